@@ -0,0 +1,74 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fem/internal/middleware"
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fem/internal/utils"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type ExportHandler struct {
+	exportStore store.ExportStore
+	logger      *log.Logger
+}
+
+func NewExportHandler(exportStore store.ExportStore, logger *log.Logger) *ExportHandler {
+	return &ExportHandler{
+		exportStore: exportStore,
+		logger:      logger,
+	}
+}
+
+// HandleCreateExport queues a data export; the archive is built in the background
+func (h *ExportHandler) HandleCreateExport(w http.ResponseWriter, r *http.Request) {
+	export, err := h.exportStore.CreateExport(r.Context(), middleware.GetUser(r).ID)
+	if err != nil {
+		h.logger.Printf("error CreateExport %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/users/me/exports/"+export.ID)
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"export": export})
+}
+
+func (h *ExportHandler) HandleGetExport(w http.ResponseWriter, r *http.Request) {
+	export, err := h.exportStore.GetExport(r.Context(), middleware.GetUser(r).ID, chi.URLParam(r, "id"))
+	if err != nil {
+		h.logger.Printf("error GetExport %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if export == nil {
+		problem.Write(w, r, problem.NotFound("export not found"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"export": export})
+}
+
+func (h *ExportHandler) HandleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	archive, err := h.exportStore.GetExportArchive(r.Context(), middleware.GetUser(r).ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.NotFound("export not found, not ready yet or expired"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error GetExportArchive %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="fem-export-`+id+`.zip"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fem/internal/dto"
+	"fem/internal/middleware"
+	"fem/internal/oidc"
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fem/internal/utils"
+	"fem/internal/validate"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// usernameAttempts is how many names are tried for an account created at first sign-in
+const usernameAttempts = 5
+
+type OIDCHandler struct {
+	providers        map[string]*oidc.Provider
+	identityStore    store.IdentityStore
+	userStore        store.UserStore
+	tokenStore       store.TokenStore
+	unverifiedPolicy middleware.UnverifiedPolicy
+	cookies          middleware.Cookies
+	logger           *log.Logger
+}
+
+func NewOIDCHandler(providers []*oidc.Provider, identityStore store.IdentityStore, userStore store.UserStore, tokenStore store.TokenStore, unverifiedPolicy middleware.UnverifiedPolicy, cookies middleware.Cookies, logger *log.Logger) *OIDCHandler {
+	byName := make(map[string]*oidc.Provider, len(providers))
+	for _, p := range providers {
+		byName[p.Name()] = p
+	}
+	return &OIDCHandler{
+		providers:        byName,
+		identityStore:    identityStore,
+		userStore:        userStore,
+		tokenStore:       tokenStore,
+		unverifiedPolicy: unverifiedPolicy,
+		cookies:          cookies,
+		logger:           logger,
+	}
+}
+
+func (h *OIDCHandler) provider(w http.ResponseWriter, r *http.Request) (*oidc.Provider, bool) {
+	p, ok := h.providers[chi.URLParam(r, "provider")]
+	if !ok {
+		problem.Write(w, r, problem.NotFound("unknown identity provider"))
+		return nil, false
+	}
+	return p, true
+}
+
+func providerUnreachable() *problem.Problem {
+	return problem.New(http.StatusBadGateway, problem.CodeUnavailable, "identity provider could not be reached, try again later")
+}
+
+// HandleLoginOptions starts a login at the provider. the client sends the user to
+// authorization_url; the provider sends them back to its redirect URL with a code and state
+func (h *OIDCHandler) HandleLoginOptions(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	authReq, err := oidc.NewAuthRequest()
+	if err != nil {
+		h.logger.Printf("error NewAuthRequest %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	authURL, err := p.AuthCodeURL(r.Context(), authReq)
+	if err != nil {
+		h.logger.Printf("error AuthCodeURL %s %v", p.Name(), err)
+		problem.Write(w, r, providerUnreachable())
+		return
+	}
+
+	err = h.identityStore.SaveOIDCLogin(r.Context(), authReq.State, store.OIDCLogin{
+		Provider:     p.Name(),
+		Nonce:        authReq.Nonce,
+		CodeVerifier: authReq.Verifier,
+	}, oidc.LoginTTL)
+	if err != nil {
+		h.logger.Printf("error SaveOIDCLogin %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"authorization_url": authURL,
+		"state":             authReq.State,
+	})
+}
+
+// HandleLogin finishes a login with the code and state the provider redirected back with,
+// and hands out the same token pair a password login gets
+func (h *OIDCHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.provider(w, r)
+	if !ok {
+		return
+	}
+
+	var req dto.OIDCLoginDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding oidc login %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	expired := problem.New(http.StatusBadRequest, problem.CodeInvalidToken, "login expired or unknown, start again")
+
+	login, err := h.identityStore.ConsumeOIDCLogin(r.Context(), req.State)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, expired)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error ConsumeOIDCLogin %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if login.Provider != p.Name() {
+		problem.Write(w, r, expired)
+		return
+	}
+
+	rejected := problem.Unauthorized(problem.CodeInvalidCredentials, "identity provider login could not be verified")
+
+	idToken, err := p.Exchange(r.Context(), req.Code, login.CodeVerifier)
+	if errors.Is(err, oidc.ErrExchange) {
+		h.logger.Printf("WARN: %v", err)
+		problem.Write(w, r, rejected)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error Exchange %s %v", p.Name(), err)
+		problem.Write(w, r, providerUnreachable())
+		return
+	}
+	claims, err := p.VerifyIDToken(r.Context(), idToken, login.Nonce)
+	if errors.Is(err, oidc.ErrVerification) {
+		h.logger.Printf("WARN: %v", err)
+		problem.Write(w, r, rejected)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error VerifyIDToken %s %v", p.Name(), err)
+		problem.Write(w, r, providerUnreachable())
+		return
+	}
+
+	user, prob, err := h.resolveUser(r.Context(), p.Name(), claims)
+	if err != nil {
+		h.logger.Printf("error resolving oidc user %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if prob != nil {
+		problem.Write(w, r, prob)
+		return
+	}
+
+	if h.unverifiedPolicy == middleware.UnverifiedBlock && !user.EmailVerified {
+		problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeEmailUnverified, "confirm your email address before logging in"))
+		return
+	}
+	// the provider stands in for the password, not for the second factor
+	if user.TwoFactorEnabled {
+		writeTwoFactorChallenge(w, r, h.tokenStore, h.logger, user.ID)
+		return
+	}
+
+	pair, err := h.tokenStore.CreateTokenPair(r.Context(), user.ID, middleware.ClientInfo(r))
+	if err != nil {
+		h.logger.Printf("error CreateTokenPair %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeTokenPair(w, r, h.cookies, h.logger, pair)
+}
+
+// resolveUser finds the account an external identity signs in to. an unknown identity is
+// linked to the account with the same email when both sides have verified it, or gets a
+// new account without a password when no account has that email.
+// linking to an unverified account would hand it to whoever registered the address first
+func (h *OIDCHandler) resolveUser(ctx context.Context, provider string, claims *oidc.Claims) (*store.User, *problem.Problem, error) {
+	user, err := h.identityStore.UseIdentity(ctx, provider, claims.Subject)
+	if err != nil || user != nil {
+		return user, nil, err
+	}
+
+	if claims.Email == "" {
+		return nil, problem.BadRequest("the identity provider did not share an email address"), nil
+	}
+	if !claims.EmailVerified {
+		return nil, problem.New(http.StatusForbidden, problem.CodeEmailUnverified, "the identity provider has not verified your email address"), nil
+	}
+	identity := &store.Identity{Provider: provider, Subject: claims.Subject, Email: claims.Email}
+
+	existing, err := h.userStore.GetUserByEmail(ctx, claims.Email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing != nil {
+		if !existing.EmailVerified {
+			return nil, problem.New(http.StatusConflict, problem.CodeConflict,
+				"an account with this email exists but has not verified it; log in with its password and verify the address first"), nil
+		}
+		identity.UserID = existing.ID
+		err = h.identityStore.LinkIdentity(ctx, identity)
+		if err != nil {
+			return nil, nil, err
+		}
+		return existing, nil, nil
+	}
+
+	user = &store.User{Email: claims.Email, EmailVerified: true}
+	for attempt := range usernameAttempts {
+		user.Username = claims.UsernameHint()
+		if attempt > 0 {
+			n, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return nil, nil, err
+			}
+			user.Username = fmt.Sprintf("%s-%04d", user.Username, n)
+		}
+
+		err = h.identityStore.CreateUserWithIdentity(ctx, user, identity)
+		if errors.Is(err, store.ErrUsernameTaken) || errors.Is(err, store.ErrUsernameReserved) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, nil, nil
+	}
+	return nil, problem.New(http.StatusConflict, problem.CodeConflict, "could not find a free username, try again"), nil
+}
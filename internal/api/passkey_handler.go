@@ -0,0 +1,301 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fem/internal/dto"
+	"fem/internal/middleware"
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fem/internal/utils"
+	"fem/internal/validate"
+	"fem/internal/webauthn"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type PasskeyHandler struct {
+	passkeyStore     store.PasskeyStore
+	userStore        store.UserStore
+	tokenStore       store.TokenStore
+	webauthn         webauthn.Config
+	unverifiedPolicy middleware.UnverifiedPolicy
+	cookies          middleware.Cookies
+	logger           *log.Logger
+}
+
+func NewPasskeyHandler(passkeyStore store.PasskeyStore, userStore store.UserStore, tokenStore store.TokenStore, webauthnCfg webauthn.Config, unverifiedPolicy middleware.UnverifiedPolicy, cookies middleware.Cookies, logger *log.Logger) *PasskeyHandler {
+	return &PasskeyHandler{
+		passkeyStore:     passkeyStore,
+		userStore:        userStore,
+		tokenStore:       tokenStore,
+		webauthn:         webauthnCfg,
+		unverifiedPolicy: unverifiedPolicy,
+		cookies:          cookies,
+		logger:           logger,
+	}
+}
+
+// userHandle is the WebAuthn user id of an account
+func userHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// decodeBinary decodes a base64url request field, adding a validation error when it is not
+func decodeBinary(errs *[]problem.FieldError, pointer, s string) []byte {
+	b, err := webauthn.DecodeBase64URL(s)
+	if err != nil {
+		*errs = append(*errs, problem.FieldError{Pointer: pointer, Detail: "must be base64url"})
+	}
+	return b
+}
+
+func challengeProblem() *problem.Problem {
+	return problem.New(http.StatusBadRequest, problem.CodeInvalidToken, "challenge expired or unknown, request new options")
+}
+
+// HandleRegistrationOptions starts adding a passkey to the current account
+func (h *PasskeyHandler) HandleRegistrationOptions(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok {
+		return
+	}
+
+	passkeys, err := h.passkeyStore.ListPasskeys(r.Context(), user.ID)
+	if err != nil {
+		h.logger.Printf("error ListPasskeys %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	exclude := make([][]byte, len(passkeys))
+	for i, passkey := range passkeys {
+		exclude[i] = passkey.Credential.ID
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		h.logger.Printf("error NewChallenge %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	err = h.passkeyStore.SaveChallenge(r.Context(), store.CeremonyRegistration, user.ID, challenge)
+	if err != nil {
+		h.logger.Printf("error SaveChallenge %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	entity := webauthn.UserEntity{ID: userHandle(user.ID), Name: user.Username, DisplayName: user.Username}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"options": h.webauthn.CreationOptions(entity, challenge, exclude),
+	})
+}
+
+func (h *PasskeyHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	var req dto.RegisterPasskeyDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding passkey registration %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	errs := validate.Struct(&req)
+	credentialID := decodeBinary(&errs, "/credential/id", req.Credential.ID)
+	clientData := decodeBinary(&errs, "/credential/response/clientDataJSON", req.Credential.Response.ClientDataJSON)
+	attestation := decodeBinary(&errs, "/credential/response/attestationObject", req.Credential.Response.AttestationObject)
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	challenge, err := webauthn.Challenge(clientData)
+	if err != nil {
+		problem.Write(w, r, problem.BadRequest(err.Error()))
+		return
+	}
+	owner, err := h.passkeyStore.ConsumeChallenge(r.Context(), store.CeremonyRegistration, challenge)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, challengeProblem())
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error ConsumeChallenge %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	userID := middleware.GetUser(r).ID
+	if owner != userID {
+		problem.Write(w, r, challengeProblem())
+		return
+	}
+
+	cred, err := h.webauthn.VerifyRegistration(challenge, clientData, attestation)
+	if err != nil {
+		problem.Write(w, r, problem.BadRequest("passkey could not be verified: "+err.Error()))
+		return
+	}
+	if string(cred.ID) != string(credentialID) {
+		problem.Write(w, r, problem.BadRequest("credential id does not match the authenticator data"))
+		return
+	}
+
+	passkey, err := h.passkeyStore.CreatePasskey(r.Context(), userID, req.Name, cred)
+	if err != nil {
+		h.logger.Printf("error CreatePasskey %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"passkey": passkey})
+}
+
+func (h *PasskeyHandler) HandleListPasskeys(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := h.passkeyStore.ListPasskeys(r.Context(), middleware.GetUser(r).ID)
+	if err != nil {
+		h.logger.Printf("error ListPasskeys %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"passkeys": passkeys})
+}
+
+func (h *PasskeyHandler) HandleDeletePasskey(w http.ResponseWriter, r *http.Request) {
+	err := h.passkeyStore.DeletePasskey(r.Context(), middleware.GetUser(r).ID, chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.NotFound("passkey not found"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error DeletePasskey %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLoginOptions starts a passkey login. the browser offers whichever passkeys it holds
+// for this site, so no username is needed and none is revealed
+func (h *PasskeyHandler) HandleLoginOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		h.logger.Printf("error NewChallenge %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	err = h.passkeyStore.SaveChallenge(r.Context(), store.CeremonyLogin, 0, challenge)
+	if err != nil {
+		h.logger.Printf("error SaveChallenge %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"options": h.webauthn.RequestOptions(challenge)})
+}
+
+// HandleLogin trades a passkey assertion for the same token pair a password login gets
+func (h *PasskeyHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	var req dto.PasskeyLoginDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding passkey login %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	errs := validate.Struct(&req)
+	credentialID := decodeBinary(&errs, "/credential/id", req.Credential.ID)
+	clientData := decodeBinary(&errs, "/credential/response/clientDataJSON", req.Credential.Response.ClientDataJSON)
+	authData := decodeBinary(&errs, "/credential/response/authenticatorData", req.Credential.Response.AuthenticatorData)
+	signature := decodeBinary(&errs, "/credential/response/signature", req.Credential.Response.Signature)
+	handle := decodeBinary(&errs, "/credential/response/userHandle", req.Credential.Response.UserHandle)
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	challenge, err := webauthn.Challenge(clientData)
+	if err != nil {
+		problem.Write(w, r, problem.BadRequest(err.Error()))
+		return
+	}
+	_, err = h.passkeyStore.ConsumeChallenge(r.Context(), store.CeremonyLogin, challenge)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, challengeProblem())
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error ConsumeChallenge %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	rejected := problem.Unauthorized(problem.CodeInvalidCredentials, "passkey could not be verified")
+	cloned := problem.Unauthorized(problem.CodeInvalidCredentials, "passkey sign count went backwards; it may have been cloned and was not accepted")
+
+	passkey, err := h.passkeyStore.GetPasskey(r.Context(), credentialID)
+	if err != nil {
+		h.logger.Printf("error GetPasskey %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if passkey == nil || (len(handle) > 0 && string(handle) != string(userHandle(passkey.UserID))) {
+		problem.Write(w, r, rejected)
+		return
+	}
+
+	signCount, err := h.webauthn.VerifyAssertion(challenge, passkey.Credential, clientData, authData, signature)
+	if errors.Is(err, webauthn.ErrCloned) {
+		h.logger.Printf("WARN: passkey %s of user %d presented sign count %d after %d, possible clone",
+			passkey.ID, passkey.UserID, signCount, passkey.Credential.SignCount)
+		problem.Write(w, r, cloned)
+		return
+	}
+	if err != nil {
+		problem.Write(w, r, rejected)
+		return
+	}
+
+	// a parallel login may have stored the same or a higher count since GetPasskey
+	err = h.passkeyStore.UsePasskey(r.Context(), credentialID, signCount)
+	if errors.Is(err, webauthn.ErrCloned) {
+		h.logger.Printf("WARN: passkey %s of user %d presented sign count %d that was already used, possible clone",
+			passkey.ID, passkey.UserID, signCount)
+		problem.Write(w, r, cloned)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error UsePasskey %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), passkey.UserID)
+	if err != nil {
+		h.logger.Printf("error GetUserByID %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if user == nil {
+		problem.Write(w, r, rejected)
+		return
+	}
+	if h.unverifiedPolicy == middleware.UnverifiedBlock && !user.EmailVerified {
+		problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeEmailUnverified, "confirm your email address before logging in"))
+		return
+	}
+
+	pair, err := h.tokenStore.CreateTokenPair(r.Context(), user.ID, middleware.ClientInfo(r))
+	if err != nil {
+		h.logger.Printf("error CreateTokenPair %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeTokenPair(w, r, h.cookies, h.logger, pair)
+}
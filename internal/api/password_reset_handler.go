@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fem/internal/dto"
+	"fem/internal/mailer"
+	"fem/internal/passhash"
+	"fem/internal/passpolicy"
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fem/internal/tokens"
+	"fem/internal/utils"
+	"fem/internal/validate"
+	"log"
+	"net/http"
+)
+
+type PasswordResetHandler struct {
+	userStore      store.UserStore
+	tokenStore     store.TokenStore
+	denylist       *tokens.MemoryDenylist
+	mailer         mailer.Mailer
+	hasher         passhash.Hasher
+	passwordPolicy passpolicy.Policy
+	logger         *log.Logger
+}
+
+func NewPasswordResetHandler(userStore store.UserStore, tokenStore store.TokenStore, denylist *tokens.MemoryDenylist, mailer mailer.Mailer, hasher passhash.Hasher, passwordPolicy passpolicy.Policy, logger *log.Logger) *PasswordResetHandler {
+	return &PasswordResetHandler{
+		userStore:      userStore,
+		tokenStore:     tokenStore,
+		denylist:       denylist,
+		mailer:         mailer,
+		hasher:         hasher,
+		passwordPolicy: passwordPolicy,
+		logger:         logger,
+	}
+}
+
+// HandleRequestReset always answers 202, so it cannot be used to find out which
+// addresses are registered
+func (h *PasswordResetHandler) HandleRequestReset(w http.ResponseWriter, r *http.Request) {
+	var req dto.PasswordResetRequestDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding password reset request %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user, err := h.userStore.GetUserByEmail(r.Context(), req.Email)
+	if err != nil {
+		h.logger.Printf("error GetUserByEmail %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if user != nil {
+		// sent in the background so the response time does not give the answer away either
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), backgroundMailTimeout)
+			defer cancel()
+
+			err := h.sendReset(ctx, user)
+			if err != nil {
+				h.logger.Printf("error sending password reset email %v", err)
+			}
+		}()
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
+		"message": "if the address belongs to an account, a password reset email is on its way",
+	})
+}
+
+func (h *PasswordResetHandler) HandleConfirmReset(w http.ResponseWriter, r *http.Request) {
+	var req dto.PasswordResetConfirmDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding password reset confirmation %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	invalidToken := problem.New(http.StatusBadRequest, problem.CodeInvalidToken, "password reset token expired, used or invalid")
+
+	// looked up first so the new password can be checked against the account's name
+	owner, err := h.userStore.GetUserByToken(r.Context(), tokens.ScopePasswordReset, req.Token)
+	if err != nil {
+		h.logger.Printf("error GetUserByToken %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if owner == nil {
+		problem.Write(w, r, invalidToken)
+		return
+	}
+	if errs := checkPasswordPolicy(nil, h.passwordPolicy, "/password", req.Password, owner.Username, owner.Email); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user := &store.User{}
+	err = user.PasswordHash.Set(h.hasher, req.Password)
+	if err != nil {
+		h.logger.Printf("error hasing password %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	revoked, err := h.userStore.ResetPassword(r.Context(), req.Token, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, invalidToken)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error ResetPassword %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	deny(h.denylist, revoked)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendReset replaces any reset token still outstanding, so only the latest email works
+func (h *PasswordResetHandler) sendReset(ctx context.Context, user *store.User) error {
+	_, err := h.tokenStore.DeleteUserTokens(ctx, user.ID, tokens.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	token, err := h.tokenStore.CreateNewToken(ctx, user.ID, tokens.PasswordResetTokenTTL, tokens.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	return h.mailer.Send(ctx, mailer.ResetPassword(user.Email, user.Username, token.Plaintext))
+}
@@ -1,75 +1,401 @@
 package api
 
 import (
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fem/internal/dto"
+	"fem/internal/lockout"
+	"fem/internal/middleware"
+	"fem/internal/passhash"
+	"fem/internal/problem"
 	"fem/internal/store"
 	"fem/internal/tokens"
 	"fem/internal/utils"
+	"fem/internal/validate"
 	"log"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type TokenHandler struct {
-	tokenStore store.TokenStore
-	userStore  store.UserStore
-	logger     *log.Logger
+	tokenStore       store.TokenStore
+	denylist         *tokens.MemoryDenylist
+	userStore        store.UserStore
+	unverifiedPolicy middleware.UnverifiedPolicy
+	guard            *lockout.Guard
+	hasher           passhash.Hasher
+	cookies          middleware.Cookies
+	logger           *log.Logger
 }
 
-func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, logger *log.Logger) *TokenHandler {
+func NewTokenHandler(tokenStore store.TokenStore, denylist *tokens.MemoryDenylist, userStore store.UserStore, unverifiedPolicy middleware.UnverifiedPolicy, guard *lockout.Guard, hasher passhash.Hasher, cookies middleware.Cookies, logger *log.Logger) *TokenHandler {
 	return &TokenHandler{
-		tokenStore: tokenStore,
-		userStore:  userStore,
-		logger:     logger,
+		tokenStore:       tokenStore,
+		denylist:         denylist,
+		userStore:        userStore,
+		unverifiedPolicy: unverifiedPolicy,
+		guard:            guard,
+		hasher:           hasher,
+		cookies:          cookies,
+		logger:           logger,
 	}
 }
 
 func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 	var req dto.CreateTokenDTO
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := utils.ReadJSON(w, r, &req)
 	if err != nil {
 		h.logger.Printf("error creating token %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{
-			"error": "invalid request payload",
-		})
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
 		return
 	}
 
-	user, err := h.userStore.GetUserByUsername(req.Username)
-	if err != nil || user == nil {
-		h.logger.Printf("error GetUserByUsername %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{
-			"error": "internal server error",
-		})
+	ip := utils.ClientIP(r)
+
+	// checked before any password work, so a locked out caller costs no hashing time
+	wait, err := h.guard.Attempt(r.Context(), req.Username, ip)
+	if err != nil {
+		h.logger.Printf("error guard.Attempt %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, r, wait)
 		return
 	}
 
-	passwordsMatch, err := user.PasswordHash.Matches(req.Password)
+	user, err := h.userStore.GetUserByUsername(r.Context(), req.Username)
 	if err != nil {
-		h.logger.Printf("error PasswordHash.Matches %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{
-			"error": "internal server error",
-		})
+		h.logger.Printf("error GetUserByUsername %v", err)
+		giveBackAttempt(r, h.logger, h.guard, req.Username, ip)
+		problem.WriteError(w, r, err)
 		return
 	}
 
+	passwordsMatch := false
+	if user == nil {
+		store.SimulatePasswordCheck(h.hasher, req.Password)
+	} else {
+		passwordsMatch, err = user.PasswordHash.Matches(h.hasher, req.Password)
+		if err != nil {
+			h.logger.Printf("error PasswordHash.Matches %v", err)
+			giveBackAttempt(r, h.logger, h.guard, req.Username, ip)
+			problem.Write(w, r, problem.Internal())
+			return
+		}
+	}
+
 	if !passwordsMatch {
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{
-			"error": "invalid login attempt",
-		})
+		err = h.guard.Failed(r.Context(), req.Username, ip)
+		if err != nil {
+			h.logger.Printf("error guard.Failed %v", err)
+		}
+		problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidCredentials, "invalid login attempt"))
+		return
+	}
+
+	// the plaintext is only at hand now, so this is when old hashes get upgraded.
+	// a failure leaves the old hash in place, which still works
+	if user.PasswordHash.NeedsRehash(h.hasher) {
+		err = h.userStore.RehashPassword(r.Context(), user, h.hasher, req.Password)
+		if err != nil {
+			h.logger.Printf("WARN: rehashing password of user %d %v", user.ID, err)
+		}
+	}
+
+	// failures are only forgotten once the second factor checks out as well,
+	// otherwise knowing the password would reset the budget for guessing codes
+	if user.TwoFactorEnabled || (h.unverifiedPolicy == middleware.UnverifiedBlock && !user.EmailVerified) {
+		err = h.guard.Passed(r.Context(), req.Username, ip)
+		if err != nil {
+			h.logger.Printf("error guard.Passed %v", err)
+		}
+	}
+
+	if h.unverifiedPolicy == middleware.UnverifiedBlock && !user.EmailVerified {
+		problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeEmailUnverified, "confirm your email address before logging in"))
 		return
 	}
 
-	token, err := h.tokenStore.CreateNewToken(user.ID, 24*time.Hour, tokens.ScopeAuth)
+	if user.TwoFactorEnabled {
+		writeTwoFactorChallenge(w, r, h.tokenStore, h.logger, user.ID)
+		return
+	}
+
+	err = h.guard.Succeeded(r.Context(), req.Username, ip)
+	if err != nil {
+		h.logger.Printf("error guard.Succeeded %v", err)
+	}
+
+	pair, err := h.tokenStore.CreateTokenPair(r.Context(), user.ID, middleware.ClientInfo(r))
+	if err != nil {
+		h.logger.Printf("error CreateTokenPair %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeTokenPair(w, r, h.cookies, h.logger, pair)
+}
+
+// giveBackAttempt returns an attempt the guard reserved when the check behind it failed
+// with an internal error; that says nothing about the credentials, so it must not count
+func giveBackAttempt(r *http.Request, logger *log.Logger, guard *lockout.Guard, username, ip string) {
+	err := guard.Passed(r.Context(), username, ip)
 	if err != nil {
-		h.logger.Printf("error CreateNewToken %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{
-			"error": "internal server error",
+		logger.Printf("error guard.Passed %v", err)
+	}
+}
+
+// writeTokenPair answers a successful login or refresh. browsers asking for ?session=cookie
+// get the tokens as HttpOnly cookies, and only the CSRF token and auth expiry in the body
+func writeTokenPair(w http.ResponseWriter, r *http.Request, cookies middleware.Cookies, logger *log.Logger, pair *store.TokenPair) {
+	if !middleware.WantsCookies(r) {
+		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{
+			"auth_token":    pair.Auth,
+			"refresh_token": pair.Refresh,
 		})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": token})
+	csrf, err := cookies.SetSession(w, pair)
+	if err != nil {
+		logger.Printf("error SetSession %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{
+		"csrf_token": csrf,
+		"expiry":     pair.Auth.Expiry,
+	})
+}
+
+// writeTwoFactorChallenge answers a login whose first factor checked out with the token
+// to finish it at POST /tokens/2fa
+func writeTwoFactorChallenge(w http.ResponseWriter, r *http.Request, tokenStore store.TokenStore, logger *log.Logger, userID int) {
+	challenge, err := tokenStore.CreateNewToken(r.Context(), userID, tokens.TwoFactorChallengeTTL, tokens.ScopeTwoFactor)
+	if err != nil {
+		logger.Printf("error creating 2fa challenge %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"two_factor_required": true,
+		"challenge_token":     challenge,
+	})
+}
+
+// writeTooManyAttempts tells a caller to back off for wait, rounded up to whole seconds
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	problem.Write(w, r, problem.New(http.StatusTooManyRequests, problem.CodeTooManyAttempts,
+		"too many failed login attempts, try again in "+strconv.Itoa(seconds)+" seconds"))
+}
+
+// HandleRefreshToken rotates a refresh token. browser sessions (?session=cookie) send
+// no body, the refresh token comes from its cookie
+func (h *TokenHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	refreshToken, ok := h.readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	pair, err := h.tokenStore.RotateRefreshToken(r.Context(), refreshToken, middleware.ClientInfo(r))
+	if errors.Is(err, sql.ErrNoRows) {
+		h.endCookieSession(w, r)
+		problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "refresh token expired or invalid"))
+		return
+	}
+	if reused := (*store.TokenReusedError)(nil); errors.As(err, &reused) {
+		deny(h.denylist, reused.Revoked)
+		h.logger.Printf("WARN: refresh token reuse detected, token family revoked")
+		h.endCookieSession(w, r)
+		problem.Write(w, r, problem.Unauthorized(problem.CodeTokenReused, "refresh token was already used; all related sessions have been revoked"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error RotateRefreshToken %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeTokenPair(w, r, h.cookies, h.logger, pair)
+}
+
+func (h *TokenHandler) readRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if middleware.WantsCookies(r) {
+		// the refresh cookie is SameSite=Strict already, this covers browsers ignoring that
+		if !h.cookies.CheckCSRF(r) {
+			problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeCSRFFailed, "missing or wrong "+middleware.CSRFHeader+" header"))
+			return "", false
+		}
+		refreshToken := h.cookies.RefreshToken(r)
+		if refreshToken == "" {
+			problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "no session cookie"))
+			return "", false
+		}
+		return refreshToken, true
+	}
+
+	var req dto.RefreshTokenDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding refresh request %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return "", false
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return "", false
+	}
+	return req.RefreshToken, true
+}
+
+// deny makes this instance refuse revoked signed access tokens right away instead of
+// after the next denylist refresh. denylist is nil when access tokens are opaque
+func deny(denylist *tokens.MemoryDenylist, revoked store.RevokedTokens) {
+	if denylist == nil {
+		return
+	}
+	for jti, expiry := range revoked {
+		denylist.Deny(jti, expiry)
+	}
+}
+
+// endCookieSession drops the cookies of a browser session that is over
+func (h *TokenHandler) endCookieSession(w http.ResponseWriter, r *http.Request) {
+	if middleware.WantsCookies(r) || middleware.FromCookie(r) {
+		h.cookies.ClearSession(w)
+	}
+}
+
+func (h *TokenHandler) HandleRevokeCurrentToken(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	revoked, err := h.tokenStore.RevokeSessionByToken(r.Context(), user.ID, middleware.GetTokenHash(r))
+	if err != nil {
+		h.logger.Printf("error RevokeSessionByToken %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	deny(h.denylist, revoked)
+
+	h.endCookieSession(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TokenHandler) HandleRevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh} {
+		revoked, err := h.tokenStore.DeleteUserTokens(r.Context(), user.ID, scope)
+		if err != nil {
+			h.logger.Printf("error DeleteUserTokens %v", err)
+			problem.WriteError(w, r, err)
+			return
+		}
+		deny(h.denylist, revoked)
+	}
+
+	h.endCookieSession(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TokenHandler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	sessions, err := h.tokenStore.ListSessions(r.Context(), user.ID, middleware.GetTokenHash(r))
+	if err != nil {
+		h.logger.Printf("error ListSessions %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions})
+}
+
+func (h *TokenHandler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	sessionID := chi.URLParam(r, "id")
+
+	revoked, err := h.tokenStore.RevokeSession(r.Context(), user.ID, sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.NotFound("session not found"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error RevokeSession %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	deny(h.denylist, revoked)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TokenHandler) HandleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	var req dto.CreateAPITokenDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding api token request %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	var expiry time.Time
+	if req.ExpiresAt != nil {
+		expiry = *req.ExpiresAt
+	}
+	slices.Sort(req.Scopes)
+
+	apiToken, err := h.tokenStore.CreateAPIToken(r.Context(), middleware.GetUser(r).ID, req.Name, slices.Compact(req.Scopes), expiry)
+	if err != nil {
+		h.logger.Printf("error CreateAPIToken %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_token": apiToken})
+}
+
+func (h *TokenHandler) HandleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	apiTokens, err := h.tokenStore.ListAPITokens(r.Context(), middleware.GetUser(r).ID)
+	if err != nil {
+		h.logger.Printf("error ListAPITokens %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_tokens": apiTokens})
+}
+
+func (h *TokenHandler) HandleRevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := h.tokenStore.RevokeAPIToken(r.Context(), middleware.GetUser(r).ID, chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.NotFound("api token not found"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error RevokeAPIToken %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"fem/internal/lockout"
+	"fem/internal/middleware"
+	"fem/internal/store"
+	"fem/internal/tokens"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type emptyDenylistSource struct{}
+
+func (emptyDenylistSource) ListDenied(context.Context) (map[string]time.Time, error) {
+	return map[string]time.Time{}, nil
+}
+
+// revokingTokenStore knows a single signed access token and revokes it on logout
+type revokingTokenStore struct {
+	store.TokenStore
+	token *tokens.Token
+}
+
+func (s *revokingTokenStore) RevokeSessionByToken(ctx context.Context, userID int, hash []byte) (store.RevokedTokens, error) {
+	return store.RevokedTokens{s.token.ID: s.token.Expiry}, nil
+}
+
+func TestLogoutDeniesSignedTokenOnThisInstance(t *testing.T) {
+	keys, err := tokens.ParseKeySet("k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	require.NoError(t, err)
+	format := tokens.Signed{Keys: keys}
+
+	token, err := format.Generate(7, tokens.AuthTokenTTL, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	// no refresh happens during the test, so only Deny can refuse the token
+	denylist := tokens.NewMemoryDenylist(emptyDenylistSource{})
+	require.NoError(t, denylist.Refresh(context.Background()))
+
+	tokenStore := &revokingTokenStore{token: token}
+	um := &middleware.UserMiddleware{TokenStore: tokenStore, TokenFormat: format, Denylist: denylist}
+	h := NewTokenHandler(tokenStore, denylist, nil, middleware.UnverifiedAllow, nil, nil, middleware.Cookies{}, log.New(io.Discard, "", 0))
+
+	r := chi.NewRouter()
+	r.Use(um.Authenticate, um.IsAuthed)
+	r.Get("/users/me", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Delete("/tokens/current", h.HandleRevokeCurrentToken)
+
+	send := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/users/me"))
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/tokens/current"))
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/users/me"))
+}
+
+// countingLockoutStore lets every attempt through and counts the reserved ones per key
+type countingLockoutStore struct {
+	mu       sync.Mutex
+	reserved map[string]int
+}
+
+func (s *countingLockoutStore) GetFailures(ctx context.Context, key string) (lockout.Record, error) {
+	return lockout.Record{}, nil
+}
+
+func (s *countingLockoutStore) Reserve(ctx context.Context, key string, at time.Time, window time.Duration, allow func(lockout.Record) bool) (lockout.Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reserved[key]++
+	return lockout.Record{Failures: s.reserved[key]}, true, nil
+}
+
+func (s *countingLockoutStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reserved[key]--
+	return nil
+}
+
+func (s *countingLockoutStore) Lock(ctx context.Context, key string, until time.Time) error {
+	return nil
+}
+
+func (s *countingLockoutStore) ResetFailures(ctx context.Context, key string) error {
+	return nil
+}
+
+type failingUserStore struct {
+	store.UserStore
+}
+
+func (failingUserStore) GetUserByUsername(ctx context.Context, username string) (*store.User, error) {
+	return nil, errors.New("db down")
+}
+
+func TestLoginGivesBackAttemptOnInternalError(t *testing.T) {
+	lockoutStore := &countingLockoutStore{reserved: map[string]int{}}
+	guard := lockout.NewGuard(lockoutStore, lockout.DefaultAccountPolicy, lockout.DefaultIPPolicy, nil)
+	h := NewTokenHandler(nil, nil, failingUserStore{}, middleware.UnverifiedAllow, guard, nil, middleware.Cookies{}, log.New(io.Discard, "", 0))
+
+	req := httptest.NewRequest(http.MethodPost, "/tokens/auth", strings.NewReader(`{"username":"jane","password":"hunter22"}`))
+	w := httptest.NewRecorder()
+	h.HandleCreateToken(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	require.NotEmpty(t, lockoutStore.reserved)
+	for key, n := range lockoutStore.reserved {
+		assert.Zero(t, n, key)
+	}
+}
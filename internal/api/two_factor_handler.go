@@ -0,0 +1,362 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fem/internal/dto"
+	"fem/internal/lockout"
+	"fem/internal/middleware"
+	"fem/internal/passhash"
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fem/internal/tokens"
+	"fem/internal/totp"
+	"fem/internal/utils"
+	"fem/internal/validate"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TOTPIssuer is the account name prefix authenticator apps show
+const TOTPIssuer = "fem"
+
+type TwoFactorHandler struct {
+	userStore      store.UserStore
+	twoFactorStore store.TwoFactorStore
+	tokenStore     store.TokenStore
+	// cipher encrypts TOTP secrets at rest; nil when no key is configured, which turns 2FA off
+	cipher  *totp.Cipher
+	guard   *lockout.Guard
+	hasher  passhash.Hasher
+	cookies middleware.Cookies
+	logger  *log.Logger
+}
+
+func NewTwoFactorHandler(userStore store.UserStore, twoFactorStore store.TwoFactorStore, tokenStore store.TokenStore, cipher *totp.Cipher, guard *lockout.Guard, hasher passhash.Hasher, cookies middleware.Cookies, logger *log.Logger) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		userStore:      userStore,
+		twoFactorStore: twoFactorStore,
+		tokenStore:     tokenStore,
+		cipher:         cipher,
+		guard:          guard,
+		hasher:         hasher,
+		cookies:        cookies,
+		logger:         logger,
+	}
+}
+
+func (h *TwoFactorHandler) available(w http.ResponseWriter, r *http.Request) bool {
+	if h.cipher == nil {
+		problem.Write(w, r, problem.New(http.StatusServiceUnavailable, problem.CodeUnavailable, "two-factor authentication is not configured on this server"))
+		return false
+	}
+	return true
+}
+
+// HandleEnroll starts turning on 2FA: it hands out a new secret, which only takes
+// effect once a code generated from it is sent to HandleConfirm
+func (h *TwoFactorHandler) HandleEnroll(w http.ResponseWriter, r *http.Request) {
+	var req dto.EnrollTwoFactorDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding 2fa enrollment %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+	if !h.available(w, r) {
+		return
+	}
+
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok || !checkCurrentPassword(w, r, h.logger, h.hasher, h.guard, user, req.CurrentPassword) {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.Printf("error GenerateSecret %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	sealed, err := h.cipher.Seal(secret)
+	if err != nil {
+		h.logger.Printf("error sealing totp secret %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+
+	err = h.twoFactorStore.SetPendingTOTP(r.Context(), user.ID, sealed)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.New(http.StatusConflict, problem.CodeConflict, "two-factor authentication is already enabled"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error SetPendingTOTP %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"secret":           totp.EncodeSecret(secret),
+		"provisioning_uri": totp.URI(TOTPIssuer, user.Username, secret),
+	})
+}
+
+// HandleConfirm turns on 2FA and returns the recovery codes; they are shown this once
+func (h *TwoFactorHandler) HandleConfirm(w http.ResponseWriter, r *http.Request) {
+	var req dto.ConfirmTwoFactorDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding 2fa confirmation %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+	if !h.available(w, r) {
+		return
+	}
+
+	userID := middleware.GetUser(r).ID
+	notPending := problem.New(http.StatusConflict, problem.CodeConflict, "no two-factor enrollment is pending")
+
+	state, err := h.twoFactorStore.GetTOTP(r.Context(), userID)
+	if err != nil {
+		h.logger.Printf("error GetTOTP %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if state == nil || state.Enabled {
+		problem.Write(w, r, notPending)
+		return
+	}
+
+	secret, err := h.cipher.Open(state.Secret)
+	if err != nil {
+		h.logger.Printf("error opening totp secret %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	step, ok := totp.Validate(secret, req.Code, time.Now())
+	if !ok {
+		problem.Write(w, r, problem.Validation(problem.FieldError{Pointer: "/code", Detail: "is incorrect"}))
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(totp.RecoveryCodeCount)
+	if err != nil {
+		h.logger.Printf("error GenerateRecoveryCodes %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
+	}
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = tokens.Hash(code)
+	}
+
+	err = h.twoFactorStore.EnableTOTP(r.Context(), userID, step, hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, notPending)
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error EnableTOTP %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"recovery_codes": codes})
+}
+
+func (h *TwoFactorHandler) HandleDisable(w http.ResponseWriter, r *http.Request) {
+	var req dto.DisableTwoFactorDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding 2fa removal %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+	if !h.available(w, r) {
+		return
+	}
+
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok || !checkCurrentPassword(w, r, h.logger, h.hasher, h.guard, user, req.CurrentPassword) {
+		return
+	}
+	// an enrollment that was never confirmed has no second factor to ask for yet
+	if user.TwoFactorEnabled && !h.checkDisableFactor(w, r, user, req) {
+		return
+	}
+
+	err = h.twoFactorStore.DisableTOTP(r.Context(), user.ID)
+	if err != nil {
+		h.logger.Printf("error DisableTOTP %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLogin finishes a login started at POST /tokens/auth. failed codes count
+// against the same lockout budget as failed passwords
+func (h *TwoFactorHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	var req dto.TwoFactorLoginDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding 2fa login %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+	if !h.available(w, r) {
+		return
+	}
+
+	user, err := h.userStore.GetUserByToken(r.Context(), tokens.ScopeTwoFactor, req.ChallengeToken)
+	if err != nil {
+		h.logger.Printf("error GetUserByToken %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if user == nil {
+		problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "challenge token expired or invalid"))
+		return
+	}
+
+	ip := utils.ClientIP(r)
+	wait, err := h.guard.Attempt(r.Context(), user.Username, ip)
+	if err != nil {
+		h.logger.Printf("error guard.Attempt %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return
+	}
+
+	ok, err := h.checkSecondFactor(r.Context(), user.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		h.logger.Printf("error checking second factor %v", err)
+		giveBackAttempt(r, h.logger, h.guard, user.Username, ip)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if !ok {
+		err = h.guard.Failed(r.Context(), user.Username, ip)
+		if err != nil {
+			h.logger.Printf("error guard.Failed %v", err)
+		}
+		problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidCredentials, "invalid two-factor code"))
+		return
+	}
+
+	_, err = h.tokenStore.DeleteUserTokens(r.Context(), user.ID, tokens.ScopeTwoFactor)
+	if err != nil {
+		h.logger.Printf("error DeleteUserTokens %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	err = h.guard.Succeeded(r.Context(), user.Username, ip)
+	if err != nil {
+		h.logger.Printf("error guard.Succeeded %v", err)
+	}
+
+	pair, err := h.tokenStore.CreateTokenPair(r.Context(), user.ID, middleware.ClientInfo(r))
+	if err != nil {
+		h.logger.Printf("error CreateTokenPair %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	writeTokenPair(w, r, h.cookies, h.logger, pair)
+}
+
+// checkDisableFactor checks the code or recovery code sent to turn 2FA off. it goes
+// through the guard like a login does, so codes cannot be guessed from a session
+func (h *TwoFactorHandler) checkDisableFactor(w http.ResponseWriter, r *http.Request, user *store.User, req dto.DisableTwoFactorDTO) bool {
+	if req.Code == "" && req.RecoveryCode == "" {
+		problem.Write(w, r, problem.Validation(problem.FieldError{Pointer: "/code", Detail: "a code or recovery_code is required while two-factor authentication is on"}))
+		return false
+	}
+
+	ip := utils.ClientIP(r)
+	wait, err := h.guard.Attempt(r.Context(), user.Username, ip)
+	if err != nil {
+		h.logger.Printf("error guard.Attempt %v", err)
+		problem.WriteError(w, r, err)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return false
+	}
+
+	ok, err := h.checkSecondFactor(r.Context(), user.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		h.logger.Printf("error checking second factor %v", err)
+		giveBackAttempt(r, h.logger, h.guard, user.Username, ip)
+		problem.WriteError(w, r, err)
+		return false
+	}
+	if !ok {
+		err = h.guard.Failed(r.Context(), user.Username, ip)
+		if err != nil {
+			h.logger.Printf("error guard.Failed %v", err)
+		}
+		pointer := "/code"
+		if req.RecoveryCode != "" {
+			pointer = "/recovery_code"
+		}
+		problem.Write(w, r, problem.Validation(problem.FieldError{Pointer: pointer, Detail: "is incorrect"}))
+		return false
+	}
+
+	err = h.guard.Passed(r.Context(), user.Username, ip)
+	if err != nil {
+		h.logger.Printf("error guard.Passed %v", err)
+	}
+	return true
+}
+
+// checkSecondFactor uses up the recovery code or TOTP step, so neither works twice
+func (h *TwoFactorHandler) checkSecondFactor(ctx context.Context, userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return h.twoFactorStore.UseRecoveryCode(ctx, userID, tokens.Hash(totp.NormalizeRecoveryCode(recoveryCode)))
+	}
+
+	state, err := h.twoFactorStore.GetTOTP(ctx, userID)
+	if err != nil || state == nil || !state.Enabled {
+		return false, err
+	}
+	secret, err := h.cipher.Open(state.Secret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return h.twoFactorStore.UseTOTPStep(ctx, userID, step)
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fem/internal/middleware"
+	"fem/internal/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisableTwoFactorWithoutKey(t *testing.T) {
+	// no -totp-key: the stored secret cannot be decrypted, so the code cannot be checked
+	h := NewTwoFactorHandler(nil, nil, nil, nil, nil, nil, middleware.Cookies{}, log.New(io.Discard, "", 0))
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/me/2fa", strings.NewReader(`{"current_password":"hunter22","code":"123456"}`))
+	req = middleware.SetUser(req, &store.User{ID: 1, Username: "jane", TwoFactorEnabled: true})
+	w := httptest.NewRecorder()
+	h.HandleDisable(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
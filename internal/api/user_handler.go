@@ -1,98 +1,500 @@
 package api
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
 	"errors"
 	"fem/internal/dto"
+	"fem/internal/lockout"
+	"fem/internal/mailer"
+	"fem/internal/middleware"
+	"fem/internal/passhash"
+	"fem/internal/passpolicy"
+	"fem/internal/problem"
 	"fem/internal/store"
+	"fem/internal/tokens"
 	"fem/internal/utils"
+	"fem/internal/validate"
 	"log"
 	"net/http"
-	"regexp"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/go-chi/chi/v5"
 )
 
+// backgroundMailTimeout bounds email sent after the response went out, token
+// bookkeeping included, so a hanging relay does not pile up goroutines
+const backgroundMailTimeout = time.Minute
+
 type UserHandler struct {
-	userStore store.UserStore
-	logger    *log.Logger
+	userStore  store.UserStore
+	tokenStore store.TokenStore
+	// denylist is nil when access tokens are opaque
+	denylist *tokens.MemoryDenylist
+	mailer   mailer.Mailer
+	// deletionGracePeriod is how long a deleted account can still be restored
+	deletionGracePeriod time.Duration
+	// guard throttles wrong current passwords like failed logins
+	guard          *lockout.Guard
+	hasher         passhash.Hasher
+	passwordPolicy passpolicy.Policy
+	logger         *log.Logger
 }
 
-func NewUserHandler(userStore store.UserStore, logger *log.Logger) *UserHandler {
+func NewUserHandler(userStore store.UserStore, tokenStore store.TokenStore, denylist *tokens.MemoryDenylist, mailer mailer.Mailer, deletionGracePeriod time.Duration, guard *lockout.Guard, hasher passhash.Hasher, passwordPolicy passpolicy.Policy, logger *log.Logger) *UserHandler {
 	return &UserHandler{
-		userStore: userStore,
-		logger:    logger,
+		userStore:           userStore,
+		tokenStore:          tokenStore,
+		denylist:            denylist,
+		mailer:              mailer,
+		deletionGracePeriod: deletionGracePeriod,
+		guard:               guard,
+		hasher:              hasher,
+		passwordPolicy:      passwordPolicy,
+		logger:              logger,
 	}
 }
 
-func (h *UserHandler) validateRegisterRequest(userReq *dto.RegisterUserDTO) error {
-	if userReq.Username == "" {
-		return errors.New("username is required")
+func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request) {
+	var req dto.RegisterUserDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding request %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	errs := validate.Struct(&req)
+	errs = checkPasswordPolicy(errs, h.passwordPolicy, "/password", req.Password, req.Username, req.Email)
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
 	}
 
-	if len(userReq.Username) > 50 {
-		return errors.New("username cannot be greater than 50 characters")
+	user := &store.User{
+		Username: req.Username,
+		Email:    req.Email,
+	}
+	if req.Bio != "" {
+		user.Bio = req.Bio
 	}
 
-	if userReq.Email == "" {
-		return errors.New("email is required")
+	err = user.PasswordHash.Set(h.hasher, req.Password)
+	if err != nil {
+		h.logger.Printf("error hasing password %v", err)
+		problem.Write(w, r, problem.Internal())
+		return
 	}
 
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-	if !emailRegex.MatchString(userReq.Email) {
-		return errors.New("invalid email format")
+	err = h.userStore.CreateUser(r.Context(), user)
+
+	if err != nil {
+		h.logger.Printf("error registering user %v", err)
+		problem.WriteError(w, r, err)
+		return
 	}
 
-	if userReq.Password == "" {
-		return errors.New("password is required")
+	// the account exists either way; a lost email can be sent again
+	err = h.sendVerification(r.Context(), user)
+	if err != nil {
+		h.logger.Printf("error sending verification email %v", err)
 	}
 
-	return nil
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": user})
 }
 
-func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request) {
-	var req dto.RegisterUserDTO
+func (h *UserHandler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req dto.VerifyEmailDTO
 
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := utils.ReadJSON(w, r, &req)
 	if err != nil {
-		h.logger.Printf("error decoding request %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{
-			"error": "invalid request payload",
-		})
+		h.logger.Printf("error decoding verify request %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user, err := h.userStore.VerifyEmail(r.Context(), req.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.New(http.StatusBadRequest, problem.CodeInvalidToken, "verification token expired or invalid"))
 		return
 	}
-	err = h.validateRegisterRequest(&req)
 	if err != nil {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{
-			"error": err.Error(),
-		})
+		h.logger.Printf("error VerifyEmail %v", err)
+		problem.WriteError(w, r, err)
 		return
 	}
 
-	user := &store.User{
-		Username: req.Username,
-		Email:    req.Email,
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleResendVerification always answers 202, so it cannot be used to find out which
+// addresses are registered
+func (h *UserHandler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req dto.ResendVerificationDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding resend request %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
 	}
-	if req.Bio != "" {
-		user.Bio = req.Bio
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
 	}
 
-	err = user.PasswordHash.Set(req.Password)
+	user, err := h.userStore.GetUserByEmail(r.Context(), req.Email)
+	if err != nil {
+		h.logger.Printf("error GetUserByEmail %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if user != nil && !user.EmailVerified {
+		// sent in the background so the response time does not give the answer away either
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), backgroundMailTimeout)
+			defer cancel()
+
+			_, err := h.tokenStore.DeleteUserTokens(ctx, user.ID, tokens.ScopeVerification)
+			if err == nil {
+				err = h.sendVerification(ctx, user)
+			}
+			if err != nil {
+				h.logger.Printf("error resending verification email %v", err)
+			}
+		}()
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
+		"message": "if the address belongs to an unverified account, a new verification email is on its way",
+	})
+}
+
+func (h *UserHandler) HandleGetUserByID(w http.ResponseWriter, r *http.Request) {
+	userID, err := utils.ReadIDParam(r)
+	if err != nil {
+		h.logger.Printf("ERROR: ReadIDParam %v", err)
+		problem.Write(w, r, problem.BadRequest("invalid user id"))
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(r.Context(), int(userID))
+	if err != nil {
+		h.logger.Printf("error GetUserByID %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if user == nil {
+		problem.Write(w, r, problem.NotFound("user not found"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user.Public()})
+}
+
+// HandleGetUserByUsername redirects names given up in a recent rename to the new one
+func (h *UserHandler) HandleGetUserByUsername(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+
+	user, err := h.userStore.GetUserByUsername(r.Context(), username)
+	if err != nil {
+		h.logger.Printf("error GetUserByUsername %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if user != nil {
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user.Public()})
+		return
+	}
+
+	user, err = h.userStore.GetUserByOldUsername(r.Context(), username)
+	if err != nil {
+		h.logger.Printf("error GetUserByOldUsername %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+	if user == nil {
+		problem.Write(w, r, problem.NotFound("user not found"))
+		return
+	}
+
+	http.Redirect(w, r, "/users/by-username/"+url.PathEscape(user.Username), http.StatusTemporaryRedirect)
+}
+
+func (h *UserHandler) HandleGetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+func (h *UserHandler) HandleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	var req dto.UpdateProfileDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding profile update %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok {
+		return
+	}
+
+	if req.Username != nil {
+		user.Username = *req.Username
+	}
+	if req.Bio != nil {
+		user.Bio = *req.Bio
+	}
+
+	err = h.userStore.UpdateUser(r.Context(), user)
+	if err != nil {
+		h.logger.Printf("error UpdateUser %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleChangePassword logs out every other session, personal access tokens keep working
+func (h *UserHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req dto.ChangePasswordDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding password change %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok || !checkCurrentPassword(w, r, h.logger, h.hasher, h.guard, user, req.CurrentPassword) {
+		return
+	}
+	if errs := checkPasswordPolicy(nil, h.passwordPolicy, "/new_password", req.NewPassword, user.Username, user.Email); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	err = user.PasswordHash.Set(h.hasher, req.NewPassword)
 	if err != nil {
 		h.logger.Printf("error hasing password %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{
-			"error": "internal server error",
-		})
+		problem.Write(w, r, problem.Internal())
 		return
 	}
 
-	err = h.userStore.CreateUser(user)
+	err = h.userStore.UpdatePassword(r.Context(), user)
+	if err != nil {
+		h.logger.Printf("error UpdatePassword %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
 
+	revoked, err := h.tokenStore.RevokeOtherSessions(r.Context(), user.ID, middleware.GetTokenHash(r))
 	if err != nil {
-		h.logger.Printf("error registering user %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{
-			"error": "internal server error",
-		})
+		h.logger.Printf("error RevokeOtherSessions %v", err)
+		problem.WriteError(w, r, err)
 		return
 	}
+	deny(h.denylist, revoked)
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": user})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleChangeEmail marks the account unverified until the new address is confirmed
+func (h *UserHandler) HandleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var req dto.ChangeEmailDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding email change %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok || !checkCurrentPassword(w, r, h.logger, h.hasher, h.guard, user, req.CurrentPassword) {
+		return
+	}
+
+	user.Email = req.Email
+	err = h.userStore.UpdateEmail(r.Context(), user)
+	if err != nil {
+		h.logger.Printf("error UpdateEmail %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	err = h.sendVerification(r.Context(), user)
+	if err != nil {
+		h.logger.Printf("error sending verification email %v", err)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleDeleteMe schedules the account for deletion after the grace period, or deletes it
+// right away when there is none. until then the current session can cancel the deletion
+func (h *UserHandler) HandleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	var req dto.DeleteAccountDTO
+
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		h.logger.Printf("error decoding account deletion %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	user, ok := loadMe(w, r, h.userStore, h.logger)
+	if !ok || !checkCurrentPassword(w, r, h.logger, h.hasher, h.guard, user, req.CurrentPassword) {
+		return
+	}
+
+	if h.deletionGracePeriod <= 0 {
+		revoked, err := h.userStore.DeleteUser(r.Context(), user.ID)
+		if err != nil {
+			h.logger.Printf("error DeleteUser %v", err)
+			problem.WriteError(w, r, err)
+			return
+		}
+		deny(h.denylist, revoked)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if user.DeletionScheduledAt == nil {
+		revoked, err := h.userStore.ScheduleDeletion(r.Context(), user, time.Now().Add(h.deletionGracePeriod), middleware.GetTokenHash(r))
+		if err != nil {
+			h.logger.Printf("error ScheduleDeletion %v", err)
+			problem.WriteError(w, r, err)
+			return
+		}
+		deny(h.denylist, revoked)
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"user": user})
+}
+
+func (h *UserHandler) HandleCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	err := h.userStore.CancelDeletion(r.Context(), middleware.GetUser(r).ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		problem.Write(w, r, problem.NotFound("no account deletion is pending"))
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error CancelDeletion %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadMe reads the authenticated user from the db, since signed tokens only carry the id
+func loadMe(w http.ResponseWriter, r *http.Request, userStore store.UserStore, logger *log.Logger) (*store.User, bool) {
+	user, err := userStore.GetUserByID(r.Context(), middleware.GetUser(r).ID)
+	if err != nil {
+		logger.Printf("error GetUserByID %v", err)
+		problem.WriteError(w, r, err)
+		return nil, false
+	}
+	if user == nil {
+		problem.Write(w, r, problem.NotFound("user not found"))
+		return nil, false
+	}
+	return user, true
+}
+
+// checkCurrentPassword counts against the same budget as logins to the account, so a
+// hijacked session is no faster way to guess the password. a match does not forget
+// earlier failures, only a full login does
+func checkCurrentPassword(w http.ResponseWriter, r *http.Request, logger *log.Logger, hasher passhash.Hasher, guard *lockout.Guard, user *store.User, plaintext string) bool {
+	if !user.PasswordHash.IsSet() {
+		problem.Write(w, r, problem.Validation(problem.FieldError{Pointer: "/current_password", Detail: "account has no password yet, set one with a password reset first"}))
+		return false
+	}
+
+	ip := utils.ClientIP(r)
+	wait, err := guard.Attempt(r.Context(), user.Username, ip)
+	if err != nil {
+		logger.Printf("error guard.Attempt %v", err)
+		problem.WriteError(w, r, err)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, r, wait)
+		return false
+	}
+
+	matches, err := user.PasswordHash.Matches(hasher, plaintext)
+	if err != nil {
+		logger.Printf("error PasswordHash.Matches %v", err)
+		giveBackAttempt(r, logger, guard, user.Username, ip)
+		problem.Write(w, r, problem.Internal())
+		return false
+	}
+	if !matches {
+		err = guard.Failed(r.Context(), user.Username, ip)
+		if err != nil {
+			logger.Printf("error guard.Failed %v", err)
+		}
+		problem.Write(w, r, problem.Validation(problem.FieldError{Pointer: "/current_password", Detail: "is incorrect"}))
+		return false
+	}
+
+	err = guard.Passed(r.Context(), user.Username, ip)
+	if err != nil {
+		logger.Printf("error guard.Passed %v", err)
+	}
+	return true
+}
+
+// checkPasswordPolicy adds the policy's objection to a new password, if any, to errs.
+// a password that already failed validation is not checked again
+func checkPasswordPolicy(errs []problem.FieldError, policy passpolicy.Policy, pointer, password string, userInputs ...string) []problem.FieldError {
+	if slices.ContainsFunc(errs, func(e problem.FieldError) bool { return e.Pointer == pointer }) {
+		return errs
+	}
+	if detail := policy.Check(password, userInputs...); detail != "" {
+		errs = append(errs, problem.FieldError{Pointer: pointer, Detail: detail})
+	}
+	return errs
+}
+
+func (h *UserHandler) sendVerification(ctx context.Context, user *store.User) error {
+	token, err := h.tokenStore.CreateNewToken(ctx, user.ID, tokens.VerificationTokenTTL, tokens.ScopeVerification)
+	if err != nil {
+		return err
+	}
+
+	return h.mailer.Send(ctx, mailer.VerifyEmail(user.Email, user.Username, token.Plaintext))
 }
@@ -1,45 +1,99 @@
 package api
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fem/internal/conditional"
 	"fem/internal/dto"
+	"fem/internal/jsonpatch"
 	"fem/internal/middleware"
+	"fem/internal/problem"
 	"fem/internal/store"
 	"fem/internal/utils"
+	"fem/internal/validate"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
 )
 
+// patchTypes are the media types PATCH accepts, for Accept-Patch
+const patchTypes = jsonpatch.MergePatchType + ", " + jsonpatch.JSONPatchType
+
 type WorkoutHandler struct {
 	workoutStore store.WorkoutStore
-	logger       *log.Logger
+	// requireIfMatch refuses writes that do not say which version they were based on
+	requireIfMatch bool
+	logger         *log.Logger
 }
 
-func NewWorkoutHandler(workoutStore store.WorkoutStore, logger *log.Logger) *WorkoutHandler {
+func NewWorkoutHandler(workoutStore store.WorkoutStore, requireIfMatch bool, logger *log.Logger) *WorkoutHandler {
 	return &WorkoutHandler{
-		workoutStore: workoutStore,
-		logger:       logger,
+		workoutStore:   workoutStore,
+		requireIfMatch: requireIfMatch,
+		logger:         logger,
+	}
+}
+
+// checkIfMatch answers a write whose If-Match does not hold for workout with 412, or with
+// 428 when it has none and one is required. it reports whether the write may go ahead
+func (wh *WorkoutHandler) checkIfMatch(w http.ResponseWriter, r *http.Request, workout *store.Workout) bool {
+	etag := conditional.ETag(workout.Version)
+	match, ok := conditional.IfMatch(r, etag)
+	switch {
+	case !ok && wh.requireIfMatch:
+		problem.Write(w, r, problem.New(http.StatusPreconditionRequired, problem.CodePreconditionNeeded,
+			"send the ETag of the workout in If-Match"))
+		return false
+	case ok && !match:
+		w.Header().Set("ETag", etag)
+		problem.Write(w, r, problem.New(http.StatusPreconditionFailed, problem.CodePreconditionFailed,
+			"workout was changed since it was fetched"))
+		return false
+	}
+	return true
+}
+
+// writeVersionError renders an error of a write guarded by the workout version. losing
+// the race to another write fails the precondition of a request that sent one
+func (wh *WorkoutHandler) writeVersionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, store.ErrVersionMismatch) && r.Header.Get("If-Match") != "" {
+		problem.Write(w, r, problem.New(http.StatusPreconditionFailed, problem.CodePreconditionFailed,
+			"workout was changed since it was fetched"))
+		return
 	}
+	problem.WriteError(w, r, err)
 }
 
 func (wh *WorkoutHandler) HandleGetWorkoutByID(w http.ResponseWriter, r *http.Request) {
 	workoutID, err := utils.ReadIDParam(r)
 	if err != nil {
 		wh.logger.Printf("ERROR: ReadIDParam %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid workout id"})
+		problem.Write(w, r, problem.BadRequest("invalid workout id"))
 		return
 	}
 
-	workout, err := wh.workoutStore.GetWorkoutByID(workoutID)
+	workout, err := wh.workoutStore.GetWorkoutByID(r.Context(), workoutID)
 	if err != nil {
 		wh.logger.Printf("ERROR: GetWorkoutByID %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		problem.WriteError(w, r, err)
 		return
 	}
 
 	if workout == nil {
-		http.NotFound(w, r)
+		problem.Write(w, r, problem.NotFound("workout not found"))
+		return
+	}
+
+	etag := conditional.ETag(workout.Version)
+	w.Header().Set("ETag", etag)
+	if conditional.IfNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
@@ -47,24 +101,29 @@ func (wh *WorkoutHandler) HandleGetWorkoutByID(w http.ResponseWriter, r *http.Re
 }
 
 func (wh *WorkoutHandler) HandleCreateWorkout(w http.ResponseWriter, r *http.Request) {
-	var workout store.Workout
+	var req dto.CreateWorkoutDTO
 
-	err := json.NewDecoder(r.Body).Decode(&workout)
+	err := utils.ReadJSON(w, r, &req)
 	if err != nil {
 		wh.logger.Printf("ERROR: decoding create workout %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request"})
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
 		return
 	}
 
-	workout.UserID = middleware.GetUser(r).ID
+	workout := req.ToWorkout(middleware.GetUser(r).ID)
 
-	createdWorkout, err := wh.workoutStore.CreateWorkout(&workout)
+	createdWorkout, err := wh.workoutStore.CreateWorkout(r.Context(), workout)
 	if err != nil {
 		wh.logger.Printf("ERROR: CreateWorkout %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "invalid request"})
+		problem.WriteError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", conditional.ETag(createdWorkout.Version))
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"workout": createdWorkout})
 }
 
@@ -72,28 +131,42 @@ func (wh *WorkoutHandler) HandleUpdateWorkoutByID(w http.ResponseWriter, r *http
 	workoutID, err := utils.ReadIDParam(r)
 	if err != nil {
 		wh.logger.Printf("ERROR: ReadIDParam %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid update workout id"})
+		problem.Write(w, r, problem.BadRequest("invalid update workout id"))
 		return
 	}
 
-	existingWorkout, err := wh.workoutStore.GetWorkoutByID(workoutID)
+	existingWorkout, err := wh.workoutStore.GetWorkoutByID(r.Context(), workoutID)
 	if err != nil {
 		wh.logger.Printf("ERROR: GetWorkoutByID %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		problem.WriteError(w, r, err)
 		return
 	}
 
 	if existingWorkout == nil {
-		http.NotFound(w, r)
+		problem.Write(w, r, problem.NotFound("workout not found"))
+		return
+	}
+	if !wh.checkIfMatch(w, r, existingWorkout) {
 		return
 	}
 
 	var updateWorkoutRequest dto.UpdateWorkoutDTO
 
-	err = json.NewDecoder(r.Body).Decode(&updateWorkoutRequest)
+	err = utils.ReadJSON(w, r, &updateWorkoutRequest)
 	if err != nil {
 		wh.logger.Printf("ERROR: decoding update request body %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request"})
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	errs := validate.Struct(&updateWorkoutRequest)
+	errs = append(errs, updateWorkoutRequest.CheckAgainst(existingWorkout)...)
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+	// a version in the body is what the client edited, like an If-Match
+	if updateWorkoutRequest.Version != nil && *updateWorkoutRequest.Version != existingWorkout.Version {
+		wh.writeVersionError(w, r, store.ErrVersionMismatch)
 		return
 	}
 
@@ -114,16 +187,17 @@ func (wh *WorkoutHandler) HandleUpdateWorkoutByID(w http.ResponseWriter, r *http
 		existingWorkout.CaloriesBurned = *updateWorkoutRequest.CaloriesBurned
 	}
 	if updateWorkoutRequest.Entries != nil {
-		existingWorkout.Entries = updateWorkoutRequest.Entries
+		existingWorkout.Entries = dto.ToUpdatedEntries(updateWorkoutRequest.Entries)
 	}
 
-	err = wh.workoutStore.UpdateWorkout(existingWorkout)
+	err = wh.workoutStore.UpdateWorkout(r.Context(), existingWorkout)
 	if err != nil {
 		wh.logger.Printf("ERROR: UpdateWorkout %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		wh.writeVersionError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", conditional.ETag(existingWorkout.Version))
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": existingWorkout})
 }
 
@@ -131,22 +205,348 @@ func (wh *WorkoutHandler) HandleDeleteWorkoutByID(w http.ResponseWriter, r *http
 	workoutID, err := utils.ReadIDParam(r)
 	if err != nil {
 		wh.logger.Printf("ERROR: ReadIDParam %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid delete workout id"})
+		problem.Write(w, r, problem.BadRequest("invalid delete workout id"))
 		return
 	}
 
-	err = wh.workoutStore.DeleteWorkoutByID(workoutID)
+	// without If-Match any version goes
+	version := 0
+	if r.Header.Get("If-Match") != "" || wh.requireIfMatch {
+		existingWorkout, err := wh.workoutStore.GetWorkoutByID(r.Context(), workoutID)
+		if err != nil {
+			wh.logger.Printf("ERROR: GetWorkoutByID %v", err)
+			problem.WriteError(w, r, err)
+			return
+		}
+		if existingWorkout == nil {
+			problem.Write(w, r, problem.NotFound("workout not found"))
+			return
+		}
+		if !wh.checkIfMatch(w, r, existingWorkout) {
+			return
+		}
+		version = existingWorkout.Version
+	}
+
+	err = wh.workoutStore.DeleteWorkoutByID(r.Context(), workoutID, version)
 	if err == sql.ErrNoRows {
 		wh.logger.Printf("ERROR: workout not found %v", err)
-		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		problem.Write(w, r, problem.NotFound("workout not found"))
 		return
 	}
 
 	if err != nil {
 		wh.logger.Printf("ERROR: DeleteWorkoutByID %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		wh.writeVersionError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// HandleListTrash lists the deleted workouts of the user that can still be restored
+func (wh *WorkoutHandler) HandleListTrash(w http.ResponseWriter, r *http.Request) {
+	workouts, err := wh.workoutStore.ListDeletedWorkouts(r.Context(), middleware.GetUser(r).ID)
+	if err != nil {
+		wh.logger.Printf("ERROR: ListDeletedWorkouts %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workouts": workouts})
+}
+
+// HandleRestoreWorkout takes a workout of the user out of the trash
+func (wh *WorkoutHandler) HandleRestoreWorkout(w http.ResponseWriter, r *http.Request) {
+	workoutID, err := utils.ReadIDParam(r)
+	if err != nil {
+		wh.logger.Printf("ERROR: ReadIDParam %v", err)
+		problem.Write(w, r, problem.BadRequest("invalid restore workout id"))
+		return
+	}
+
+	// the owner check is part of the query, deleted workouts are out of CanModifyWorkouts' sight
+	err = wh.workoutStore.RestoreWorkout(r.Context(), workoutID, middleware.GetUser(r).ID)
+	if err == sql.ErrNoRows {
+		problem.Write(w, r, problem.NotFound("workout not found in the trash"))
+		return
+	}
+	if err != nil {
+		wh.logger.Printf("ERROR: RestoreWorkout %v", err)
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	workout := wh.loadWorkout(w, r)
+	if workout == nil {
+		return
+	}
+	w.Header().Set("ETag", conditional.ETag(workout.Version))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
+}
+
+// HandlePatchWorkoutByID applies a merge patch or JSON Patch to the workout. as with PUT,
+// entries that keep their id are updated in place
+func (wh *WorkoutHandler) HandlePatchWorkoutByID(w http.ResponseWriter, r *http.Request) {
+	workout := wh.loadWorkout(w, r)
+	if workout == nil || !wh.checkIfMatch(w, r, workout) {
+		return
+	}
+
+	var patched dto.PatchedWorkoutDTO
+	if !wh.readPatched(w, r, workout, &patched) {
+		return
+	}
+	errs := validate.Struct(&patched)
+	errs = append(errs, patched.CheckAgainst(workout)...)
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	patched.ApplyTo(workout)
+	wh.saveWorkout(w, r, workout, utils.Envelope{"workout": workout})
+}
+
+func (wh *WorkoutHandler) HandleGetEntry(w http.ResponseWriter, r *http.Request) {
+	workout, i := wh.loadEntry(w, r)
+	if workout == nil {
+		return
+	}
+
+	// entries have no version of their own, the workout's covers them
+	etag := conditional.ETag(workout.Version)
+	w.Header().Set("ETag", etag)
+	if conditional.IfNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"entry": workout.Entries[i]})
+}
+
+func (wh *WorkoutHandler) HandleCreateEntry(w http.ResponseWriter, r *http.Request) {
+	workout := wh.loadWorkout(w, r)
+	if workout == nil || !wh.checkIfMatch(w, r, workout) {
+		return
+	}
+
+	var req dto.WorkoutEntryDTO
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		wh.logger.Printf("ERROR: decoding create entry %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+	if len(workout.Entries) >= dto.MaxWorkoutEntries {
+		problem.Write(w, r, problem.New(http.StatusUnprocessableEntity, problem.CodeConstraintViolated,
+			"a workout holds at most "+strconv.Itoa(dto.MaxWorkoutEntries)+" entries"))
+		return
+	}
+
+	workout.Entries = append(workout.Entries, req.ToEntry())
+	entry := &workout.Entries[len(workout.Entries)-1]
+	if !wh.updateWorkout(w, r, workout) {
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/workouts/%d/entries/%d", workout.ID, entry.ID))
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"entry": entry})
+}
+
+// HandleUpdateEntry replaces an entry, keeping its id
+func (wh *WorkoutHandler) HandleUpdateEntry(w http.ResponseWriter, r *http.Request) {
+	workout, i := wh.loadEntry(w, r)
+	if workout == nil || !wh.checkIfMatch(w, r, workout) {
+		return
+	}
+
+	var req dto.WorkoutEntryDTO
+	err := utils.ReadJSON(w, r, &req)
+	if err != nil {
+		wh.logger.Printf("ERROR: decoding update entry %v", err)
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return
+	}
+	if errs := validate.Struct(&req); len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	entry := req.ToEntry()
+	entry.ID = workout.Entries[i].ID
+	workout.Entries[i] = entry
+	wh.saveWorkout(w, r, workout, utils.Envelope{"entry": &workout.Entries[i]})
+}
+
+// HandlePatchEntry applies a merge patch or JSON Patch to an entry
+func (wh *WorkoutHandler) HandlePatchEntry(w http.ResponseWriter, r *http.Request) {
+	workout, i := wh.loadEntry(w, r)
+	if workout == nil || !wh.checkIfMatch(w, r, workout) {
+		return
+	}
+
+	var patched dto.UpdateWorkoutEntryDTO
+	if !wh.readPatched(w, r, workout.Entries[i], &patched) {
+		return
+	}
+	errs := validate.Struct(&patched)
+	if patched.ID != workout.Entries[i].ID {
+		errs = append(errs, problem.FieldError{Pointer: "/id", Detail: "is read-only"})
+	}
+	if len(errs) > 0 {
+		problem.Write(w, r, problem.Validation(errs...))
+		return
+	}
+
+	workout.Entries[i] = patched.ToEntry()
+	wh.saveWorkout(w, r, workout, utils.Envelope{"entry": &workout.Entries[i]})
+}
+
+func (wh *WorkoutHandler) HandleDeleteEntry(w http.ResponseWriter, r *http.Request) {
+	workout, i := wh.loadEntry(w, r)
+	if workout == nil || !wh.checkIfMatch(w, r, workout) {
+		return
+	}
+
+	workout.Entries = slices.Delete(workout.Entries, i, i+1)
+	if !wh.updateWorkout(w, r, workout) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadWorkout fetches the workout of the {id} route param. it writes the problem and
+// returns nil when there is none
+func (wh *WorkoutHandler) loadWorkout(w http.ResponseWriter, r *http.Request) *store.Workout {
+	workoutID, err := utils.ReadIDParam(r)
+	if err != nil {
+		wh.logger.Printf("ERROR: ReadIDParam %v", err)
+		problem.Write(w, r, problem.BadRequest("invalid workout id"))
+		return nil
+	}
+
+	workout, err := wh.workoutStore.GetWorkoutByID(r.Context(), workoutID)
+	if err != nil {
+		wh.logger.Printf("ERROR: GetWorkoutByID %v", err)
+		problem.WriteError(w, r, err)
+		return nil
+	}
+	if workout == nil {
+		problem.Write(w, r, problem.NotFound("workout not found"))
+		return nil
+	}
+	return workout
+}
+
+// loadEntry fetches the workout of the {id} route param and finds the {entryId} entry
+// in it. it writes the problem and returns nil when either is missing
+func (wh *WorkoutHandler) loadEntry(w http.ResponseWriter, r *http.Request) (*store.Workout, int) {
+	entryID, err := utils.ReadNamedIDParam(r, "entryId")
+	if err != nil {
+		wh.logger.Printf("ERROR: ReadNamedIDParam %v", err)
+		problem.Write(w, r, problem.BadRequest("invalid entry id"))
+		return nil, -1
+	}
+
+	workout := wh.loadWorkout(w, r)
+	if workout == nil {
+		return nil, -1
+	}
+	i := slices.IndexFunc(workout.Entries, func(e store.WorkoutEntry) bool { return int64(e.ID) == entryID })
+	if i < 0 {
+		problem.Write(w, r, problem.NotFound("entry not found"))
+		return nil, -1
+	}
+	return workout, i
+}
+
+// updateWorkout saves workout and sets the ETag of its new version. it writes the
+// problem and returns false when that fails
+func (wh *WorkoutHandler) updateWorkout(w http.ResponseWriter, r *http.Request, workout *store.Workout) bool {
+	err := wh.workoutStore.UpdateWorkout(r.Context(), workout)
+	if err != nil {
+		wh.logger.Printf("ERROR: UpdateWorkout %v", err)
+		wh.writeVersionError(w, r, err)
+		return false
+	}
+	w.Header().Set("ETag", conditional.ETag(workout.Version))
+	return true
+}
+
+// saveWorkout saves workout and answers with data, which may point into it
+func (wh *WorkoutHandler) saveWorkout(w http.ResponseWriter, r *http.Request, workout *store.Workout, data utils.Envelope) {
+	if wh.updateWorkout(w, r, workout) {
+		utils.WriteJSON(w, http.StatusOK, data)
+	}
+}
+
+// readPatched applies the patch in the body to the JSON of current and decodes the
+// result into dst. it writes the problem and returns false when any of that fails
+func (wh *WorkoutHandler) readPatched(w http.ResponseWriter, r *http.Request, current, dst any) bool {
+	var apply func(doc, patch []byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case jsonpatch.MergePatchType:
+		apply = jsonpatch.MergePatch
+	case jsonpatch.JSONPatchType:
+		apply = jsonpatch.Apply
+	default:
+		w.Header().Set("Accept-Patch", patchTypes)
+		problem.Write(w, r, problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMedia,
+			"a patch must be sent as one of "+patchTypes))
+		return false
+	}
+
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, utils.MaxBodyBytes))
+	if err != nil {
+		problem.Write(w, r, problem.FromDecodeError(err))
+		return false
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		problem.WriteError(w, r, err)
+		return false
+	}
+
+	patched, err := apply(doc, patch)
+	if err != nil {
+		problem.Write(w, r, patchProblem(err))
+		return false
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		p := problem.Validation(problem.FromDecodeError(err).Errors...)
+		p.Detail = "the patched document is not valid"
+		problem.Write(w, r, p)
+		return false
+	}
+	return true
+}
+
+// patchProblem explains why a patch could not be applied, pointing at the operation
+// of a JSON Patch that failed
+func patchProblem(err error) *problem.Problem {
+	var p *problem.Problem
+	switch {
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		p = problem.New(http.StatusConflict, problem.CodeConflict, "a test operation of the patch failed")
+	case errors.Is(err, jsonpatch.ErrPathNotFound):
+		p = problem.Validation()
+		p.Detail = "the patch does not apply to the current document"
+	default:
+		p = problem.BadRequest("request body is not a valid patch")
+	}
+
+	var opErr *jsonpatch.OpError
+	if errors.As(err, &opErr) {
+		p.Errors = []problem.FieldError{{Pointer: "/" + strconv.Itoa(opErr.Index), Detail: opErr.Detail}}
+	}
+	return p
+}
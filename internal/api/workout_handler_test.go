@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"fem/internal/jsonpatch"
+	"fem/internal/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryWorkoutStore keeps workouts the way PostgresWorkoutStore does as far as the
+// handlers can tell: versions go up on every write and new entries get fresh ids
+type memoryWorkoutStore struct {
+	store.WorkoutStore
+
+	mu          sync.Mutex
+	workouts    map[int]*store.Workout
+	nextEntryID int
+}
+
+func newMemoryWorkoutStore(workouts ...*store.Workout) *memoryWorkoutStore {
+	s := &memoryWorkoutStore{workouts: map[int]*store.Workout{}, nextEntryID: 100}
+	for _, workout := range workouts {
+		s.workouts[workout.ID] = cloneWorkout(workout)
+	}
+	return s
+}
+
+func cloneWorkout(workout *store.Workout) *store.Workout {
+	clone := *workout
+	clone.Entries = slices.Clone(workout.Entries)
+	return &clone
+}
+
+func (s *memoryWorkoutStore) GetWorkoutByID(ctx context.Context, id int64) (*store.Workout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	workout, ok := s.workouts[int(id)]
+	if !ok {
+		return nil, nil
+	}
+	return cloneWorkout(workout), nil
+}
+
+func (s *memoryWorkoutStore) UpdateWorkout(ctx context.Context, workout *store.Workout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.workouts[workout.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if stored.Version != workout.Version {
+		return store.ErrVersionMismatch
+	}
+
+	for i := range workout.Entries {
+		if workout.Entries[i].ID == 0 {
+			workout.Entries[i].ID = s.nextEntryID
+			s.nextEntryID++
+		}
+	}
+	workout.Version++
+	s.workouts[workout.ID] = cloneWorkout(workout)
+	return nil
+}
+
+func testWorkout() *store.Workout {
+	reps := 10
+	return &store.Workout{
+		ID:              1,
+		UserID:          7,
+		Title:           "legs",
+		DurationMinutes: 45,
+		Version:         1,
+		Entries: []store.WorkoutEntry{
+			{ID: 11, ExerciseName: "squat", Sets: 3, Reps: &reps, OrderIndex: 0},
+			{ID: 12, ExerciseName: "lunge", Sets: 3, Reps: &reps, OrderIndex: 1},
+		},
+	}
+}
+
+func newWorkoutRouter(workoutStore store.WorkoutStore) http.Handler {
+	wh := NewWorkoutHandler(workoutStore, false, log.New(io.Discard, "", 0))
+
+	r := chi.NewRouter()
+	r.Put("/workouts/{id}", wh.HandleUpdateWorkoutByID)
+	r.Patch("/workouts/{id}", wh.HandlePatchWorkoutByID)
+	r.Patch("/workouts/{id}/entries/{entryId}", wh.HandlePatchEntry)
+	return r
+}
+
+func sendWorkoutRequest(t *testing.T, h http.Handler, method, path, contentType, body string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var resp map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return w, resp
+}
+
+func decodeWorkout(t *testing.T, resp map[string]json.RawMessage) store.Workout {
+	t.Helper()
+
+	var workout store.Workout
+	require.NoError(t, json.Unmarshal(resp["workout"], &workout))
+	return workout
+}
+
+func entryIDs(workout store.Workout) []int {
+	ids := make([]int, len(workout.Entries))
+	for i, entry := range workout.Entries {
+		ids[i] = entry.ID
+	}
+	return ids
+}
+
+func TestPatchWorkoutMergePatch(t *testing.T) {
+	workoutStore := newMemoryWorkoutStore(testWorkout())
+	h := newWorkoutRouter(workoutStore)
+
+	w, resp := sendWorkoutRequest(t, h, http.MethodPatch, "/workouts/1", jsonpatch.MergePatchType,
+		`{"title": "leg day", "calories_burned": 300}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	workout := decodeWorkout(t, resp)
+	assert.Equal(t, "leg day", workout.Title)
+	assert.Equal(t, 300, workout.CaloriesBurned)
+	assert.Equal(t, 45, workout.DurationMinutes, "fields the patch leaves out are kept")
+	assert.Equal(t, 2, workout.Version)
+	assert.Equal(t, []int{11, 12}, entryIDs(workout))
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+}
+
+func TestPatchWorkoutJSONPatch(t *testing.T) {
+	workoutStore := newMemoryWorkoutStore(testWorkout())
+	h := newWorkoutRouter(workoutStore)
+
+	w, resp := sendWorkoutRequest(t, h, http.MethodPatch, "/workouts/1", jsonpatch.JSONPatchType, `[
+		{"op": "test", "path": "/title", "value": "legs"},
+		{"op": "remove", "path": "/entries/0"},
+		{"op": "add", "path": "/entries/-", "value": {"exercise_name": "deadlift", "sets": 5, "reps": 5, "order_index": 2}},
+		{"op": "replace", "path": "/entries/0/sets", "value": 4}
+	]`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	workout := decodeWorkout(t, resp)
+	require.Len(t, workout.Entries, 2)
+	// the kept entry is updated in place, the added one gets a new id
+	assert.Equal(t, 12, workout.Entries[0].ID)
+	assert.Equal(t, 4, workout.Entries[0].Sets)
+	assert.Equal(t, "deadlift", workout.Entries[1].ExerciseName)
+	assert.NotContains(t, []int{0, 11, 12}, workout.Entries[1].ID)
+}
+
+func TestPatchWorkoutReadOnlyFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		pointer string
+	}{
+		{name: "id", patch: `[{"op": "replace", "path": "/id", "value": 2}]`, pointer: "/id"},
+		{name: "user_id", patch: `[{"op": "replace", "path": "/user_id", "value": 8}]`, pointer: "/user_id"},
+		{name: "version", patch: `[{"op": "replace", "path": "/version", "value": 5}]`, pointer: "/version"},
+		{name: "foreign entry id", patch: `[{"op": "replace", "path": "/entries/0/id", "value": 99}]`, pointer: "/entries/0/id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workoutStore := newMemoryWorkoutStore(testWorkout())
+			h := newWorkoutRouter(workoutStore)
+
+			w, resp := sendWorkoutRequest(t, h, http.MethodPatch, "/workouts/1", jsonpatch.JSONPatchType, tt.patch)
+			require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+			assert.Contains(t, string(resp["errors"]), `"pointer": "`+tt.pointer+`"`)
+
+			stored, _ := workoutStore.GetWorkoutByID(context.Background(), 1)
+			assert.Equal(t, 1, stored.Version, "nothing was saved")
+		})
+	}
+}
+
+func TestPatchWorkoutFailedTest(t *testing.T) {
+	workoutStore := newMemoryWorkoutStore(testWorkout())
+	h := newWorkoutRouter(workoutStore)
+
+	w, resp := sendWorkoutRequest(t, h, http.MethodPatch, "/workouts/1", jsonpatch.JSONPatchType, `[
+		{"op": "replace", "path": "/title", "value": "arms"},
+		{"op": "test", "path": "/title", "value": "legs"}
+	]`)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	assert.Contains(t, string(resp["errors"]), `"pointer": "/1"`)
+
+	stored, _ := workoutStore.GetWorkoutByID(context.Background(), 1)
+	assert.Equal(t, "legs", stored.Title)
+}
+
+func TestEntryIDsStableAcrossPutAndPatch(t *testing.T) {
+	workoutStore := newMemoryWorkoutStore(testWorkout())
+	h := newWorkoutRouter(workoutStore)
+
+	// a fetched workout sent back with one entry edited and one added
+	w, resp := sendWorkoutRequest(t, h, http.MethodPut, "/workouts/1", "application/json", `{
+		"id": 1, "user_id": 7, "version": 1, "title": "legs",
+		"entries": [
+			{"id": 12, "exercise_name": "lunge", "sets": 4, "reps": 10, "order_index": 0},
+			{"exercise_name": "calf raise", "sets": 3, "reps": 20, "order_index": 1}
+		]
+	}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	workout := decodeWorkout(t, resp)
+	require.Len(t, workout.Entries, 2)
+	assert.Equal(t, 12, workout.Entries[0].ID)
+	assert.Equal(t, 4, workout.Entries[0].Sets)
+	added := workout.Entries[1].ID
+	assert.NotZero(t, added)
+
+	// patching a single entry keeps every id
+	w, resp = sendWorkoutRequest(t, h, http.MethodPatch, "/workouts/1/entries/12", jsonpatch.MergePatchType, `{"notes": "slow"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var entry store.WorkoutEntry
+	require.NoError(t, json.Unmarshal(resp["entry"], &entry))
+	assert.Equal(t, 12, entry.ID)
+	assert.Equal(t, "slow", entry.Notes)
+
+	stored, _ := workoutStore.GetWorkoutByID(context.Background(), 1)
+	assert.Equal(t, []int{12, added}, entryIDs(*stored))
+	assert.Equal(t, 3, stored.Version)
+
+	// and so does patching the whole workout
+	w, resp = sendWorkoutRequest(t, h, http.MethodPatch, "/workouts/1", jsonpatch.MergePatchType, `{"title": "leg day"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []int{12, added}, entryIDs(decodeWorkout(t, resp)))
+}
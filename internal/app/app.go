@@ -1,27 +1,202 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"fem/internal/api"
+	"fem/internal/export"
+	"fem/internal/lockout"
+	"fem/internal/mailer"
 	"fem/internal/middleware"
+	"fem/internal/oidc"
+	"fem/internal/passhash"
+	"fem/internal/passpolicy"
+	"fem/internal/ratelimit"
 	"fem/internal/store"
+	"fem/internal/tokens"
+	"fem/internal/totp"
+	"fem/internal/webauthn"
 	"fem/migrations"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type Application struct {
-	Logger         *log.Logger
-	WorkoutHandler *api.WorkoutHandler
-	UserHandler    *api.UserHandler
-	TokenHandler   *api.TokenHandler
-	Middleware     middleware.UserMiddleware
-	DB             *sql.DB
+	Logger               *log.Logger
+	WorkoutHandler       *api.WorkoutHandler
+	UserHandler          *api.UserHandler
+	TokenHandler         *api.TokenHandler
+	PasswordResetHandler *api.PasswordResetHandler
+	ExportHandler        *api.ExportHandler
+	TwoFactorHandler     *api.TwoFactorHandler
+	PasskeyHandler       *api.PasskeyHandler
+	OIDCHandler          *api.OIDCHandler
+	Middleware           middleware.UserMiddleware
+	DB                   *sql.DB
+	Denylist             *store.PostgresDenylist
+	// TokenDenylist is what signed tokens are checked against, nil for opaque tokens
+	TokenDenylist   *tokens.MemoryDenylist
+	DenylistRefresh time.Duration
+	// used by the background jobs
+	WorkoutStore      *store.PostgresWorkoutStore
+	UserStore         *store.PostgresUserStore
+	ExportStore       *store.PostgresExportStore
+	LoginFailureStore *store.PostgresLoginFailureStore
+	PasskeyStore      *store.PostgresPasskeyStore
+	IdentityStore     *store.PostgresIdentityStore
+	RateLimitStore    *store.PostgresRateLimitStore
+	IdempotencyStore  *store.PostgresIdempotencyStore
+	Exporter          *export.Exporter
+	TrashRetention    time.Duration
 }
 
-func NewApplication() (*Application, error) {
+const (
+	TokenFormatOpaque = "opaque"
+	TokenFormatSigned = "signed"
+)
+
+const (
+	RateLimitMemory   = "memory"
+	RateLimitPostgres = "postgres"
+	RateLimitOff      = "off"
+)
+
+const (
+	MailerFile = "file"
+	MailerSMTP = "smtp"
+)
+
+type Config struct {
+	QueryTimeouts store.QueryTimeouts
+	// TokenFormat picks how access tokens are issued: opaque (db lookup per request)
+	// or signed (stateless, needs SigningKeys)
+	TokenFormat string
+	SigningKeys string
+	// DenylistRefresh is how often revoked signed tokens are reloaded from the db, so
+	// it is the longest a token revoked on another instance keeps working
+	DenylistRefresh time.Duration
+	// Mailer picks how email goes out: file (written to MailDir) or smtp
+	Mailer   string
+	MailDir  string
+	MailFrom string
+	SMTP     mailer.SMTPConfig
+	// UnverifiedPolicy is one of allow, restrict or block
+	UnverifiedPolicy string
+	// DeletionGracePeriod is how long a deleted account can be restored; 0 deletes right away
+	DeletionGracePeriod time.Duration
+	// TOTPKey encrypts two-factor secrets at rest; without it 2FA cannot be turned on
+	TOTPKey string
+	// WebAuthnRPID is the domain passkeys are bound to, WebAuthnOrigins the comma
+	// separated origins the frontend is served from
+	WebAuthnRPID    string
+	WebAuthnOrigins string
+	// OIDCProviders is a JSON array of oidc.ProviderConfig
+	OIDCProviders string
+	// InsecureCookies sends browser session cookies over plain http, for development
+	InsecureCookies bool
+	// PasswordHash is the algorithm new password hashes are made with, argon2id or bcrypt.
+	// hashes made by the other one still verify and are replaced at the next login
+	PasswordHash string
+	// PasswordPolicy is what new passwords are checked against on register, change and reset
+	PasswordPolicy passpolicy.Policy
+	// RateLimit picks where rate limit buckets live: memory (per instance), postgres
+	// (shared by every instance) or off
+	RateLimit string
+	// RequireIfMatch refuses workout updates and deletes that do not send If-Match
+	RequireIfMatch bool
+	// TrashRetention is how long a deleted workout can be restored; the housekeeping job
+	// purges it after that
+	TrashRetention time.Duration
+}
+
+func newTokenFormat(cfg Config) (tokens.Format, error) {
+	switch cfg.TokenFormat {
+	case "", TokenFormatOpaque:
+		return tokens.Opaque{}, nil
+	case TokenFormatSigned:
+		keys, err := tokens.ParseKeySet(cfg.SigningKeys)
+		if err != nil {
+			return nil, err
+		}
+		return tokens.Signed{Keys: keys}, nil
+	default:
+		return nil, fmt.Errorf("app: unknown token format %q", cfg.TokenFormat)
+	}
+}
+
+// newTokenDenylist loads the revoked signed tokens. opaque tokens are looked up in the
+// db on every request anyway, so they need none
+func newTokenDenylist(cfg Config, source tokens.DenylistSource) (*tokens.MemoryDenylist, error) {
+	if cfg.TokenFormat != TokenFormatSigned {
+		return nil, nil
+	}
+	if cfg.DenylistRefresh <= 0 {
+		return nil, fmt.Errorf("app: the denylist refresh interval must be positive")
+	}
+
+	denylist := tokens.NewMemoryDenylist(source)
+	err := denylist.Refresh(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("app: loading the token denylist: %w", err)
+	}
+	return denylist, nil
+}
+
+func newMailer(cfg Config) (mailer.Mailer, error) {
+	switch cfg.Mailer {
+	case "", MailerFile:
+		return mailer.NewFile(cfg.MailDir, cfg.MailFrom), nil
+	case MailerSMTP:
+		if cfg.SMTP.Addr == "" {
+			return nil, fmt.Errorf("app: the smtp mailer needs an address")
+		}
+		return mailer.NewSMTP(cfg.SMTP, cfg.MailFrom), nil
+	default:
+		return nil, fmt.Errorf("app: unknown mailer %q", cfg.Mailer)
+	}
+}
+
+func newRateLimiter(cfg Config, pgStore *store.PostgresRateLimitStore) (*ratelimit.Limiter, error) {
+	switch cfg.RateLimit {
+	case "", RateLimitMemory:
+		return ratelimit.NewLimiter(ratelimit.NewMemoryStore()), nil
+	case RateLimitPostgres:
+		return ratelimit.NewLimiter(pgStore), nil
+	case RateLimitOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("app: unknown rate limit backend %q", cfg.RateLimit)
+	}
+}
+
+func newTOTPCipher(cfg Config) (*totp.Cipher, error) {
+	if cfg.TOTPKey == "" {
+		return nil, nil
+	}
+	key, err := totp.ParseKey(cfg.TOTPKey)
+	if err != nil {
+		return nil, err
+	}
+	return totp.NewCipher(key)
+}
+
+func newOIDCProviders(cfg Config) ([]*oidc.Provider, error) {
+	configs, err := oidc.ParseProviders(cfg.OIDCProviders)
+	if err != nil {
+		return nil, err
+	}
+	providers := make([]*oidc.Provider, len(configs))
+	for i, providerCfg := range configs {
+		providers[i] = oidc.NewProvider(providerCfg, nil)
+	}
+	return providers, nil
+}
+
+func NewApplication(cfg Config) (*Application, error) {
 	pgDB, err := store.Open()
 	if err != nil {
 		return nil, err
@@ -34,32 +209,210 @@ func NewApplication() (*Application, error) {
 
 	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
+	tokenFormat, err := newTokenFormat(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	mail, err := newMailer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	unverifiedPolicy, err := middleware.ParseUnverifiedPolicy(cfg.UnverifiedPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	totpCipher, err := newTOTPCipher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if totpCipher == nil {
+		logger.Printf("WARN: no -totp-key set, two-factor authentication is unavailable")
+	}
+
+	oidcProviders, err := newOIDCProviders(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher, err := passhash.Parse(cfg.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PasswordPolicy.MinScore < 0 || cfg.PasswordPolicy.MinScore > 4 {
+		return nil, fmt.Errorf("password policy: min score must be 0 to 4, not %d", cfg.PasswordPolicy.MinScore)
+	}
+
 	// stores
-	workoutStore := store.NewPostgresWorkoutStore(pgDB)
-	userStore := store.NewPostgresUserStore(pgDB)
-	tokenStore := store.NewPostgresTokenStore(pgDB)
+	workoutStore := store.NewPostgresWorkoutStore(pgDB, cfg.QueryTimeouts)
+	userStore := store.NewPostgresUserStore(pgDB, cfg.QueryTimeouts)
+	tokenStore := store.NewPostgresTokenStore(pgDB, cfg.QueryTimeouts, tokenFormat)
+	denylist := store.NewPostgresDenylist(pgDB, cfg.QueryTimeouts)
+	exportStore := store.NewPostgresExportStore(pgDB, cfg.QueryTimeouts)
+	loginFailureStore := store.NewPostgresLoginFailureStore(pgDB, cfg.QueryTimeouts)
+	passkeyStore := store.NewPostgresPasskeyStore(pgDB, cfg.QueryTimeouts)
+	identityStore := store.NewPostgresIdentityStore(pgDB, cfg.QueryTimeouts)
+	rateLimitStore := store.NewPostgresRateLimitStore(pgDB, cfg.QueryTimeouts)
+	idempotencyStore := store.NewPostgresIdempotencyStore(pgDB, cfg.QueryTimeouts)
+
+	tokenDenylist, err := newTokenDenylist(cfg, denylist)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimiter, err := newRateLimiter(cfg, rateLimitStore)
+	if err != nil {
+		return nil, err
+	}
+
+	guard := lockout.NewGuard(loginFailureStore, lockout.DefaultAccountPolicy, lockout.DefaultIPPolicy,
+		lockoutNotifier(logger, userStore, mail))
+
+	cookies := middleware.Cookies{Insecure: cfg.InsecureCookies}
 
 	// hanlders
-	workoutHandler := api.NewWorkoutHandler(workoutStore, logger)
-	userHanlder := api.NewUserHandler(userStore, logger)
-	tokenHandler := api.NewTokenHandler(tokenStore, userStore, logger)
+	workoutHandler := api.NewWorkoutHandler(workoutStore, cfg.RequireIfMatch, logger)
+	userHanlder := api.NewUserHandler(userStore, tokenStore, tokenDenylist, mail, cfg.DeletionGracePeriod, guard, hasher, cfg.PasswordPolicy, logger)
+	tokenHandler := api.NewTokenHandler(tokenStore, tokenDenylist, userStore, unverifiedPolicy, guard, hasher, cookies, logger)
+	passwordResetHandler := api.NewPasswordResetHandler(userStore, tokenStore, tokenDenylist, mail, hasher, cfg.PasswordPolicy, logger)
+	exportHandler := api.NewExportHandler(exportStore, logger)
+	webauthnCfg := webauthn.Config{
+		RPID:    cfg.WebAuthnRPID,
+		RPName:  api.TOTPIssuer,
+		Origins: strings.Split(cfg.WebAuthnOrigins, ","),
+	}
+	passkeyHandler := api.NewPasskeyHandler(passkeyStore, userStore, tokenStore, webauthnCfg, unverifiedPolicy, cookies, logger)
+	oidcHandler := api.NewOIDCHandler(oidcProviders, identityStore, userStore, tokenStore, unverifiedPolicy, cookies, logger)
+	twoFactorHandler := api.NewTwoFactorHandler(userStore, userStore, tokenStore, totpCipher, guard, hasher, cookies, logger)
 	middlewareHandler := middleware.UserMiddleware{
-		UserStore: userStore,
-		WorkoutStore: workoutStore,
+		UserStore:        userStore,
+		WorkoutStore:     workoutStore,
+		TokenStore:       tokenStore,
+		TokenFormat:      tokenFormat,
+		Denylist:         tokenDenylist,
+		UnverifiedPolicy: unverifiedPolicy,
+		Cookies:          cookies,
+		RateLimiter:      rateLimiter,
+		IdempotencyStore: idempotencyStore,
 	}
 
 	app := &Application{
-		Logger:         logger,
-		WorkoutHandler: workoutHandler,
-		UserHandler:    userHanlder,
-		TokenHandler:   tokenHandler,
-		Middleware:     middlewareHandler,
-		DB:             pgDB,
+		Logger:               logger,
+		WorkoutHandler:       workoutHandler,
+		UserHandler:          userHanlder,
+		TokenHandler:         tokenHandler,
+		PasswordResetHandler: passwordResetHandler,
+		ExportHandler:        exportHandler,
+		TwoFactorHandler:     twoFactorHandler,
+		PasskeyHandler:       passkeyHandler,
+		OIDCHandler:          oidcHandler,
+		Middleware:           middlewareHandler,
+		DB:                   pgDB,
+		Denylist:             denylist,
+		TokenDenylist:        tokenDenylist,
+		DenylistRefresh:      cfg.DenylistRefresh,
+		WorkoutStore:         workoutStore,
+		UserStore:            userStore,
+		ExportStore:          exportStore,
+		LoginFailureStore:    loginFailureStore,
+		PasskeyStore:         passkeyStore,
+		IdentityStore:        identityStore,
+		RateLimitStore:       rateLimitStore,
+		IdempotencyStore:     idempotencyStore,
+		Exporter:             export.NewExporter(userStore, workoutStore, tokenStore, passkeyStore, exportStore, logger),
+		TrashRetention:       cfg.TrashRetention,
 	}
 
 	return app, nil
 }
 
+// lockoutNotifier logs every lockout and warns the owner of a locked account by email
+func lockoutNotifier(logger *log.Logger, userStore store.UserStore, mail mailer.Mailer) lockout.NotifierFunc {
+	return func(ctx context.Context, e lockout.Event) {
+		logger.Printf("WARN: %s after %d failed logins (username %q, ip %s) until %s",
+			e.Kind, e.Failures, e.Username, e.IP, e.LockedUntil.Format(time.RFC3339))
+		if e.Kind != lockout.AccountLocked {
+			return
+		}
+
+		user, err := userStore.GetUserByUsername(ctx, e.Username)
+		if err != nil {
+			logger.Printf("ERROR: GetUserByUsername %v", err)
+			return
+		}
+		if user == nil {
+			return
+		}
+		err = mail.Send(ctx, mailer.AccountLocked(user.Email, user.Username, e.LockedUntil))
+		if err != nil {
+			logger.Printf("ERROR: sending lockout notice %v", err)
+		}
+	}
+}
+
+// RunJobs runs background work until ctx is cancelled: building data exports,
+// and periodic housekeeping
+func (a *Application) RunJobs(ctx context.Context) {
+	housekeeping := time.NewTicker(10 * time.Minute)
+	defer housekeeping.Stop()
+	exports := time.NewTicker(5 * time.Second)
+	defer exports.Stop()
+
+	var denylistRefresh <-chan time.Time
+	if a.TokenDenylist != nil {
+		ticker := time.NewTicker(a.DenylistRefresh)
+		defer ticker.Stop()
+		denylistRefresh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-denylistRefresh:
+			err := a.TokenDenylist.Refresh(ctx)
+			if err != nil {
+				a.Logger.Printf("ERROR: refreshing the token denylist %v", err)
+			}
+		case <-exports.C:
+			built, err := a.Exporter.RunPending(ctx)
+			if err != nil {
+				a.Logger.Printf("ERROR: RunPending %v", err)
+			}
+			if built > 0 {
+				a.Logger.Printf("built %d data exports", built)
+			}
+		case <-housekeeping.C:
+			a.purge(ctx, "expired denylist entries", a.Denylist.PurgeExpired)
+			a.purge(ctx, "deleted accounts", a.UserStore.PurgeDeletedUsers)
+			a.purge(ctx, "workouts past the trash retention", func(ctx context.Context) (int64, error) {
+				return a.WorkoutStore.PurgeDeletedWorkouts(ctx, time.Now().Add(-a.TrashRetention))
+			})
+			a.purge(ctx, "expired data exports", a.ExportStore.PurgeExpiredExports)
+			a.purge(ctx, "expired passkey challenges", a.PasskeyStore.PurgeExpiredChallenges)
+			a.purge(ctx, "expired identity provider logins", a.IdentityStore.PurgeExpiredLogins)
+			a.purge(ctx, "full rate limit buckets", a.RateLimitStore.PurgeFull)
+			a.purge(ctx, "expired idempotency keys", a.IdempotencyStore.PurgeExpiredIdempotencyKeys)
+			a.purge(ctx, "stale login failures", func(ctx context.Context) (int64, error) {
+				return a.LoginFailureStore.PurgeStale(ctx, time.Now().Add(-lockout.DefaultAccountPolicy.Window))
+			})
+		}
+	}
+}
+
+func (a *Application) purge(ctx context.Context, what string, purge func(context.Context) (int64, error)) {
+	purged, err := purge(ctx)
+	if err != nil {
+		a.Logger.Printf("ERROR: purging %s %v", what, err)
+		return
+	}
+	if purged > 0 {
+		a.Logger.Printf("purged %d %s", purged, what)
+	}
+}
+
 func (a *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Status is available\n")
 }
@@ -0,0 +1,67 @@
+// Package conditional reads the precondition headers of RFC 9110 section 13, so a
+// client can skip downloading what it has and cannot overwrite what it has not seen
+package conditional
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETag is the strong entity tag of a resource at version
+func ETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// IfMatch reports whether r may change the resource currently tagged etag: If-Match is
+// "*" or lists etag. weak tags never match. ok is false when r has no If-Match at all
+func IfMatch(r *http.Request, etag string) (match, ok bool) {
+	header := r.Header.Values("If-Match")
+	if len(header) == 0 {
+		return false, false
+	}
+	return matches(strings.Join(header, ","), etag, false), true
+}
+
+// IfNoneMatch reports whether the client already has the representation tagged etag,
+// comparing weakly as a cache may have kept a weak tag
+func IfNoneMatch(r *http.Request, etag string) bool {
+	header := r.Header.Values("If-None-Match")
+	if len(header) == 0 {
+		return false
+	}
+	return matches(strings.Join(header, ","), etag, true)
+}
+
+// matches looks for etag in a comma separated list of entity tags. a malformed list
+// matches nothing past the point it stops making sense
+func matches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			break
+		}
+
+		isWeak := strings.HasPrefix(list, "W/")
+		if isWeak {
+			list = list[2:]
+		}
+		if !strings.HasPrefix(list, `"`) {
+			return false
+		}
+		end := strings.IndexByte(list[1:], '"')
+		if end < 0 {
+			return false
+		}
+		tag := list[:end+2]
+		list = list[end+2:]
+
+		if tag == etag && (weak || !isWeak) {
+			return true
+		}
+	}
+	return false
+}
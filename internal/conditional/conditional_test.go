@@ -0,0 +1,65 @@
+package conditional
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETag(t *testing.T) {
+	assert.Equal(t, `"7"`, ETag(7))
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		match  bool
+	}{
+		{"same tag", []string{`"3"`}, true},
+		{"any", []string{`*`}, true},
+		{"one of a list", []string{`"1", "3"`}, true},
+		{"across header lines", []string{`"1"`, `"3"`}, true},
+		{"other tag", []string{`"2"`}, false},
+		{"weak tags are not compared", []string{`W/"3"`}, false},
+		{"unquoted", []string{`3`}, false},
+		{"tag with a comma", []string{`"3,4"`}, false},
+		{"unterminated", []string{`"3`}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/workouts/1", nil)
+			for _, value := range tt.header {
+				r.Header.Add("If-Match", value)
+			}
+			match, ok := IfMatch(r, ETag(3))
+			assert.True(t, ok)
+			assert.Equal(t, tt.match, match)
+		})
+	}
+
+	_, ok := IfMatch(httptest.NewRequest("PUT", "/workouts/1", nil), ETag(3))
+	assert.False(t, ok, "no If-Match is not a failed one")
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{``, false},
+		{`"3"`, true},
+		{`W/"3"`, true},
+		{`"1", W/"3"`, true},
+		{`*`, true},
+		{`"2"`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/workouts/1", nil)
+		if tt.header != "" {
+			r.Header.Set("If-None-Match", tt.header)
+		}
+		assert.Equal(t, tt.match, IfNoneMatch(r, ETag(3)), tt.header)
+	}
+}
@@ -0,0 +1,128 @@
+package docs_test
+
+import (
+	"encoding/json"
+	"fem/internal/app"
+	"fem/internal/docs"
+	"fem/internal/dto"
+	"fem/internal/problem"
+	"fem/internal/routes"
+	"fem/internal/store"
+	"fem/internal/tokens"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type spec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadSpec(t *testing.T) spec {
+	var s spec
+	require.NoError(t, json.Unmarshal(docs.Spec, &s))
+	return s
+}
+
+func TestSpecCoversRoutes(t *testing.T) {
+	s := loadSpec(t)
+
+	var inSpec []string
+	for path, item := range s.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			inSpec = append(inSpec, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	var inRouter []string
+	r := routes.SetupRoutes(&app.Application{})
+	err := chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		inRouter = append(inRouter, method+" "+strings.TrimSuffix(route, "/*"))
+		return nil
+	})
+	require.NoError(t, err)
+
+	sort.Strings(inSpec)
+	sort.Strings(inRouter)
+	assert.Equal(t, inRouter, inSpec, "chi routes and openapi.json paths are out of sync")
+}
+
+func TestSpecSchemasMatchTypes(t *testing.T) {
+	s := loadSpec(t)
+
+	types := map[string]any{
+		"Workout":                     store.Workout{},
+		"WorkoutEntry":                store.WorkoutEntry{},
+		"User":                        store.User{},
+		"Token":                       tokens.Token{},
+		"Session":                     store.Session{},
+		"APIToken":                    store.APIToken{},
+		"CreateAPITokenRequest":       dto.CreateAPITokenDTO{},
+		"WorkoutEntryRequest":         dto.WorkoutEntryDTO{},
+		"CreateWorkoutRequest":        dto.CreateWorkoutDTO{},
+		"UpdateWorkoutRequest":        dto.UpdateWorkoutDTO{},
+		"UpdateWorkoutEntryRequest":   dto.UpdateWorkoutEntryDTO{},
+		"RegisterUserRequest":         dto.RegisterUserDTO{},
+		"CreateTokenRequest":          dto.CreateTokenDTO{},
+		"RefreshTokenRequest":         dto.RefreshTokenDTO{},
+		"VerifyEmailRequest":          dto.VerifyEmailDTO{},
+		"ResendVerificationRequest":   dto.ResendVerificationDTO{},
+		"PasswordResetRequest":        dto.PasswordResetRequestDTO{},
+		"PasswordResetConfirmRequest": dto.PasswordResetConfirmDTO{},
+		"EnrollTwoFactorRequest":      dto.EnrollTwoFactorDTO{},
+		"ConfirmTwoFactorRequest":     dto.ConfirmTwoFactorDTO{},
+		"DisableTwoFactorRequest":     dto.DisableTwoFactorDTO{},
+		"TwoFactorLoginRequest":       dto.TwoFactorLoginDTO{},
+		"Passkey":                     store.Passkey{},
+		"RegisterPasskeyRequest":      dto.RegisterPasskeyDTO{},
+		"PasskeyLoginRequest":         dto.PasskeyLoginDTO{},
+		"OIDCLoginRequest":            dto.OIDCLoginDTO{},
+		"FieldError":                  problem.FieldError{},
+		"Problem":                     problem.Problem{},
+	}
+
+	for name, v := range types {
+		t.Run(name, func(t *testing.T) {
+			schema, ok := s.Components.Schemas[name]
+			require.True(t, ok, "missing schema %s", name)
+
+			var specFields []string
+			for field := range schema.Properties {
+				specFields = append(specFields, field)
+			}
+			sort.Strings(specFields)
+			assert.Equal(t, jsonFields(reflect.TypeOf(v)), specFields)
+		})
+	}
+}
+
+func jsonFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
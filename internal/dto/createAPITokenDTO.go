@@ -0,0 +1,33 @@
+package dto
+
+import (
+	"fem/internal/problem"
+	"fem/internal/tokens"
+	"fmt"
+	"time"
+)
+
+type CreateAPITokenDTO struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,max=10"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (d *CreateAPITokenDTO) Check() []problem.FieldError {
+	var errs []problem.FieldError
+
+	for i, scope := range d.Scopes {
+		if !tokens.IsAPIScope(scope) {
+			errs = append(errs, problem.FieldError{
+				Pointer: fmt.Sprintf("/scopes/%d", i),
+				Detail:  fmt.Sprintf("unknown scope, must be one of %v", tokens.APIScopes),
+			})
+		}
+	}
+
+	if d.ExpiresAt != nil && !d.ExpiresAt.After(time.Now()) {
+		errs = append(errs, problem.FieldError{Pointer: "/expires_at", Detail: "must be in the future"})
+	}
+
+	return errs
+}
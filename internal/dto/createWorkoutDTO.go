@@ -0,0 +1,22 @@
+package dto
+
+import "fem/internal/store"
+
+type CreateWorkoutDTO struct {
+	Title           string            `json:"title" validate:"required,max=255"`
+	Description     string            `json:"description" validate:"max=5000"`
+	DurationMinutes int               `json:"duration_minutes" validate:"min=1,max=1440"`
+	CaloriesBurned  int               `json:"calories_burned" validate:"min=0,max=100000"`
+	Entries         []WorkoutEntryDTO `json:"entries" validate:"max=100"`
+}
+
+func (d *CreateWorkoutDTO) ToWorkout(userID int) *store.Workout {
+	return &store.Workout{
+		UserID:          userID,
+		Title:           d.Title,
+		Description:     d.Description,
+		DurationMinutes: d.DurationMinutes,
+		CaloriesBurned:  d.CaloriesBurned,
+		Entries:         ToEntries(d.Entries),
+	}
+}
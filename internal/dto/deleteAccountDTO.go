@@ -0,0 +1,5 @@
+package dto
+
+type DeleteAccountDTO struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+}
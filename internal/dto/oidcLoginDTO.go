@@ -0,0 +1,7 @@
+package dto
+
+// OIDCLoginDTO carries what the provider appended to the redirect URL
+type OIDCLoginDTO struct {
+	Code  string `json:"code" validate:"required,max=2048"`
+	State string `json:"state" validate:"required,max=256"`
+}
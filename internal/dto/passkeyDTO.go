@@ -0,0 +1,53 @@
+package dto
+
+import "fem/internal/problem"
+
+// binary fields are base64url, as produced by PublicKeyCredential.toJSON() in the browser
+
+type AttestationResponseDTO struct {
+	ClientDataJSON    string `json:"clientDataJSON" validate:"required,max=4096"`
+	AttestationObject string `json:"attestationObject" validate:"required,max=16384"`
+}
+
+type RegistrationCredentialDTO struct {
+	ID       string                 `json:"id" validate:"required,max=1400"`
+	Type     string                 `json:"type" validate:"required"`
+	Response AttestationResponseDTO `json:"response"`
+}
+
+type RegisterPasskeyDTO struct {
+	Name       string                    `json:"name" validate:"required,max=100"`
+	Credential RegistrationCredentialDTO `json:"credential"`
+}
+
+type AssertionResponseDTO struct {
+	ClientDataJSON    string `json:"clientDataJSON" validate:"required,max=4096"`
+	AuthenticatorData string `json:"authenticatorData" validate:"required,max=4096"`
+	Signature         string `json:"signature" validate:"required,max=2048"`
+	UserHandle        string `json:"userHandle" validate:"max=128"`
+}
+
+type AssertionCredentialDTO struct {
+	ID       string               `json:"id" validate:"required,max=1400"`
+	Type     string               `json:"type" validate:"required"`
+	Response AssertionResponseDTO `json:"response"`
+}
+
+type PasskeyLoginDTO struct {
+	Credential AssertionCredentialDTO `json:"credential"`
+}
+
+func checkCredentialType(typ string) []problem.FieldError {
+	if typ != "public-key" {
+		return []problem.FieldError{{Pointer: "/type", Detail: "must be public-key"}}
+	}
+	return nil
+}
+
+func (d *RegistrationCredentialDTO) Check() []problem.FieldError {
+	return checkCredentialType(d.Type)
+}
+
+func (d *AssertionCredentialDTO) Check() []problem.FieldError {
+	return checkCredentialType(d.Type)
+}
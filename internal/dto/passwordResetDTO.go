@@ -0,0 +1,10 @@
+package dto
+
+type PasswordResetRequestDTO struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+
+type PasswordResetConfirmDTO struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,max=256"`
+}
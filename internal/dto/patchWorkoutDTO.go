@@ -0,0 +1,74 @@
+package dto
+
+import (
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fmt"
+)
+
+/**
+* 💡 a PATCH is applied to the stored workout as JSON first (merge patch or JSON Patch),
+* and what comes out is decoded into the DTOs below and validated like any other body.
+* so the rules hold for the whole result, not only for the fields the patch touched
+ */
+
+// PatchedWorkoutDTO is a workout after a patch. id, user_id and version are read-only
+type PatchedWorkoutDTO struct {
+	ID              int                     `json:"id"`
+	UserID          int                     `json:"user_id"`
+	Version         int                     `json:"version"`
+	Title           string                  `json:"title" validate:"required,max=255"`
+	Description     string                  `json:"description" validate:"max=5000"`
+	DurationMinutes int                     `json:"duration_minutes" validate:"min=1,max=1440"`
+	CaloriesBurned  int                     `json:"calories_burned" validate:"min=0,max=100000"`
+	Entries         []UpdateWorkoutEntryDTO `json:"entries" validate:"max=100"`
+}
+
+// CheckAgainst reports changes to read-only fields of workout and entry ids that are
+// not the workout's own
+func (d *PatchedWorkoutDTO) CheckAgainst(workout *store.Workout) []problem.FieldError {
+	var errs []problem.FieldError
+	if d.ID != workout.ID {
+		errs = append(errs, problem.FieldError{Pointer: "/id", Detail: "is read-only"})
+	}
+	if d.UserID != workout.UserID {
+		errs = append(errs, problem.FieldError{Pointer: "/user_id", Detail: "is read-only"})
+	}
+	if d.Version != workout.Version {
+		errs = append(errs, problem.FieldError{Pointer: "/version", Detail: "is read-only"})
+	}
+
+	return append(errs, checkEntryIDs(workout, d.Entries)...)
+}
+
+// checkEntryIDs reports entry ids that are not the workout's own or that are used twice
+func checkEntryIDs(workout *store.Workout, entries []UpdateWorkoutEntryDTO) []problem.FieldError {
+	owned := map[int]bool{}
+	for _, entry := range workout.Entries {
+		owned[entry.ID] = true
+	}
+
+	var errs []problem.FieldError
+	seen := map[int]bool{}
+	for i, entry := range entries {
+		pointer := fmt.Sprintf("/entries/%d/id", i)
+		switch {
+		case entry.ID == 0:
+		case !owned[entry.ID]:
+			errs = append(errs, problem.FieldError{Pointer: pointer, Detail: "is not an entry of this workout"})
+		case seen[entry.ID]:
+			errs = append(errs, problem.FieldError{Pointer: pointer, Detail: "appears more than once"})
+		}
+		seen[entry.ID] = true
+	}
+	return errs
+}
+
+// ApplyTo copies the patched fields onto workout
+func (d *PatchedWorkoutDTO) ApplyTo(workout *store.Workout) {
+	workout.Title = d.Title
+	workout.Description = d.Description
+	workout.DurationMinutes = d.DurationMinutes
+	workout.CaloriesBurned = d.CaloriesBurned
+	workout.Entries = ToUpdatedEntries(d.Entries)
+}
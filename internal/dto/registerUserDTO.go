@@ -1,8 +1,8 @@
 package dto
 
 type RegisterUserDTO struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Bio      string `json:"bio"`
+	Username string `json:"username" validate:"required,max=50"`
+	Email    string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"required,max=256"`
+	Bio      string `json:"bio" validate:"max=1000"`
 }
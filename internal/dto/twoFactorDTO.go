@@ -0,0 +1,40 @@
+package dto
+
+import "fem/internal/problem"
+
+type EnrollTwoFactorDTO struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+}
+
+type ConfirmTwoFactorDTO struct {
+	Code string `json:"code" validate:"required,max=10"`
+}
+
+// DisableTwoFactorDTO takes a second factor on top of the password while 2FA is on,
+// so a phished password and a hijacked session are not enough to remove it
+type DisableTwoFactorDTO struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	Code            string `json:"code" validate:"max=10"`
+	RecoveryCode    string `json:"recovery_code" validate:"max=20"`
+}
+
+func (d *DisableTwoFactorDTO) Check() []problem.FieldError {
+	if d.Code != "" && d.RecoveryCode != "" {
+		return []problem.FieldError{{Pointer: "/code", Detail: "send either code or recovery_code, not both"}}
+	}
+	return nil
+}
+
+// TwoFactorLoginDTO finishes a login with either a code from the authenticator app or a recovery code
+type TwoFactorLoginDTO struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code" validate:"max=10"`
+	RecoveryCode   string `json:"recovery_code" validate:"max=20"`
+}
+
+func (d *TwoFactorLoginDTO) Check() []problem.FieldError {
+	if (d.Code == "") == (d.RecoveryCode == "") {
+		return []problem.FieldError{{Pointer: "/code", Detail: "exactly one of code and recovery_code is required"}}
+	}
+	return nil
+}
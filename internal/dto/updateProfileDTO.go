@@ -0,0 +1,17 @@
+package dto
+
+// UpdateProfileDTO only changes the fields that are present
+type UpdateProfileDTO struct {
+	Username *string `json:"username" validate:"notblank,max=50"`
+	Bio      *string `json:"bio" validate:"max=1000"`
+}
+
+type ChangePasswordDTO struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,max=256"`
+}
+
+type ChangeEmailDTO struct {
+	Email           string `json:"email" validate:"required,email,max=255"`
+	CurrentPassword string `json:"current_password" validate:"required"`
+}
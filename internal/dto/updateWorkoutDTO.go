@@ -1,6 +1,9 @@
 package dto
 
-import "fem/internal/store"
+import (
+	"fem/internal/problem"
+	"fem/internal/store"
+)
 
 /**
 * 💡 using *pointers below to catch 0-values
@@ -8,9 +11,64 @@ import "fem/internal/store"
 * if a field is not set, its value would be `nil` instead of `""` or `0` (for example)
  */
 type UpdateWorkoutDTO struct {
-	Title           *string              `json:"title"`
-	Description     *string              `json:"description"`
-	DurationMinutes *int                 `json:"duration_minutes"`
-	CaloriesBurned  *int                 `json:"calories_burned"`
-	Entries         []store.WorkoutEntry `json:"entries"`
+	// ID, UserID and Version may be sent back as they were fetched, but not changed
+	ID              *int                    `json:"id"`
+	UserID          *int                    `json:"user_id"`
+	Version         *int                    `json:"version"`
+	Title           *string                 `json:"title" validate:"notblank,max=255"`
+	Description     *string                 `json:"description" validate:"max=5000"`
+	DurationMinutes *int                    `json:"duration_minutes" validate:"min=1,max=1440"`
+	CaloriesBurned  *int                    `json:"calories_burned" validate:"min=0,max=100000"`
+	Entries         []UpdateWorkoutEntryDTO `json:"entries" validate:"max=100"`
+}
+
+// UpdateWorkoutEntryDTO is an entry of a PUT or of a patched workout. entries that keep
+// their id are updated in place, ones without an id are added
+type UpdateWorkoutEntryDTO struct {
+	ID              int      `json:"id" validate:"min=0"`
+	ExerciseName    string   `json:"exercise_name" validate:"required,max=255"`
+	Sets            int      `json:"sets" validate:"min=1,max=100"`
+	Reps            *int     `json:"reps" validate:"min=1,max=1000"`
+	DurationSeconds *int     `json:"duration_seconds" validate:"min=1,max=86400"`
+	Weight          *float64 `json:"weight" validate:"min=0,max=999.99"` // DECIMAL(5,2)
+	Notes           string   `json:"notes" validate:"max=1000"`
+	OrderIndex      int      `json:"order_index" validate:"min=0"`
+}
+
+func (e *UpdateWorkoutEntryDTO) Check() []problem.FieldError {
+	return checkRepsOrDuration(e.Reps, e.DurationSeconds)
+}
+
+// CheckAgainst reports changes to id and user_id and entry ids that are not the
+// workout's own. a stale version is a conflict, not a field error, so the handler checks it
+func (d *UpdateWorkoutDTO) CheckAgainst(workout *store.Workout) []problem.FieldError {
+	var errs []problem.FieldError
+	if d.ID != nil && *d.ID != workout.ID {
+		errs = append(errs, problem.FieldError{Pointer: "/id", Detail: "is read-only"})
+	}
+	if d.UserID != nil && *d.UserID != workout.UserID {
+		errs = append(errs, problem.FieldError{Pointer: "/user_id", Detail: "is read-only"})
+	}
+	return append(errs, checkEntryIDs(workout, d.Entries)...)
+}
+
+func (e UpdateWorkoutEntryDTO) ToEntry() store.WorkoutEntry {
+	return store.WorkoutEntry{
+		ID:              e.ID,
+		ExerciseName:    e.ExerciseName,
+		Sets:            e.Sets,
+		Reps:            e.Reps,
+		DurationSeconds: e.DurationSeconds,
+		Weight:          e.Weight,
+		Notes:           e.Notes,
+		OrderIndex:      e.OrderIndex,
+	}
+}
+
+func ToUpdatedEntries(entries []UpdateWorkoutEntryDTO) []store.WorkoutEntry {
+	result := make([]store.WorkoutEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.ToEntry())
+	}
+	return result
 }
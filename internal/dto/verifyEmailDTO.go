@@ -0,0 +1,9 @@
+package dto
+
+type VerifyEmailDTO struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResendVerificationDTO struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
@@ -0,0 +1,54 @@
+package dto
+
+import (
+	"fem/internal/problem"
+	"fem/internal/store"
+)
+
+type WorkoutEntryDTO struct {
+	ExerciseName    string   `json:"exercise_name" validate:"required,max=255"`
+	Sets            int      `json:"sets" validate:"min=1,max=100"`
+	Reps            *int     `json:"reps" validate:"min=1,max=1000"`
+	DurationSeconds *int     `json:"duration_seconds" validate:"min=1,max=86400"`
+	Weight          *float64 `json:"weight" validate:"min=0,max=999.99"` // DECIMAL(5,2)
+	Notes           string   `json:"notes" validate:"max=1000"`
+	OrderIndex      int      `json:"order_index" validate:"min=0"`
+}
+
+// MaxWorkoutEntries is how many entries a workout holds, as in the max=100 on Entries
+const MaxWorkoutEntries = 100
+
+// Check mirrors the `valid_workout_entry` constraint on workout_entries
+func (e *WorkoutEntryDTO) Check() []problem.FieldError {
+	return checkRepsOrDuration(e.Reps, e.DurationSeconds)
+}
+
+func checkRepsOrDuration(reps, durationSeconds *int) []problem.FieldError {
+	if reps == nil && durationSeconds == nil {
+		return []problem.FieldError{{Pointer: "/reps", Detail: "either reps or duration_seconds is required"}}
+	}
+	if reps != nil && durationSeconds != nil {
+		return []problem.FieldError{{Pointer: "/duration_seconds", Detail: "cannot be set together with reps"}}
+	}
+	return nil
+}
+
+func (e WorkoutEntryDTO) ToEntry() store.WorkoutEntry {
+	return store.WorkoutEntry{
+		ExerciseName:    e.ExerciseName,
+		Sets:            e.Sets,
+		Reps:            e.Reps,
+		DurationSeconds: e.DurationSeconds,
+		Weight:          e.Weight,
+		Notes:           e.Notes,
+		OrderIndex:      e.OrderIndex,
+	}
+}
+
+func ToEntries(entries []WorkoutEntryDTO) []store.WorkoutEntry {
+	result := make([]store.WorkoutEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.ToEntry())
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fem/internal/store"
+	"log"
+	"time"
+)
+
+const readme = `This archive holds everything fem stores about your account.
+
+profile.json     your account details (the password is only stored as a hash and not included)
+workouts.json    every workout with its entries, including ones in the trash (they have a deleted_at)
+sessions.json    devices you are logged in on
+api_tokens.json  your personal access tokens (names, scopes and dates, never the secret)
+passkeys.json    the passkeys you can log in with (names and dates; the keys stay on your devices)
+`
+
+// Data is everything the service stores about a user
+type Data struct {
+	Profile   *store.User
+	Workouts  []*store.Workout
+	Sessions  []*store.Session
+	APITokens []*store.APIToken
+	Passkeys  []*store.Passkey
+}
+
+// Archive packs data into a zip with one JSON file per kind of data
+func Archive(data Data, createdAt time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	files := []struct {
+		name    string
+		content any
+	}{
+		{"profile.json", data.Profile},
+		{"workouts.json", data.Workouts},
+		{"sessions.json", data.Sessions},
+		{"api_tokens.json", data.APITokens},
+		{"passkeys.json", data.Passkeys},
+	}
+
+	err := writeFile(zw, "README.txt", []byte(readme), createdAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		js, err := json.MarshalIndent(f.content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		err = writeFile(zw, f.name, append(js, '\n'), createdAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeFile(zw *zip.Writer, name string, content []byte, modified time.Time) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// Exporter builds the archives of queued data exports
+type Exporter struct {
+	userStore    store.UserStore
+	workoutStore store.WorkoutStore
+	tokenStore   store.TokenStore
+	passkeyStore store.PasskeyStore
+	exportStore  store.ExportStore
+	logger       *log.Logger
+}
+
+func NewExporter(userStore store.UserStore, workoutStore store.WorkoutStore, tokenStore store.TokenStore, passkeyStore store.PasskeyStore, exportStore store.ExportStore, logger *log.Logger) *Exporter {
+	return &Exporter{
+		userStore:    userStore,
+		workoutStore: workoutStore,
+		tokenStore:   tokenStore,
+		passkeyStore: passkeyStore,
+		exportStore:  exportStore,
+		logger:       logger,
+	}
+}
+
+// RunPending builds queued exports until the queue is empty and returns how many it built.
+// an export that cannot be built is marked failed and does not stop the others
+func (e *Exporter) RunPending(ctx context.Context) (int, error) {
+	built := 0
+	for {
+		export, err := e.exportStore.ClaimPendingExport(ctx)
+		if err != nil || export == nil {
+			return built, err
+		}
+
+		archive, err := e.build(ctx, export.UserID)
+		if err != nil {
+			e.logger.Printf("ERROR: building export %s %v", export.ID, err)
+			err = e.exportStore.FailExport(ctx, export.ID)
+			if err != nil {
+				return built, err
+			}
+			continue
+		}
+
+		err = e.exportStore.CompleteExport(ctx, export.ID, archive)
+		if err != nil {
+			return built, err
+		}
+		built++
+	}
+}
+
+func (e *Exporter) build(ctx context.Context, userID int) ([]byte, error) {
+	var (
+		data Data
+		err  error
+	)
+
+	data.Profile, err = e.userStore.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	data.Workouts, err = e.workoutStore.ListWorkoutsForExport(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	// no session is the current one when nobody is asking over http
+	data.Sessions, err = e.tokenStore.ListSessions(ctx, userID, []byte{})
+	if err != nil {
+		return nil, err
+	}
+	data.APITokens, err = e.tokenStore.ListAPITokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	data.Passkeys, err = e.passkeyStore.ListPasskeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return Archive(data, time.Now())
+}
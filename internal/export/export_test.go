@@ -0,0 +1,64 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fem/internal/store"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	reps := 10
+	deletedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	data := Data{
+		Profile: &store.User{ID: 1, Username: "jane", Email: "jane@example.com"},
+		Workouts: []*store.Workout{
+			{ID: 7, UserID: 1, Title: "push", Entries: []store.WorkoutEntry{{ExerciseName: "Bench press", Sets: 3, Reps: &reps}}},
+			{ID: 8, UserID: 1, Title: "pull", Entries: []store.WorkoutEntry{}, DeletedAt: &deletedAt},
+		},
+		Sessions:  []*store.Session{},
+		APITokens: []*store.APIToken{{ID: "abc", Name: "sync", Scopes: []string{"workouts:read"}}},
+		Passkeys:  []*store.Passkey{{ID: "cred", Name: "laptop"}},
+	}
+
+	archive, err := Archive(data, time.Now())
+	require.NoError(t, err)
+
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		files[f.Name], err = io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+	}
+	assert.Len(t, files, 6)
+	assert.Contains(t, files, "README.txt")
+
+	var profile map[string]any
+	require.NoError(t, json.Unmarshal(files["profile.json"], &profile))
+	assert.Equal(t, "jane@example.com", profile["email"])
+	assert.NotContains(t, profile, "password_hash")
+
+	var workouts []store.Workout
+	require.NoError(t, json.Unmarshal(files["workouts.json"], &workouts))
+	require.Len(t, workouts, 2)
+	assert.Equal(t, "Bench press", workouts[0].Entries[0].ExerciseName)
+	assert.Nil(t, workouts[0].DeletedAt)
+	// a workout in the trash is still exported, marked as deleted
+	require.NotNil(t, workouts[1].DeletedAt)
+	assert.True(t, deletedAt.Equal(*workouts[1].DeletedAt))
+
+	assert.JSONEq(t, `[]`, string(files["sessions.json"]))
+	assert.NotContains(t, string(files["api_tokens.json"]), `"token"`)
+	assert.JSONEq(t, `[{"id": "cred", "name": "laptop", "created_at": "0001-01-01T00:00:00Z", "last_used_at": null}]`, string(files["passkeys.json"]))
+}
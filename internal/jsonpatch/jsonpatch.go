@@ -0,0 +1,434 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON values. both work on the decoded document, so the caller decides
+// what the patched result may look like by decoding and validating it afterwards
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalidPatch is returned for a patch that is not a valid patch document
+	ErrInvalidPatch = errors.New("jsonpatch: invalid patch document")
+	// ErrPathNotFound is returned for a path that points at nothing in the document
+	ErrPathNotFound = errors.New("jsonpatch: path not found")
+	// ErrTestFailed is returned when a test operation does not hold
+	ErrTestFailed = errors.New("jsonpatch: test operation failed")
+)
+
+// OpError is an operation of a JSON Patch that could not be applied
+type OpError struct {
+	// Index is the position of the operation in the patch
+	Index  int
+	Detail string
+	Err    error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("jsonpatch: operation %d: %s", e.Index, e.Detail)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// MergePatch applies an RFC 7396 merge patch to doc: objects are merged key by key,
+// null removes a key and anything else, arrays included, replaces what was there
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decode(patch)
+	if err != nil {
+		return nil, invalid("merge patch is not valid JSON")
+	}
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], value)
+	}
+	return t
+}
+
+type operation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// Apply applies an RFC 6902 patch to doc. the operations run in order and the
+// patch is all or nothing: the first one that fails fails the whole patch
+func Apply(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []operation
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.DisallowUnknownFields()
+	if dec.Decode(&ops) != nil {
+		return nil, invalid("patch is not a JSON array of operations")
+	}
+
+	for i, op := range ops {
+		target, err = apply(target, op)
+		if err != nil {
+			return nil, &OpError{Index: i, Detail: err.Error(), Err: err}
+		}
+	}
+	return json.Marshal(target)
+}
+
+func apply(doc any, op operation) (any, error) {
+	if op.Path == nil {
+		return nil, invalid("%q needs a path", op.Op)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, invalid("%q needs a value", op.Op)
+		}
+		value, err = decode(*op.Value)
+		if err != nil {
+			return nil, invalid("value is not valid JSON")
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, invalid("%q needs from", op.Op)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return add(doc, path, value)
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move":
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(from) < len(path) && isPrefix(from, path) {
+			return nil, invalid("cannot move %s into itself", *op.From)
+		}
+		doc, value, err = remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "copy":
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err = get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(value))
+	case "test":
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(got, value) {
+			return nil, &failure{detail: "test of " + *op.Path + " failed", err: ErrTestFailed}
+		}
+		return doc, nil
+	default:
+		return nil, invalid("unknown op %q", op.Op)
+	}
+}
+
+// failure says what is wrong with an operation, for OpError.Detail
+type failure struct {
+	detail string
+	err    error
+}
+
+func (f *failure) Error() string {
+	return f.detail
+}
+
+func (f *failure) Unwrap() error {
+	return f.err
+}
+
+func invalid(format string, args ...any) error {
+	return &failure{detail: fmt.Sprintf(format, args...), err: ErrInvalidPatch}
+}
+
+func notFound(path []string) error {
+	return &failure{detail: "path " + formatPointer(path) + " does not exist", err: ErrPathNotFound}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, invalid("%q is not a JSON pointer", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func formatPointer(path []string) string {
+	var b strings.Builder
+	for _, token := range path {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// index reads an array index token. "-" is one past the end, only add may use it
+func index(token string, length int, forAdd bool) (int, bool) {
+	if token == "-" && forAdd {
+		return length, true
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !forAdd) {
+		return 0, false
+	}
+	return i, true
+}
+
+func get(doc any, path []string) (any, error) {
+	node := doc
+	for depth, token := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			child, ok := n[token]
+			if !ok {
+				return nil, notFound(path[:depth+1])
+			}
+			node = child
+		case []any:
+			i, ok := index(token, len(n), false)
+			if !ok {
+				return nil, notFound(path[:depth+1])
+			}
+			node = n[i]
+		default:
+			return nil, notFound(path[:depth+1])
+		}
+	}
+	return node, nil
+}
+
+// add puts value at path and returns the document, which is a new one when the
+// root itself is replaced or an array had to grow
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch p := parent.(type) {
+	case map[string]any:
+		p[last] = value
+		return doc, nil
+	case []any:
+		i, ok := index(last, len(p), true)
+		if !ok {
+			return nil, notFound(path)
+		}
+		grown := make([]any, 0, len(p)+1)
+		grown = append(grown, p[:i]...)
+		grown = append(grown, value)
+		grown = append(grown, p[i:]...)
+		return set(doc, path[:len(path)-1], grown), nil
+	default:
+		return nil, notFound(path)
+	}
+}
+
+// remove takes the value at path out of the document and returns both
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, invalid("cannot remove the whole document")
+	}
+	parent, err := get(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch p := parent.(type) {
+	case map[string]any:
+		value, ok := p[last]
+		if !ok {
+			return nil, nil, notFound(path)
+		}
+		delete(p, last)
+		return doc, value, nil
+	case []any:
+		i, ok := index(last, len(p), false)
+		if !ok {
+			return nil, nil, notFound(path)
+		}
+		value := p[i]
+		shrunk := make([]any, 0, len(p)-1)
+		shrunk = append(shrunk, p[:i]...)
+		shrunk = append(shrunk, p[i+1:]...)
+		return set(doc, path[:len(path)-1], shrunk), value, nil
+	default:
+		return nil, nil, notFound(path)
+	}
+}
+
+// set replaces the value at path, which is known to exist
+func set(doc any, path []string, value any) any {
+	if len(path) == 0 {
+		return value
+	}
+	parent, _ := get(doc, path[:len(path)-1])
+	last := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		p[last] = value
+	case []any:
+		i, _ := index(last, len(p), false)
+		p[i] = value
+	}
+	return doc
+}
+
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("jsonpatch: trailing data after the JSON value")
+	}
+	return v, nil
+}
+
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for key, value := range v {
+			c[key] = deepCopy(value)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, value := range v {
+			c[i] = deepCopy(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// equal compares JSON values as RFC 6902 test does: numbers by value, objects
+// regardless of key order
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
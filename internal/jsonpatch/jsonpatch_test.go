@@ -0,0 +1,96 @@
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"set a key", `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{"add a key", `{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{"null removes", `{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{"arrays are replaced", `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{"objects merge", `{"a":{"b":"c","d":"e"}}`, `{"a":{"d":null,"f":"g"}}`, `{"a":{"b":"c","f":"g"}}`},
+		{"non-object replaces", `{"a":"b"}`, `["c"]`, `["c"]`},
+		{"nulls are removed from new objects", `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{"numbers keep their precision", `{"n":1}`, `{"m":12345678901234567890}`, `{"m":12345678901234567890,"n":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+
+	_, err := MergePatch([]byte(`{}`), []byte(`{"a":`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+}
+
+func TestApply(t *testing.T) {
+	// examples from RFC 6902 appendix A
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"add a member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"add into an array", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"append", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`},
+		{"remove a member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"remove from an array", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"move a member", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"move in an array", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"copy", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{"test passes", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"escaped keys", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`},
+		{"replace the root", `{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	tests := []struct {
+		name, patch string
+		want        error
+		index       int
+	}{
+		{"not an array", `{"op":"add"}`, ErrInvalidPatch, -1},
+		{"unknown op", `[{"op":"frobnicate","path":"/a"}]`, ErrInvalidPatch, 0},
+		{"missing value", `[{"op":"add","path":"/a"}]`, ErrInvalidPatch, 0},
+		{"missing path", `[{"op":"remove"}]`, ErrInvalidPatch, 0},
+		{"not a pointer", `[{"op":"remove","path":"a"}]`, ErrInvalidPatch, 0},
+		{"remove a missing member", `[{"op":"remove","path":"/b"}]`, ErrPathNotFound, 0},
+		{"replace a missing member", `[{"op":"replace","path":"/b","value":1}]`, ErrPathNotFound, 0},
+		{"add past the end", `[{"op":"add","path":"/list/3","value":1}]`, ErrPathNotFound, 0},
+		{"leading zero index", `[{"op":"remove","path":"/list/01"}]`, ErrPathNotFound, 0},
+		{"add below a missing parent", `[{"op":"add","path":"/x/y","value":1}]`, ErrPathNotFound, 0},
+		{"move into itself", `[{"op":"move","from":"/list","path":"/list/0"}]`, ErrInvalidPatch, 0},
+		{"failed test", `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":"1"}]`, ErrTestFailed, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Apply([]byte(`{"a":1,"list":[1,2]}`), []byte(tt.patch))
+			require.ErrorIs(t, err, tt.want)
+
+			var opErr *OpError
+			if tt.index < 0 {
+				assert.False(t, errors.As(err, &opErr))
+				return
+			}
+			require.ErrorAs(t, err, &opErr)
+			assert.Equal(t, tt.index, opErr.Index)
+		})
+	}
+}
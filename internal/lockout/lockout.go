@@ -0,0 +1,209 @@
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Record is what is known about the failed logins of one key (an account or an IP)
+type Record struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// Store keeps failure records.
+// Reserve counts an attempt at key as a failure unless allow rejects the record as it
+// was, and returns the record it decided on. it has to be atomic, so concurrent attempts
+// each see the ones before them. failures older than window are forgotten by then.
+// Release takes back one reserved failure
+type Store interface {
+	GetFailures(ctx context.Context, key string) (Record, error)
+	Reserve(ctx context.Context, key string, at time.Time, window time.Duration, allow func(Record) bool) (Record, bool, error)
+	Release(ctx context.Context, key string) error
+	Lock(ctx context.Context, key string, until time.Time) error
+	ResetFailures(ctx context.Context, key string) error
+}
+
+// Policy decides how long a key has to wait after failed logins
+type Policy struct {
+	// FreeAttempts can fail without any delay
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past FreeAttempts; it doubles with every further one
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockAfter failures lock the key for LockFor
+	LockAfter int
+	LockFor   time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+var (
+	DefaultAccountPolicy = Policy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockAfter:    10,
+		LockFor:      15 * time.Minute,
+		Window:       24 * time.Hour,
+	}
+	// DefaultIPPolicy is more lenient, since many users can share an address
+	DefaultIPPolicy = Policy{
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockAfter:    100,
+		LockFor:      time.Hour,
+		Window:       24 * time.Hour,
+	}
+)
+
+// Wait returns how long a key with rec has to wait before its next attempt
+func (p Policy) Wait(rec Record, now time.Time) time.Duration {
+	if now.Before(rec.LockedUntil) {
+		return rec.LockedUntil.Sub(now)
+	}
+	if rec.Failures <= p.FreeAttempts || now.Sub(rec.LastFailureAt) >= p.Window {
+		return 0
+	}
+
+	delay := p.MaxDelay
+	if shift := rec.Failures - p.FreeAttempts - 1; shift < 32 {
+		delay = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+	return max(rec.LastFailureAt.Add(delay).Sub(now), 0)
+}
+
+const (
+	AccountLocked = "account_locked"
+	IPLocked      = "ip_locked"
+)
+
+// Event describes suspicious activity: a key that was just locked
+type Event struct {
+	Kind        string
+	Username    string
+	IP          string
+	Failures    int
+	LockedUntil time.Time
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, e Event)
+}
+
+type NotifierFunc func(ctx context.Context, e Event)
+
+func (f NotifierFunc) Notify(ctx context.Context, e Event) {
+	f(ctx, e)
+}
+
+// Guard tracks failed logins per account and per IP
+type Guard struct {
+	store    Store
+	account  Policy
+	ip       Policy
+	notifier Notifier
+	now      func() time.Time
+}
+
+func NewGuard(store Store, account, ip Policy, notifier Notifier) *Guard {
+	return &Guard{
+		store:    store,
+		account:  account,
+		ip:       ip,
+		notifier: notifier,
+		now:      time.Now,
+	}
+}
+
+func accountKey(username string) string {
+	return "account:" + username
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Attempt is called before a password or code for username is checked. it returns how
+// long the caller has to wait, or 0 when the attempt may go ahead. an attempt that goes
+// ahead is counted as a failure right away, so guesses sent in parallel wait for each
+// other like serial ones; Succeeded takes it back. the IP is reserved first, so an IP
+// that has to wait leaves the account alone
+func (g *Guard) Attempt(ctx context.Context, username, ip string) (time.Duration, error) {
+	now := g.now()
+	for _, k := range []struct {
+		key    string
+		policy Policy
+	}{
+		{ipKey(ip), g.ip},
+		{accountKey(username), g.account},
+	} {
+		rec, ok, err := g.store.Reserve(ctx, k.key, now, k.policy.Window, func(rec Record) bool {
+			return k.policy.Wait(rec, now) == 0
+		})
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return k.policy.Wait(rec, now), nil
+		}
+	}
+	return 0, nil
+}
+
+// Failed is called when the attempt turned out wrong. it locks the account or IP once
+// their policy says so. unknown usernames are tracked like real ones, so lockouts do not
+// reveal which exist
+func (g *Guard) Failed(ctx context.Context, username, ip string) error {
+	err := g.lockIfDue(ctx, accountKey(username), g.account, Event{Kind: AccountLocked, Username: username, IP: ip})
+	if err != nil {
+		return err
+	}
+	return g.lockIfDue(ctx, ipKey(ip), g.ip, Event{Kind: IPLocked, Username: username, IP: ip})
+}
+
+func (g *Guard) lockIfDue(ctx context.Context, key string, policy Policy, event Event) error {
+	now := g.now()
+	rec, err := g.store.GetFailures(ctx, key)
+	if err != nil {
+		return err
+	}
+	if policy.LockAfter <= 0 || rec.Failures < policy.LockAfter || now.Before(rec.LockedUntil) {
+		return nil
+	}
+
+	event.Failures = rec.Failures
+	event.LockedUntil = now.Add(policy.LockFor)
+	err = g.store.Lock(ctx, key, event.LockedUntil)
+	if err != nil {
+		return err
+	}
+
+	if g.notifier != nil {
+		// notifying may mean sending email, which must not hold up the response
+		go g.notifier.Notify(context.WithoutCancel(ctx), event)
+	}
+	return nil
+}
+
+// Passed gives back a reserved attempt without forgetting the failures before it: for a
+// password that still needs a second factor, or a check an internal error cut short
+func (g *Guard) Passed(ctx context.Context, username, ip string) error {
+	err := g.store.Release(ctx, accountKey(username))
+	if err != nil {
+		return err
+	}
+	return g.store.Release(ctx, ipKey(ip))
+}
+
+// Succeeded forgets the failed logins of the account. the IP only gets its reserved
+// attempt back, so logging in to an account of one's own does not reset a guessing run
+func (g *Guard) Succeeded(ctx context.Context, username, ip string) error {
+	err := g.store.ResetFailures(ctx, accountKey(username))
+	if err != nil {
+		return err
+	}
+	return g.store.Release(ctx, ipKey(ip))
+}
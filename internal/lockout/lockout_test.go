@@ -0,0 +1,177 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func (m *memoryStore) GetFailures(ctx context.Context, key string) (Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.records[key], nil
+}
+
+func (m *memoryStore) Reserve(ctx context.Context, key string, at time.Time, window time.Duration, allow func(Record) bool) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := m.records[key]
+	if !allow(rec) {
+		return rec, false, nil
+	}
+	if at.Sub(rec.LastFailureAt) >= window {
+		rec.Failures = 0
+	}
+	rec.Failures++
+	rec.LastFailureAt = at
+	m.records[key] = rec
+	return rec, true, nil
+}
+
+func (m *memoryStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := m.records[key]
+	rec.Failures = max(rec.Failures-1, 0)
+	m.records[key] = rec
+	return nil
+}
+
+func (m *memoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec := m.records[key]
+	rec.LockedUntil = until
+	m.records[key] = rec
+	return nil
+}
+
+func (m *memoryStore) ResetFailures(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	return nil
+}
+
+func TestPolicyWait(t *testing.T) {
+	now := time.Now()
+	p := Policy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, Window: time.Hour}
+
+	tests := []struct {
+		name string
+		rec  Record
+		want time.Duration
+	}{
+		{name: "no failures", want: 0},
+		{name: "free attempts", rec: Record{Failures: 3, LastFailureAt: now}, want: 0},
+		{name: "first delay", rec: Record{Failures: 4, LastFailureAt: now}, want: time.Second},
+		{name: "doubles", rec: Record{Failures: 6, LastFailureAt: now}, want: 4 * time.Second},
+		{name: "capped", rec: Record{Failures: 60, LastFailureAt: now}, want: time.Minute},
+		{name: "delay already passed", rec: Record{Failures: 4, LastFailureAt: now.Add(-2 * time.Second)}, want: 0},
+		{name: "outside the window", rec: Record{Failures: 60, LastFailureAt: now.Add(-2 * time.Hour)}, want: 0},
+		{name: "locked", rec: Record{Failures: 1, LockedUntil: now.Add(10 * time.Minute)}, want: 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, p.Wait(tt.rec, now))
+		})
+	}
+}
+
+func TestGuardLocksAndNotifies(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	policy := Policy{FreeAttempts: 100, LockAfter: 3, LockFor: time.Minute, Window: time.Hour}
+
+	var (
+		wg     sync.WaitGroup
+		events []Event
+	)
+	wg.Add(1)
+	notifier := NotifierFunc(func(ctx context.Context, e Event) {
+		events = append(events, e)
+		wg.Done()
+	})
+
+	g := NewGuard(&memoryStore{records: map[string]Record{}}, policy, Policy{Window: time.Hour}, notifier)
+	g.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		wait, err := g.Attempt(ctx, "jane", "10.0.0.1")
+		require.NoError(t, err)
+		require.Zero(t, wait)
+		require.NoError(t, g.Failed(ctx, "jane", "10.0.0.1"))
+	}
+
+	wait, err := g.Attempt(ctx, "jane", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, wait, "the account is locked from any address")
+
+	wait, err = g.Attempt(ctx, "john", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait, "other accounts from the same address are not")
+	require.NoError(t, g.Succeeded(ctx, "john", "10.0.0.1"))
+
+	wg.Wait()
+	require.Len(t, events, 1)
+	assert.Equal(t, AccountLocked, events[0].Kind)
+	assert.Equal(t, "jane", events[0].Username)
+	assert.Equal(t, 3, events[0].Failures)
+
+	require.NoError(t, g.Succeeded(ctx, "jane", "10.0.0.1"))
+	wait, err = g.Attempt(ctx, "jane", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestGuardParallelAttempts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	policy := Policy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, Window: time.Hour}
+
+	store := &memoryStore{records: map[string]Record{}}
+	g := NewGuard(store, policy, Policy{Window: time.Hour}, nil)
+	g.now = func() time.Time { return now }
+
+	// guesses sent at once must not all get in before the first one is found wrong
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		allowed int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := g.Attempt(ctx, "jane", "10.0.0.1")
+			assert.NoError(t, err)
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, policy.FreeAttempts+1, allowed)
+
+	// a password that checks out only hands back its own attempt
+	require.NoError(t, g.Passed(ctx, "jane", "10.0.0.1"))
+	rec, err := store.GetFailures(ctx, accountKey("jane"))
+	require.NoError(t, err)
+	assert.Equal(t, policy.FreeAttempts, rec.Failures)
+}
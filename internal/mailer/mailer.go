@@ -0,0 +1,222 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("mailer: header values must not contain line breaks")
+
+// ErrNoSTARTTLS is returned when a relay does not offer STARTTLS and sending in
+// plain text was not allowed
+var ErrNoSTARTTLS = errors.New("mailer: smtp relay does not offer STARTTLS")
+
+// DefaultSMTPTimeout bounds a whole SMTP conversation when SMTPConfig.Timeout is unset
+const DefaultSMTPTimeout = 30 * time.Second
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outbound email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// encode renders msg as an RFC 5322 message
+func encode(from string, msg Message) ([]byte, error) {
+	for _, v := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return b.Bytes(), nil
+}
+
+type SMTPConfig struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	// Insecure allows relays that do not offer STARTTLS. relays on a loopback
+	// address are allowed without it anyway
+	Insecure bool
+	Timeout  time.Duration
+}
+
+// SMTP sends mail through a relay, upgrading to TLS with STARTTLS. credentials and
+// message bodies (reset links) never go out in plain text unless the config allows it
+type SMTP struct {
+	cfg  SMTPConfig
+	from string
+}
+
+func NewSMTP(cfg SMTPConfig, from string) *SMTP {
+	return &SMTP{
+		cfg:  cfg,
+		from: from,
+	}
+}
+
+func (m *SMTP) Send(ctx context.Context, msg Message) error {
+	data, err := encode(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	timeout := m.cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSMTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	} else if !m.plainTextAllowed(host) {
+		return ErrNoSTARTTLS
+	}
+	if m.cfg.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(m.from)
+	if err != nil {
+		return err
+	}
+	err = c.Rcpt(msg.To)
+	if err != nil {
+		return err
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = wc.Write(data)
+	if err != nil {
+		return err
+	}
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// plainTextAllowed reports whether mail may go to host without TLS: when the config
+// says so, or when the relay is on this machine
+func (m *SMTP) plainTextAllowed(host string) bool {
+	if m.cfg.Insecure || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// File writes every message to an .eml file in dir instead of sending it, for local development
+type File struct {
+	dir  string
+	from string
+}
+
+func NewFile(dir, from string) *File {
+	return &File{
+		dir:  dir,
+		from: from,
+	}
+}
+
+func (m *File) Send(ctx context.Context, msg Message) error {
+	data, err := encode(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	return os.WriteFile(filepath.Join(m.dir, name), data, 0o600)
+}
+
+// Memory keeps sent messages around so tests can inspect them
+type Memory struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Send(ctx context.Context, msg Message) error {
+	_, err := encode("", msg)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first
+func (m *Memory) Sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.sent...)
+}
@@ -0,0 +1,92 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := NewFile(dir, "fem <no-reply@example.com>")
+
+	err := m.Send(context.Background(), VerifyEmail("jane@example.com", "jane", "abc123"))
+	require.NoError(t, err)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	raw, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+	headers, body, ok := strings.Cut(string(raw), "\r\n\r\n")
+	require.True(t, ok)
+	assert.Contains(t, headers, "From: fem <no-reply@example.com>\r\n")
+	assert.Contains(t, headers, "To: jane@example.com\r\n")
+	assert.Contains(t, headers, "Subject: Confirm your email address\r\n")
+	assert.Contains(t, body, "abc123")
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+
+	require.NoError(t, m.Send(context.Background(), Message{To: "a@example.com", Subject: "one"}))
+	require.NoError(t, m.Send(context.Background(), Message{To: "b@example.com", Subject: "two"}))
+
+	sent := m.Sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "one", sent[0].Subject)
+	assert.Equal(t, "b@example.com", sent[1].To)
+}
+
+func TestHeaderInjection(t *testing.T) {
+	err := NewMemory().Send(context.Background(), Message{To: "a@example.com\r\nBcc: b@example.com"})
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestSMTPPlainText(t *testing.T) {
+	tests := []struct {
+		host     string
+		insecure bool
+		want     bool
+	}{
+		{host: "smtp.example.com", want: false},
+		{host: "203.0.113.7", want: false},
+		{host: "smtp.example.com", insecure: true, want: true},
+		{host: "localhost", want: true},
+		{host: "127.0.0.1", want: true},
+		{host: "::1", want: true},
+	}
+
+	for _, tt := range tests {
+		m := NewSMTP(SMTPConfig{Insecure: tt.insecure}, "")
+		assert.Equal(t, tt.want, m.plainTextAllowed(tt.host), tt.host)
+	}
+}
+
+func TestSMTPTimeout(t *testing.T) {
+	// a relay that accepts the connection but never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	m := NewSMTP(SMTPConfig{Addr: ln.Addr().String(), Timeout: 50 * time.Millisecond}, "no-reply@example.com")
+	start := time.Now()
+	err = m.Send(context.Background(), Message{To: "a@example.com", Subject: "hi"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
@@ -0,0 +1,58 @@
+package mailer
+
+import (
+	"fmt"
+	"time"
+)
+
+// VerifyEmail asks the owner of an address to confirm it
+func VerifyEmail(to, username, token string) Message {
+	return Message{
+		To:      to,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf(`Hi %s,
+
+please confirm this email address by sending the code below to POST /users/verify
+as {"token": "<code>"}. It expires in 24 hours.
+
+%s
+
+If you did not sign up, you can ignore this email.
+`, username, token),
+	}
+}
+
+// ResetPassword carries a password reset token
+func ResetPassword(to, username, token string) Message {
+	return Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(`Hi %s,
+
+someone asked to reset the password of your account. To pick a new one, send the code below
+to POST /password-reset/confirm as {"token": "<code>", "password": "<new password>"}.
+It expires in 30 minutes and can be used once. Every device you are logged in on will be
+logged out and your personal access tokens revoked.
+
+%s
+
+If this was not you, you can ignore this email; your password stays the same.
+`, username, token),
+	}
+}
+
+// AccountLocked warns the owner of an account that logins were blocked after repeated failures
+func AccountLocked(to, username string, until time.Time) Message {
+	return Message{
+		To:      to,
+		Subject: "Your account was temporarily locked",
+		Body: fmt.Sprintf(`Hi %s,
+
+there were several failed attempts to log in to your account, so logging in is blocked
+until %s.
+
+If this was you, wait until then and try again. If it was not, someone may be guessing your
+password; consider changing it to a long, unique one once the lock has passed.
+`, username, until.UTC().Format(time.RFC1123)),
+	}
+}
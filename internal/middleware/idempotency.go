@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fem/internal/problem"
+	"fem/internal/store"
+	"fem/internal/utils"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotencyTTL is how long a response stays available for retries
+	IdempotencyTTL = 24 * time.Hour
+
+	maxIdempotencyKeyLength = 255
+)
+
+// replayedHeaders are kept with a response; the rest are set again by the middleware
+// a replay passes through, or belong to the original exchange only
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// Idempotent lets clients retry a create safely: the first request sent with an
+// Idempotency-Key is handled and its response kept, repeats get that response again.
+// reusing a key for a different request is a 409, as is a repeat while the first one
+// is still running. 5xx responses are not kept, so the retry runs the request again.
+// keys are per user, so it has to run after Authenticate and IsAuthed. responses are
+// stored as they are: keep it off routes that hand out secrets, like new API tokens
+func (um *UserMiddleware) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || um.IdempotencyStore == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength || !printableASCII(key) {
+			problem.Write(w, r, problem.BadRequest("Idempotency-Key must be at most 255 printable ASCII characters"))
+			return
+		}
+
+		// one byte past the limit is enough for the handler to turn the body down
+		body, err := io.ReadAll(io.LimitReader(r.Body, utils.MaxBodyBytes+1))
+		if err != nil {
+			problem.Write(w, r, problem.BadRequest("request body could not be read"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := GetUser(r).ID
+		fingerprint := requestFingerprint(r, body)
+
+		stored, err := um.IdempotencyStore.ReserveIdempotencyKey(r.Context(), userID, key, fingerprint, IdempotencyTTL)
+		if err != nil {
+			problem.WriteError(w, r, err)
+			return
+		}
+		if stored != nil {
+			replay(w, r, stored, fingerprint)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		saved := false
+		defer func() {
+			// a failed or panicking request gives its key back for the retry
+			if !saved {
+				um.IdempotencyStore.ReleaseIdempotencyKey(context.WithoutCancel(r.Context()), userID, key)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			return
+		}
+		resp := &store.IdempotentResponse{Status: rec.status, Header: map[string]string{}, Body: rec.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				resp.Header[name] = value
+			}
+		}
+		err = um.IdempotencyStore.SaveIdempotentResponse(context.WithoutCancel(r.Context()), userID, key, resp)
+		saved = err == nil
+	})
+}
+
+func replay(w http.ResponseWriter, r *http.Request, stored *store.IdempotentResponse, fingerprint []byte) {
+	if !bytes.Equal(stored.Fingerprint, fingerprint) {
+		problem.Write(w, r, problem.New(http.StatusConflict, problem.CodeConflict,
+			"this Idempotency-Key was already used for a different request"))
+		return
+	}
+	if stored.Status == 0 {
+		w.Header().Set("Retry-After", "1")
+		problem.Write(w, r, problem.New(http.StatusConflict, problem.CodeConflict,
+			"a request with this Idempotency-Key is still being handled"))
+		return
+	}
+
+	for name, value := range stored.Header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// requestFingerprint tells requests apart by method, path and body
+func requestFingerprint(r *http.Request, body []byte) []byte {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// responseRecorder passes a response through and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
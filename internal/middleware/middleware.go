@@ -4,21 +4,63 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fem/internal/problem"
+	"fem/internal/ratelimit"
 	"fem/internal/store"
+	"fem/internal/telemetry"
 	"fem/internal/tokens"
 	"fem/internal/utils"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 )
 
 type UserMiddleware struct {
 	UserStore    store.UserStore
 	WorkoutStore store.WorkoutStore
+	TokenStore   store.TokenStore
+	TokenFormat  tokens.Format
+	Denylist     tokens.Denylist
+	// UnverifiedPolicy limits accounts whose email address is not confirmed yet
+	UnverifiedPolicy UnverifiedPolicy
+	Cookies          Cookies
+	// RateLimiter backs RateLimit; nil turns rate limiting off
+	RateLimiter *ratelimit.Limiter
+	// IdempotencyStore backs Idempotent; nil ignores Idempotency-Key
+	IdempotencyStore store.IdempotencyStore
+}
+
+// UnverifiedPolicy decides what an account may do before its email address is confirmed
+type UnverifiedPolicy string
+
+const (
+	// UnverifiedAllow puts no limits on unverified accounts
+	UnverifiedAllow UnverifiedPolicy = "allow"
+	// UnverifiedRestrict lets unverified accounts log in and read, but not write
+	// workouts or create personal access tokens
+	UnverifiedRestrict UnverifiedPolicy = "restrict"
+	// UnverifiedBlock refuses to log unverified accounts in at all
+	UnverifiedBlock UnverifiedPolicy = "block"
+)
+
+func ParseUnverifiedPolicy(s string) (UnverifiedPolicy, error) {
+	switch p := UnverifiedPolicy(s); p {
+	case UnverifiedAllow, UnverifiedRestrict, UnverifiedBlock:
+		return p, nil
+	default:
+		return "", fmt.Errorf("middleware: unknown unverified account policy %q", s)
+	}
 }
 
 type contextKey string
 
-const UserContextKey = contextKey("user")
+const (
+	UserContextKey   = contextKey("user")
+	TokenContextKey  = contextKey("token")
+	ScopesContextKey = contextKey("scopes")
+	CookieContextKey = contextKey("cookie")
+)
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
 	ctx := context.WithValue(r.Context(), UserContextKey, user)
@@ -37,56 +79,159 @@ func GetUser(r *http.Request) *store.User {
 	return user
 }
 
+func SetTokenHash(r *http.Request, hash []byte) *http.Request {
+	ctx := context.WithValue(r.Context(), TokenContextKey, hash)
+	return r.WithContext(ctx)
+}
+
+// GetTokenHash returns the hash of the bearer token the request was authenticated with,
+// or nil for anonymous requests
+func GetTokenHash(r *http.Request) []byte {
+	hash, _ := r.Context().Value(TokenContextKey).([]byte)
+	return hash
+}
+
+// SetScopes restricts the request to the scopes of the personal access token it carries
+func SetScopes(r *http.Request, scopes []string) *http.Request {
+	ctx := context.WithValue(r.Context(), ScopesContextKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// GetScopes returns the scopes granted to the request, and false
+// when the request is not limited by scopes (session tokens and anonymous requests)
+func GetScopes(r *http.Request) ([]string, bool) {
+	scopes, ok := r.Context().Value(ScopesContextKey).([]string)
+	return scopes, ok
+}
+
+// SetFromCookie marks a request as authenticated by a browser session cookie
+func SetFromCookie(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), CookieContextKey, true)
+	return r.WithContext(ctx)
+}
+
+// FromCookie reports whether the request was authenticated by a session cookie
+// rather than an Authorization header
+func FromCookie(r *http.Request) bool {
+	fromCookie, _ := r.Context().Value(CookieContextKey).(bool)
+	return fromCookie
+}
+
+func ClientInfo(r *http.Request) store.ClientInfo {
+	return store.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IP:        utils.ClientIP(r),
+	}
+}
+
+// Authenticate resolves the bearer token in the Authorization header, or else the
+// session cookie, to the user of the request. cookies are sent by the browser on
+// requests other sites trigger too, so unsafe methods also need the CSRF header
 func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "Cookie")
 		authHeader := r.Header.Get("Authorization")
+		cookieToken := um.Cookies.SessionToken(r)
 
-		if authHeader == "" {
+		if authHeader == "" && cookieToken == "" {
 			r = SetUser(r, store.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		headerParts := strings.Split(authHeader, " ") // Bearer <TOKEN>
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{
-				"error": "invalid authorization header",
-			})
-			return
+		token := cookieToken
+		fromCookie := authHeader == ""
+		if fromCookie {
+			// personal access tokens are for scripts and never handed out as cookies
+			if tokens.IsAPIToken(token) {
+				problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "invalid session cookie"))
+				return
+			}
+			if !safeMethod(r.Method) && !um.Cookies.CheckCSRF(r) {
+				problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeCSRFFailed, "missing or wrong "+CSRFHeader+" header"))
+				return
+			}
+		} else {
+			headerParts := strings.Split(authHeader, " ") // Bearer <TOKEN>
+			if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+				problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "invalid authorization header"))
+				return
+			}
+			token = headerParts[1]
 		}
 
-		token := headerParts[1]
-		user, err := um.UserStore.GetUserByToken(tokens.ScopeAuth, token)
+		user, scopes, stateless, err := um.lookupToken(r.Context(), token)
 
 		if err != nil {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{
-				"error": "invalid token",
-			})
+			if store.IsTimeout(err) || store.IsUnavailable(err) {
+				problem.WriteError(w, r, err)
+				return
+			}
+			problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "invalid token"))
 			return
 		}
 
 		if user == nil {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{
-				"error": "token expired or invalid",
-			})
+			problem.Write(w, r, problem.Unauthorized(problem.CodeInvalidToken, "token expired or invalid"))
 			return
 		}
 
+		hash := tokens.Hash(token)
+		if !stateless {
+			// best effort: a failed last-used update must not fail the request
+			_ = um.TokenStore.TouchToken(r.Context(), hash, ClientInfo(r))
+		}
+
 		r = SetUser(r, user)
+		r = SetTokenHash(r, hash)
+		if tokens.IsAPIToken(token) {
+			r = SetScopes(r, scopes)
+		}
+		if fromCookie {
+			r = SetFromCookie(r)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// lookupToken resolves a bearer token to its user. signed access tokens are verified
+// locally and checked against the in-memory denylist, everything else is read from the db.
+// a nil user without an error means the token is invalid, expired or revoked
+func (um *UserMiddleware) lookupToken(ctx context.Context, token string) (*store.User, []string, bool, error) {
+	ctx, span := telemetry.Start(ctx, "Authenticate.lookupToken")
+	defer span.End()
+
+	if tokens.IsAPIToken(token) {
+		user, scopes, err := um.UserStore.GetUserByAPIToken(ctx, token)
+		return user, scopes, false, err
+	}
+
+	claims, err := um.TokenFormat.Parse(token)
+	if errors.Is(err, tokens.ErrNotStateless) {
+		user, err := um.UserStore.GetUserByToken(ctx, tokens.ScopeAuth, token)
+		return user, nil, false, err
+	}
+	if err != nil || claims.Scope != tokens.ScopeAuth {
+		return nil, nil, true, nil
+	}
+
+	denied, err := um.Denylist.IsDenied(ctx, claims.ID)
+	if err != nil || denied {
+		return nil, nil, true, err
+	}
+
+	// only the id is known without a db read; handlers needing more must load the user
+	return &store.User{ID: claims.UserID}, nil, true, nil
+}
+
 // @note: not used
 func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := GetUser(r)
 
 		if user.IsAnonymous() {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{
-				"error": "unauthorized",
-			})
+			problem.Write(w, r, problem.Unauthorized(problem.CodeUnauthorized, "unauthorized"))
 			return
 		}
 
@@ -99,9 +244,60 @@ func (um *UserMiddleware) IsAuthed(next http.Handler) http.Handler {
 		user := GetUser(r)
 
 		if user.IsAnonymous() {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{
-				"error": "unauthorized",
-			})
+			problem.Write(w, r, problem.Unauthorized(problem.CodeUnauthorized, "unauthorized"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope lets a personal access token through only when it was granted scope.
+// session tokens are not limited by scopes
+func (um *UserMiddleware) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scopes, limited := GetScopes(r)
+
+			if limited && !slices.Contains(scopes, scope) {
+				problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeInsufficientScope, "token is missing the "+scope+" scope"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession rejects personal access tokens, e.g. for routes that manage tokens themselves
+func (um *UserMiddleware) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, limited := GetScopes(r); limited {
+			problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeInsufficientScope, "this route cannot be used with a personal access token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireVerified rejects accounts with an unconfirmed email address unless the policy allows them
+func (um *UserMiddleware) RequireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r)
+		if um.UnverifiedPolicy == UnverifiedAllow || user.EmailVerified {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// users behind a signed token only carry their id, so ask the db
+		fresh, err := um.UserStore.GetUserByID(r.Context(), user.ID)
+		if err != nil {
+			problem.WriteError(w, r, err)
+			return
+		}
+		if fresh == nil || !fresh.EmailVerified {
+			problem.Write(w, r, problem.New(http.StatusForbidden, problem.CodeEmailUnverified, "confirm your email address first"))
 			return
 		}
 
@@ -113,18 +309,18 @@ func (um *UserMiddleware) CanModifyWorkouts(next http.HandlerFunc) http.HandlerF
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sessionUserID := GetUser(r).ID
 		workoutID, _ := utils.ReadIDParam(r)
-		workoutOwnerID, err := um.WorkoutStore.GetWorkoutOwnerID(workoutID)
+		workoutOwnerID, err := um.WorkoutStore.GetWorkoutOwnerID(r.Context(), workoutID)
 
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+				problem.Write(w, r, problem.NotFound("workout not found"))
 				return
 			}
-			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			problem.WriteError(w, r, err)
 			return
 		}
 		if sessionUserID != workoutOwnerID {
-			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "unauthorized"})
+			problem.Write(w, r, problem.Forbidden("you are not allowed to modify this workout"))
 			return
 		}
 
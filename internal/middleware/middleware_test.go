@@ -0,0 +1,330 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fem/internal/ratelimit"
+	"fem/internal/store"
+	"fem/internal/tokens"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireScope(t *testing.T) {
+	um := &UserMiddleware{}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		scopes     []string
+		limited    bool
+		wantStatus int
+	}{
+		{name: "session token", wantStatus: http.StatusOK},
+		{name: "granted", scopes: []string{tokens.ScopeWorkoutsWrite}, limited: true, wantStatus: http.StatusOK},
+		{name: "not granted", scopes: []string{tokens.ScopeWorkoutsRead}, limited: true, wantStatus: http.StatusForbidden},
+		{name: "no scopes", scopes: []string{}, limited: true, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/workouts", nil)
+			if tt.limited {
+				r = SetScopes(r, tt.scopes)
+			}
+			w := httptest.NewRecorder()
+
+			um.RequireScope(tokens.ScopeWorkoutsWrite)(ok).ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	um := &UserMiddleware{}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	um.RequireSession(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tokens/api", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r := SetScopes(httptest.NewRequest(http.MethodGet, "/tokens/api", nil), tokens.APIScopes)
+	um.RequireSession(ok).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+type stubUserStore struct {
+	store.UserStore
+	user *store.User
+}
+
+func (s stubUserStore) GetUserByID(ctx context.Context, id int) (*store.User, error) {
+	return s.user, nil
+}
+
+func (s stubUserStore) GetUserByToken(ctx context.Context, scope, token string) (*store.User, error) {
+	if token != "session-token" {
+		return nil, nil
+	}
+	return s.user, nil
+}
+
+type stubTokenStore struct {
+	store.TokenStore
+}
+
+func (stubTokenStore) TouchToken(ctx context.Context, hash []byte, client store.ClientInfo) error {
+	return nil
+}
+
+func TestRequireVerified(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		policy     UnverifiedPolicy
+		user       *store.User
+		stored     *store.User
+		wantStatus int
+	}{
+		{name: "verified", policy: UnverifiedRestrict, user: &store.User{ID: 1, EmailVerified: true}, wantStatus: http.StatusOK},
+		{name: "unverified", policy: UnverifiedRestrict, user: &store.User{ID: 1}, stored: &store.User{ID: 1}, wantStatus: http.StatusForbidden},
+		{name: "unverified but allowed", policy: UnverifiedAllow, user: &store.User{ID: 1}, wantStatus: http.StatusOK},
+		{name: "signed token of a verified user", policy: UnverifiedRestrict, user: &store.User{ID: 1}, stored: &store.User{ID: 1, EmailVerified: true}, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			um := &UserMiddleware{UserStore: stubUserStore{user: tt.stored}, UnverifiedPolicy: tt.policy}
+			r := SetUser(httptest.NewRequest(http.MethodPost, "/workouts", nil), tt.user)
+			w := httptest.NewRecorder()
+
+			um.RequireVerified(ok).ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+}
+
+func TestAuthenticateCookie(t *testing.T) {
+	user := &store.User{ID: 7}
+	cookies := Cookies{}
+	um := &UserMiddleware{
+		UserStore:   stubUserStore{user: user},
+		TokenStore:  stubTokenStore{},
+		TokenFormat: tokens.Opaque{},
+		Cookies:     cookies,
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, user, GetUser(r))
+		assert.True(t, FromCookie(r))
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// the cookies a login hands out
+	login := httptest.NewRecorder()
+	csrf, err := cookies.SetSession(login, &store.TokenPair{
+		Auth:    &tokens.Token{Plaintext: "session-token", Expiry: time.Now().Add(time.Hour)},
+		Refresh: &tokens.Token{Plaintext: "refresh-token", Expiry: time.Now().Add(24 * time.Hour)},
+	})
+	require.NoError(t, err)
+	set := login.Result().Cookies()
+	require.Len(t, set, 3)
+	for _, c := range set {
+		assert.True(t, c.Secure, c.Name)
+		assert.Equal(t, c.Name != CSRFCookie, c.HttpOnly, c.Name)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		cookies    []*http.Cookie
+		csrf       string
+		wantStatus int
+	}{
+		{name: "read", method: http.MethodGet, cookies: set, wantStatus: http.StatusOK},
+		{name: "write with csrf header", method: http.MethodPost, cookies: set, csrf: csrf, wantStatus: http.StatusOK},
+		{name: "write without csrf header", method: http.MethodPost, cookies: set, wantStatus: http.StatusForbidden},
+		{name: "write with wrong csrf header", method: http.MethodDelete, cookies: set, csrf: "guessed", wantStatus: http.StatusForbidden},
+		{name: "unknown session", method: http.MethodGet, cookies: []*http.Cookie{{Name: SessionCookie, Value: "expired"}}, wantStatus: http.StatusUnauthorized},
+		{name: "api token as cookie", method: http.MethodGet, cookies: []*http.Cookie{{Name: SessionCookie, Value: tokens.APITokenPrefix + "abc"}}, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/workouts", nil)
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			if tt.csrf != "" {
+				r.Header.Set(CSRFHeader, tt.csrf)
+			}
+			w := httptest.NewRecorder()
+
+			um.Authenticate(next).ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+		})
+	}
+
+	t.Run("bearer needs no csrf header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/workouts", nil)
+		r.Header.Set("Authorization", "Bearer session-token")
+		w := httptest.NewRecorder()
+
+		um.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.False(t, FromCookie(r))
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestInsecureCookies(t *testing.T) {
+	w := httptest.NewRecorder()
+	Cookies{Insecure: true}.ClearSession(w)
+
+	for _, c := range w.Result().Cookies() {
+		assert.False(t, c.Secure)
+		assert.NotContains(t, c.Name, "__")
+		assert.Equal(t, -1, c.MaxAge)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	um := &UserMiddleware{RateLimiter: ratelimit.NewLimiter(ratelimit.NewMemoryStore())}
+	policy := ratelimit.Policy{Name: "test", Limit: 2, Period: time.Minute}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := um.RateLimit(policy, ByClient)(ok)
+
+	send := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	anonymous := func() *http.Request {
+		return SetUser(httptest.NewRequest(http.MethodGet, "/workouts/1", nil), store.AnonymousUser)
+	}
+
+	w := send(anonymous())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+
+	send(anonymous())
+	w = send(anonymous())
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// a user on the same address has a bucket of their own, and so has each of their tokens
+	user := SetUser(httptest.NewRequest(http.MethodGet, "/workouts/1", nil), &store.User{ID: 7})
+	assert.Equal(t, http.StatusOK, send(user).Code)
+	token := SetScopes(SetTokenHash(user, []byte{1, 2, 3}), tokens.APIScopes)
+	assert.Equal(t, "1", send(token).Header().Get("RateLimit-Remaining"))
+
+	w = httptest.NewRecorder()
+	(&UserMiddleware{}).RateLimit(policy, ByIP)(ok).ServeHTTP(w, anonymous())
+	assert.Equal(t, http.StatusOK, w.Code, "without a limiter nothing is limited")
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+type memoryIdempotencyStore struct {
+	responses map[string]*store.IdempotentResponse
+}
+
+func (m *memoryIdempotencyStore) ReserveIdempotencyKey(ctx context.Context, userID int, key string, fingerprint []byte, ttl time.Duration) (*store.IdempotentResponse, error) {
+	k := strconv.Itoa(userID) + ":" + key
+	if resp, ok := m.responses[k]; ok {
+		return resp, nil
+	}
+	m.responses[k] = &store.IdempotentResponse{Fingerprint: fingerprint}
+	return nil, nil
+}
+
+func (m *memoryIdempotencyStore) SaveIdempotentResponse(ctx context.Context, userID int, key string, resp *store.IdempotentResponse) error {
+	k := strconv.Itoa(userID) + ":" + key
+	resp.Fingerprint = m.responses[k].Fingerprint
+	m.responses[k] = resp
+	return nil
+}
+
+func (m *memoryIdempotencyStore) ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error {
+	delete(m.responses, strconv.Itoa(userID)+":"+key)
+	return nil
+}
+
+func TestIdempotent(t *testing.T) {
+	idempotency := &memoryIdempotencyStore{responses: map[string]*store.IdempotentResponse{}}
+	um := &UserMiddleware{IdempotencyStore: idempotency}
+
+	calls := 0
+	status := http.StatusCreated
+	handler := um.Idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Call", strconv.Itoa(calls))
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"call":%d,"body":%q}`, calls, body)
+	}))
+
+	send := func(userID int, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/workouts", strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, SetUser(r, &store.User{ID: userID}))
+		return w
+	}
+
+	first := send(1, "abc", `{"title":"run"}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, `{"call":1,"body":"{\"title\":\"run\"}"}`, first.Body.String(), "the handler still sees the body")
+
+	retry := send(1, "abc", `{"title":"run"}`)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Empty(t, retry.Header().Get("X-Call"), "only some headers are kept")
+
+	assert.Equal(t, http.StatusConflict, send(1, "abc", `{"title":"swim"}`).Code)
+	assert.Equal(t, http.StatusCreated, send(2, "abc", `{"title":"swim"}`).Code, "keys are per user")
+	assert.Equal(t, http.StatusCreated, send(1, "", `{"title":"run"}`).Code)
+	assert.Equal(t, 3, calls)
+
+	idempotency.responses["1:busy"] = &store.IdempotentResponse{Fingerprint: requestFingerprint(httptest.NewRequest(http.MethodPost, "/workouts", nil), []byte("{}"))}
+	w := send(1, "busy", "{}")
+	assert.Equal(t, http.StatusConflict, w.Code, "still running")
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// server errors are not kept, the retry runs again
+	status = http.StatusServiceUnavailable
+	assert.Equal(t, http.StatusServiceUnavailable, send(1, "flaky", "{}").Code)
+	status = http.StatusCreated
+	assert.Equal(t, http.StatusCreated, send(1, "flaky", "{}").Code)
+	assert.Equal(t, 5, calls)
+
+	assert.Equal(t, http.StatusBadRequest, send(1, "bad\nkey", "{}").Code)
+}
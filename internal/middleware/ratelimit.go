@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"fem/internal/problem"
+	"fem/internal/ratelimit"
+	"fem/internal/store"
+	"fem/internal/utils"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitKey picks what a rate limit counts requests against
+type RateLimitKey int
+
+const (
+	// ByClient counts each personal access token on its own, logged in users per
+	// account and anonymous requests per IP. it has to run after Authenticate
+	ByClient RateLimitKey = iota
+	// ByIP counts per IP whoever is calling, for routes used before logging in
+	ByIP
+)
+
+func rateLimitKey(r *http.Request, by RateLimitKey) string {
+	if by == ByClient {
+		user, ok := r.Context().Value(UserContextKey).(*store.User)
+		if ok && !user.IsAnonymous() {
+			if _, limited := GetScopes(r); limited {
+				return "token:" + hex.EncodeToString(GetTokenHash(r))
+			}
+			return "user:" + strconv.Itoa(user.ID)
+		}
+	}
+	return "ip:" + utils.ClientIP(r)
+}
+
+// RateLimit throttles requests with policy and reports the bucket in RateLimit-* headers.
+// with several limits on a route, the headers show the one closest to running out
+func (um *UserMiddleware) RateLimit(policy ratelimit.Policy, by RateLimitKey) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if um.RateLimiter == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			res, err := um.RateLimiter.Allow(r.Context(), policy, rateLimitKey(r, by))
+			if err != nil {
+				problem.WriteError(w, r, err)
+				return
+			}
+			writeRateLimitHeaders(w, policy, res)
+
+			if !res.Allowed {
+				retryAfter := seconds(res.RetryAfter)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				problem.Write(w, r, problem.New(http.StatusTooManyRequests, problem.CodeRateLimited,
+					"rate limit exceeded, try again in "+strconv.Itoa(retryAfter)+" seconds"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeRateLimitHeaders follows the IETF RateLimit header fields draft
+func writeRateLimitHeaders(w http.ResponseWriter, policy ratelimit.Policy, res ratelimit.Result) {
+	if prev := w.Header().Get("RateLimit-Remaining"); prev != "" {
+		if remaining, err := strconv.Atoi(prev); err == nil && remaining <= res.Remaining {
+			return
+		}
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, seconds(policy.Period)))
+}
+
+// seconds rounds d up, a client waiting the rounded down time would be refused again
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fem/internal/store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cookie names of browser sessions. the __Host- prefix makes browsers refuse the cookie
+// unless it is Secure, host-only and on /, so a sibling subdomain cannot plant one
+const (
+	SessionCookie = "__Host-session"
+	RefreshCookie = "__Secure-refresh"
+	CSRFCookie    = "__Host-csrf"
+	// CSRFHeader must echo the CSRF cookie on state-changing requests made with cookies
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// refreshCookiePath limits the refresh token to the one route that takes it
+const refreshCookiePath = "/tokens/refresh"
+
+// WantsCookies reports whether a login asked for a browser session (?session=cookie)
+// instead of tokens in the response body
+func WantsCookies(r *http.Request) bool {
+	return r.URL.Query().Get("session") == "cookie"
+}
+
+// Cookies writes and reads the cookies of browser sessions. the auth and refresh tokens
+// are the same rows in the tokens table a bearer login gets, only kept where scripts
+// cannot read them
+type Cookies struct {
+	// Insecure drops the Secure attribute and the name prefixes that require it,
+	// for development over plain http
+	Insecure bool
+}
+
+func (c Cookies) name(name string) string {
+	if c.Insecure {
+		name = strings.TrimPrefix(name, "__Host-")
+		name = strings.TrimPrefix(name, "__Secure-")
+	}
+	return name
+}
+
+func (c Cookies) cookie(name, value, path string, httpOnly bool, sameSite http.SameSite, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     c.name(name),
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   !c.Insecure,
+		SameSite: sameSite,
+	}
+	if expires.IsZero() {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// SetSession hands pair to the browser and returns the new CSRF token, which the
+// frontend sends back in CSRFHeader. it is also readable from CSRFCookie after a reload
+func (c Cookies) SetSession(w http.ResponseWriter, pair *store.TokenPair) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	csrf := base64.RawURLEncoding.EncodeToString(b)
+
+	http.SetCookie(w, c.cookie(SessionCookie, pair.Auth.Plaintext, "/", true, http.SameSiteLaxMode, pair.Auth.Expiry))
+	http.SetCookie(w, c.cookie(RefreshCookie, pair.Refresh.Plaintext, refreshCookiePath, true, http.SameSiteStrictMode, pair.Refresh.Expiry))
+	http.SetCookie(w, c.cookie(CSRFCookie, csrf, "/", false, http.SameSiteStrictMode, pair.Refresh.Expiry))
+	return csrf, nil
+}
+
+// ClearSession tells the browser to drop every session cookie
+func (c Cookies) ClearSession(w http.ResponseWriter) {
+	http.SetCookie(w, c.cookie(SessionCookie, "", "/", true, http.SameSiteLaxMode, time.Time{}))
+	http.SetCookie(w, c.cookie(RefreshCookie, "", refreshCookiePath, true, http.SameSiteStrictMode, time.Time{}))
+	http.SetCookie(w, c.cookie(CSRFCookie, "", "/", false, http.SameSiteStrictMode, time.Time{}))
+}
+
+func (c Cookies) value(r *http.Request, name string) string {
+	cookie, err := r.Cookie(c.name(name))
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// SessionToken is the auth token in the session cookie, "" when there is none
+func (c Cookies) SessionToken(r *http.Request) string {
+	return c.value(r, SessionCookie)
+}
+
+// RefreshToken is the refresh token in the refresh cookie, "" when there is none
+func (c Cookies) RefreshToken(r *http.Request) string {
+	return c.value(r, RefreshCookie)
+}
+
+// CheckCSRF is the double-submit check: another site can make the browser send our
+// cookies, but cannot read the CSRF cookie to copy it into the header
+func (c Cookies) CheckCSRF(r *http.Request) bool {
+	cookie := c.value(r, CSRFCookie)
+	header := r.Header.Get(CSRFHeader)
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// safeMethod reports methods that must not change state, so need no CSRF check
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
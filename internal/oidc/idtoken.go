@@ -0,0 +1,168 @@
+package oidc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Claims is who the provider says signed in. Subject is stable per provider,
+// the email may change or be reused, so identities are linked on Subject
+type Claims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+type idTokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// audience is a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*a = many
+	return err
+}
+
+// flexBool is a bool some providers send as "true"/"false"
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("oidc: %s is not a boolean", data)
+	}
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+}
+
+func decodeSegment(segment string, dst any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
+
+// VerifyIDToken checks the signature of raw against the provider's keys and that it was
+// issued by the provider, to this client, for the login that used nonce, and is not expired
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWS", ErrVerification)
+	}
+
+	var header idTokenHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad header", ErrVerification)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrVerification)
+	}
+
+	key, ok, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrVerification, header.Kid)
+	}
+	// the algorithm must be the one the key was published for, never "none" or HMAC
+	if !key.verify(header.Alg, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrVerification)
+	}
+
+	var claims idTokenClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad claims", ErrVerification)
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.cfg.Issuer:
+		return nil, fmt.Errorf("%w: issued by %q", ErrVerification, claims.Issuer)
+	case !slices.Contains(claims.Audience, p.cfg.ClientID):
+		return nil, fmt.Errorf("%w: issued to another client", ErrVerification)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID:
+		return nil, fmt.Errorf("%w: authorized party is not this client", ErrVerification)
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(clockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrVerification)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrVerification)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce does not match", ErrVerification)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrVerification)
+	}
+
+	return &Claims{
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     bool(claims.EmailVerified),
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+// UsernameHint suggests a username for an account created from c: the preferred username,
+// else the local part of the email without any +tag, reduced to letters, digits, '.', '-' and '_'
+func (c *Claims) UsernameHint() string {
+	hint := c.PreferredUsername
+	if hint == "" {
+		hint, _, _ = strings.Cut(c.Email, "@")
+		hint, _, _ = strings.Cut(hint, "+")
+	}
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(hint) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(".-_", r)) {
+			b.WriteRune(r)
+		}
+	}
+	hint = b.String()
+	if len(hint) > 40 {
+		hint = hint[:40]
+	}
+	if hint == "" {
+		return "user"
+	}
+	return hint
+}
@@ -0,0 +1,150 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// keyRefetchInterval limits how often an unknown kid makes us fetch the JWKS again,
+// so tokens with made up key ids cannot hammer the provider
+const keyRefetchInterval = time.Minute
+
+// publicKey verifies signatures of one JWK for the algorithm it was published with
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func parseJWK(k jwk) (publicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31 {
+			return publicKey{}, fmt.Errorf("oidc: RSA key %q is too small or has a bad exponent", k.Kid)
+		}
+		return publicKey{alg: "RS256", key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return publicKey{}, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := b64(k.Y)
+		if err != nil || len(x) != 32 || len(y) != 32 {
+			return publicKey{}, fmt.Errorf("oidc: bad P-256 key %q", k.Kid)
+		}
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return publicKey{}, err
+		}
+		return publicKey{alg: "ES256", key: key}, nil
+	case "OKP":
+		x, err := b64(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, fmt.Errorf("oidc: bad Ed25519 key %q", k.Kid)
+		}
+		return publicKey{alg: "EdDSA", key: ed25519.PublicKey(x)}, nil
+	default:
+		return publicKey{}, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+	}
+}
+
+func (k publicKey) verify(alg string, signed, sig []byte) bool {
+	if alg != k.alg {
+		return false
+	}
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS carries r||s, not ASN.1
+		if len(sig) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+// key returns the signing key with kid, fetching the JWKS when it is not known yet.
+// keys that cannot be parsed are skipped, a provider may publish types we do not use
+func (p *Provider) key(ctx context.Context, kid string) (publicKey, bool, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return publicKey{}, false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, true, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetch) < keyRefetchInterval {
+		return publicKey{}, false, nil
+	}
+
+	var set jwks
+	err = p.getJSON(ctx, meta.JWKSURI, &set)
+	if err != nil {
+		return publicKey{}, false, err
+	}
+	keys := map[string]publicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys, p.keysFetch = keys, time.Now()
+
+	key, ok := keys[kid]
+	return key, ok, nil
+}
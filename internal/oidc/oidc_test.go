@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"fem/internal/oidc/oidctest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const redirectURL = "http://localhost:5173/oidc/callback"
+
+func newTestProvider(t *testing.T) (*Provider, *oidctest.Server) {
+	t.Helper()
+	server := oidctest.NewServer("fem", "s3cret")
+	t.Cleanup(server.Close)
+
+	return NewProvider(ProviderConfig{
+		Name:         "test",
+		Issuer:       server.Issuer(),
+		ClientID:     "fem",
+		ClientSecret: "s3cret",
+		RedirectURL:  redirectURL,
+	}, server.Client()), server
+}
+
+// authorize follows the login through the provider and returns the callback query
+func authorize(t *testing.T, p *Provider, req *AuthRequest) url.Values {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), req)
+	require.NoError(t, err)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(location.String(), redirectURL))
+	return location.Query()
+}
+
+func TestLogin(t *testing.T) {
+	p, server := newTestProvider(t)
+	server.SignIn(oidctest.User{Subject: "42", Email: "grace@example.com", EmailVerified: true, PreferredUsername: "Grace H."})
+	ctx := context.Background()
+
+	req, err := NewAuthRequest()
+	require.NoError(t, err)
+	callback := authorize(t, p, req)
+	assert.Equal(t, req.State, callback.Get("state"))
+
+	idToken, err := p.Exchange(ctx, callback.Get("code"), req.Verifier)
+	require.NoError(t, err)
+
+	claims, err := p.VerifyIDToken(ctx, idToken, req.Nonce)
+	require.NoError(t, err)
+	assert.Equal(t, &Claims{Subject: "42", Email: "grace@example.com", EmailVerified: true, PreferredUsername: "Grace H."}, claims)
+
+	// codes are single use
+	_, err = p.Exchange(ctx, callback.Get("code"), req.Verifier)
+	assert.ErrorIs(t, err, ErrExchange)
+}
+
+func TestExchangeNeedsTheVerifier(t *testing.T) {
+	p, _ := newTestProvider(t)
+
+	req, err := NewAuthRequest()
+	require.NoError(t, err)
+	callback := authorize(t, p, req)
+
+	other, err := NewAuthRequest()
+	require.NoError(t, err)
+	_, err = p.Exchange(context.Background(), callback.Get("code"), other.Verifier)
+	assert.ErrorIs(t, err, ErrExchange)
+}
+
+func TestVerifyIDTokenRejected(t *testing.T) {
+	p, server := newTestProvider(t)
+	now := time.Now()
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   server.Issuer(),
+			"sub":   "42",
+			"aud":   "fem",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "n-0S6_WzA2Mj",
+		}
+	}
+	// the valid claims pass, so each case below fails for its own reason
+	_, err := p.VerifyIDToken(context.Background(), server.IDToken(valid()), "n-0S6_WzA2Mj")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		change func(claims map[string]any)
+	}{
+		{"other issuer", func(c map[string]any) { c["iss"] = "https://evil.example" }},
+		{"other audience", func(c map[string]any) { c["aud"] = "someone-else" }},
+		{"shared audience without azp", func(c map[string]any) { c["aud"] = []string{"fem", "someone-else"} }},
+		{"expired", func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }},
+		{"no expiry", func(c map[string]any) { delete(c, "exp") }},
+		{"issued in the future", func(c map[string]any) { c["iat"] = now.Add(time.Hour).Unix() }},
+		{"other nonce", func(c map[string]any) { c["nonce"] = "replayed" }},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.change(claims)
+			_, err := p.VerifyIDToken(context.Background(), server.IDToken(claims), "n-0S6_WzA2Mj")
+			assert.ErrorIs(t, err, ErrVerification)
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		parts := strings.Split(server.IDToken(valid()), ".")
+		claims := valid()
+		claims["sub"] = "1"
+		forged := strings.Split(server.IDToken(claims), ".")
+		_, err := p.VerifyIDToken(context.Background(), parts[0]+"."+forged[1]+"."+parts[2], "n-0S6_WzA2Mj")
+		assert.ErrorIs(t, err, ErrVerification)
+	})
+
+	t.Run("alg none", func(t *testing.T) {
+		parts := strings.Split(server.IDToken(valid()), ".")
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		_, err := p.VerifyIDToken(context.Background(), header+"."+parts[1]+".", "n-0S6_WzA2Mj")
+		assert.ErrorIs(t, err, ErrVerification)
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		server.RotateKey()
+		_, err := p.VerifyIDToken(context.Background(), server.IDToken(valid()), "n-0S6_WzA2Mj")
+		assert.ErrorIs(t, err, ErrVerification)
+	})
+}
+
+func TestUsernameHint(t *testing.T) {
+	tests := []struct {
+		claims Claims
+		want   string
+	}{
+		{Claims{PreferredUsername: "Grace H.", Email: "grace@example.com"}, "graceh."},
+		{Claims{Email: "Ada.Lovelace+fem@example.com"}, "ada.lovelace"},
+		{Claims{Email: "ünïcode@example.com"}, "ncode"},
+		{Claims{}, "user"},
+		{Claims{PreferredUsername: strings.Repeat("a", 60)}, strings.Repeat("a", 40)},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.claims.UsernameHint())
+	}
+}
+
+func TestParseProviders(t *testing.T) {
+	configs, err := ParseProviders("")
+	require.NoError(t, err)
+	assert.Empty(t, configs)
+
+	configs, err = ParseProviders(`[{"name":"google","issuer":"https://accounts.google.com","client_id":"id","client_secret":"secret","redirect_url":"http://localhost:5173/cb"}]`)
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, "google", configs[0].Name)
+
+	_, err = ParseProviders(`[{"name":"google"}]`)
+	assert.Error(t, err)
+
+	_, err = ParseProviders(`[{"name":"a","issuer":"i","client_id":"c","redirect_url":"r"},{"name":"a","issuer":"i","client_id":"c","redirect_url":"r"}]`)
+	assert.Error(t, err)
+}
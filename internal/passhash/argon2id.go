@@ -0,0 +1,92 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id hashes with Argon2id. Memory is in KiB
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id follows the OWASP recommendation of 19 MiB, two passes, one lane
+var DefaultArgon2id = Argon2id{Memory: 19 * 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// limits on parameters read from stored hashes, so a bad row cannot exhaust memory
+const (
+	argon2MaxMemory     = 1024 * 1024 // 1 GiB
+	argon2MaxIterations = 64
+)
+
+func (a Argon2id) Hash(plaintext string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(plaintext), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+	return a.encode(salt, key), nil
+}
+
+func (a Argon2id) encode(salt, key []byte) string {
+	b64 := base64.RawStdEncoding.EncodeToString
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism, b64(salt), b64(key))
+}
+
+// decodeArgon2id reads the parameters, salt and key of a PHC encoded hash
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var a Argon2id
+	bad := fmt.Errorf("%w: malformed argon2id hash", ErrUnknownFormat)
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return a, nil, nil, bad
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return a, nil, nil, fmt.Errorf("%w: argon2 version %q", ErrUnknownFormat, parts[2])
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.Memory, &a.Iterations, &a.Parallelism)
+	if err != nil || a.Memory == 0 || a.Memory > argon2MaxMemory || a.Iterations == 0 ||
+		a.Iterations > argon2MaxIterations || a.Parallelism == 0 {
+		return a, nil, nil, bad
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return a, nil, nil, bad
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return a, nil, nil, bad
+	}
+	a.SaltLength, a.KeyLength = uint32(len(salt)), uint32(len(key))
+	return a, salt, key, nil
+}
+
+func (Argon2id) Verify(encoded, plaintext string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	got := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(got, key) == 1, nil
+}
+
+func (a Argon2id) Current(encoded string) bool {
+	params, _, _, err := decodeArgon2id(encoded)
+	return err == nil && params == a
+}
@@ -0,0 +1,54 @@
+package passhash
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptMaxInput is the most bcrypt reads of a password; it ignores the rest
+const bcryptMaxInput = 72
+
+// Bcrypt hashes with bcrypt at Cost
+type Bcrypt struct {
+	Cost int
+}
+
+var DefaultBcrypt = Bcrypt{Cost: 12}
+
+// bcryptInput makes passwords longer than bcrypt takes fit: they are replaced by the
+// base64 of their SHA-256, so every byte counts instead of being cut off after 72.
+// hashes made before this existed are unaffected, longer passwords were refused then
+func bcryptInput(plaintext string) []byte {
+	if len(plaintext) <= bcryptMaxInput {
+		return []byte(plaintext)
+	}
+	sum := sha256.Sum256([]byte(plaintext))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+func (b Bcrypt) Hash(plaintext string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(bcryptInput(plaintext), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (Bcrypt) Verify(encoded, plaintext string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), bcryptInput(plaintext))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b Bcrypt) Current(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err == nil && cost == b.Cost
+}
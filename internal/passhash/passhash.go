@@ -0,0 +1,81 @@
+// Package passhash hashes passwords. hashes are self-describing strings (bcrypt's
+// "$2a$cost$..." and the PHC "$argon2id$v=19$m=...,t=...,p=...$salt$hash"), so any of
+// them can be checked whatever the configured Hasher is, and old ones replaced on login
+package passhash
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownFormat means a stored hash was made by no algorithm this package knows
+var ErrUnknownFormat = errors.New("passhash: unknown hash format")
+
+// Hasher makes new password hashes
+type Hasher interface {
+	// Hash returns the encoded hash of plaintext with a fresh salt
+	Hash(plaintext string) (string, error)
+	// Verify reports whether plaintext matches an encoded hash of this algorithm
+	Verify(encoded, plaintext string) (bool, error)
+	// Current reports whether encoded was made by this hasher with its parameters,
+	// so that hashing again would not change how strong it is
+	Current(encoded string) bool
+}
+
+// Parse picks a hasher by name: argon2id or bcrypt, with default parameters
+func Parse(name string) (Hasher, error) {
+	switch name {
+	case "", "argon2id":
+		return DefaultArgon2id, nil
+	case "bcrypt":
+		return DefaultBcrypt, nil
+	default:
+		return nil, errors.New("passhash: unknown algorithm " + name)
+	}
+}
+
+// verifierFor returns the algorithm that made encoded. verifying only needs the
+// parameters written into the hash, not the configured ones
+func verifierFor(encoded string) (Hasher, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2id{}, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return Bcrypt{}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+// Verify checks plaintext against a hash made by any supported algorithm
+func Verify(encoded, plaintext string) (bool, error) {
+	h, err := verifierFor(encoded)
+	if err != nil {
+		return false, err
+	}
+	return h.Verify(encoded, plaintext)
+}
+
+// NeedsRehash reports whether encoded should be replaced by a hash from h
+func NeedsRehash(h Hasher, encoded string) bool {
+	return !h.Current(encoded)
+}
+
+// dummies holds a hash per hasher for Simulate, made on first use
+var dummies sync.Map
+
+// Simulate takes as long as verifying plaintext against a real hash from h. logins for
+// accounts that do not exist (or have no password) run it, so response times do not
+// tell them apart
+func Simulate(h Hasher, plaintext string) {
+	dummy, ok := dummies.Load(h)
+	if !ok {
+		encoded, err := h.Hash("\x00not a password")
+		if err != nil {
+			return
+		}
+		dummy, _ = dummies.LoadOrStore(h, encoded)
+	}
+	h.Verify(dummy.(string), plaintext)
+}
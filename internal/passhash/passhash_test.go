@@ -0,0 +1,105 @@
+package passhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fast parameters; the defaults are deliberately slow
+var (
+	testBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+	testArgon2id = Argon2id{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+)
+
+func TestHashAndVerify(t *testing.T) {
+	long := strings.Repeat("correct horse battery staple ", 5)
+
+	for name, h := range map[string]Hasher{"bcrypt": testBcrypt, "argon2id": testArgon2id} {
+		t.Run(name, func(t *testing.T) {
+			for _, password := range []string{"hunter22", long} {
+				encoded, err := h.Hash(password)
+				require.NoError(t, err)
+				assert.True(t, h.Current(encoded))
+
+				ok, err := Verify(encoded, password)
+				require.NoError(t, err)
+				assert.True(t, ok)
+
+				ok, err = Verify(encoded, password+"!")
+				require.NoError(t, err)
+				assert.False(t, ok)
+			}
+
+			again, err := h.Hash("hunter22")
+			require.NoError(t, err)
+			first, err := h.Hash("hunter22")
+			require.NoError(t, err)
+			assert.NotEqual(t, first, again, "salts must differ")
+		})
+	}
+}
+
+func TestBcryptUsesEveryByte(t *testing.T) {
+	// bcrypt alone would ignore everything after byte 72
+	prefix := strings.Repeat("a", 72)
+	encoded, err := testBcrypt.Hash(prefix + "tail one")
+	require.NoError(t, err)
+
+	ok, err := Verify(encoded, prefix+"tail two")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVerifiesHashesFromBeforePasshash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("securepassword123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	ok, err := Verify(string(legacy), "securepassword123")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypted, err := testBcrypt.Hash("hunter22")
+	require.NoError(t, err)
+	argon, err := testArgon2id.Hash("hunter22")
+	require.NoError(t, err)
+
+	assert.True(t, NeedsRehash(testArgon2id, bcrypted), "other algorithm")
+	assert.True(t, NeedsRehash(Bcrypt{Cost: bcrypt.MinCost + 1}, bcrypted), "other cost")
+	stronger := testArgon2id
+	stronger.Iterations++
+	assert.True(t, NeedsRehash(stronger, argon), "other parameters")
+	assert.False(t, NeedsRehash(testArgon2id, argon))
+}
+
+func TestVerifyRejectsBadHashes(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"plaintext",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$$a2V5",
+	} {
+		_, err := Verify(encoded, "hunter22")
+		assert.ErrorIs(t, err, ErrUnknownFormat, encoded)
+	}
+}
+
+func TestParse(t *testing.T) {
+	h, err := Parse("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultArgon2id, h)
+
+	h, err = Parse("bcrypt")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultBcrypt, h)
+
+	_, err = Parse("md5")
+	assert.Error(t, err)
+}
@@ -0,0 +1,37 @@
+package passpolicy
+
+import (
+	"crypto/sha1"
+	_ "embed"
+	"encoding/binary"
+	"sort"
+)
+
+//go:generate go run ./breachgen -o breached.bin passwords.txt
+
+// breached holds the first 8 bytes of the SHA-1 of every breached password, big-endian
+// and sorted. like the k-anonymity range queries of Pwned Passwords, it only carries hash
+// prefixes, never passwords; 64 bits keep false positives far below one in a billion.
+// breachgen builds it from plaintext lists or from a Pwned Passwords SHA-1 download
+//
+//go:embed breached.bin
+var breached []byte
+
+func init() {
+	if len(breached)%8 != 0 {
+		panic("passpolicy: breached.bin is not a list of 8 byte prefixes")
+	}
+}
+
+// Breached reports whether password is on the embedded breach list. the comparison is
+// exact, a breached password with a capital letter added is a different password
+func Breached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	prefix := binary.BigEndian.Uint64(sum[:8])
+
+	n := len(breached) / 8
+	i := sort.Search(n, func(i int) bool {
+		return binary.BigEndian.Uint64(breached[i*8:]) >= prefix
+	})
+	return i < n && binary.BigEndian.Uint64(breached[i*8:]) == prefix
+}
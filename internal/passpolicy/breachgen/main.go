@@ -0,0 +1,90 @@
+// Command breachgen writes the breach list passpolicy embeds. each input line is either
+// a password, or a SHA-1 hash in hex as found in the Pwned Passwords downloads
+// ("HASH:COUNT"); with -min-count, hashes seen fewer times than that are left out
+//
+//	go run ./breachgen -o breached.bin passwords.txt
+//	go run ./breachgen -o breached.bin -min-count 100 pwned-passwords-sha1-ordered-by-count.txt
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	out := flag.String("o", "breached.bin", "file to write")
+	minCount := flag.Int("min-count", 0, "leave out Pwned Passwords hashes seen fewer times than this")
+	flag.Parse()
+
+	var prefixes []uint64
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			prefix, ok := pwnedPrefix(line, *minCount)
+			if !ok {
+				sum := sha1.Sum([]byte(line))
+				prefix = binary.BigEndian.Uint64(sum[:8])
+			}
+			if prefix != 0 {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+	}
+
+	slices.Sort(prefixes)
+	prefixes = slices.Compact(prefixes)
+
+	buf := make([]byte, 0, len(prefixes)*8)
+	for _, prefix := range prefixes {
+		buf = binary.BigEndian.AppendUint64(buf, prefix)
+	}
+	err := os.WriteFile(*out, buf, 0o644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d prefixes to %s", len(prefixes), *out)
+}
+
+// pwnedPrefix reads a "HASH" or "HASH:COUNT" line. ok is false for lines that are not
+// hashes, which are then taken as passwords. a prefix of 0 means the line is skipped
+func pwnedPrefix(line string, minCount int) (prefix uint64, ok bool) {
+	hash, count, hasCount := strings.Cut(line, ":")
+	if len(hash) != 40 {
+		return 0, false
+	}
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0, false
+	}
+	if hasCount {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, false
+		}
+		if n < minCount {
+			return 0, true
+		}
+	}
+	return binary.BigEndian.Uint64(sum[:8]), true
+}
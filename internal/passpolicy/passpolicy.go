@@ -0,0 +1,88 @@
+// Package passpolicy decides which new passwords are acceptable: long enough, not the
+// username or email, not on a list of breached passwords, and not easy to guess
+// according to an estimate in the style of zxcvbn
+package passpolicy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Policy is what a new password has to satisfy
+type Policy struct {
+	// MinLength counts characters, not bytes
+	MinLength int
+	// MinScore is the lowest Estimate score accepted, from 0 (anything) to 4
+	MinScore int
+	// CheckBreached rejects passwords on the embedded breach list
+	CheckBreached bool
+}
+
+// DefaultPolicy follows NIST 800-63B: eight characters, no known breached passwords,
+// and nothing guessable within about 10^8 tries, which login lockouts keep out of reach
+var DefaultPolicy = Policy{MinLength: 8, MinScore: 2, CheckBreached: true}
+
+// Check returns why password is not acceptable, or "" when it is. userInputs are what an
+// attacker would try first for this account, like its username and email address
+func (p Policy) Check(password string, userInputs ...string) string {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("must be at least %d characters", p.MinLength)
+	}
+
+	lower := strings.ToLower(password)
+	for _, input := range personalTokens(userInputs) {
+		if lower == input {
+			return "must not be your username or email address"
+		}
+	}
+
+	if p.CheckBreached && Breached(password) {
+		return "appears in a list of breached passwords, choose another one"
+	}
+
+	if p.MinScore > 0 {
+		strength := Estimate(password, userInputs...)
+		if strength.Score < p.MinScore {
+			return "is too easy to guess: " + hints[strength.Pattern]
+		}
+	}
+	return ""
+}
+
+var hints = map[string]string{
+	"":              "make it longer, or add a few uncommon words",
+	PatternPersonal: "it is based on your username or email address",
+	PatternPassword: "it is built from very common passwords",
+	PatternWord:     "add more words, uncommon ones are better",
+	PatternSequence: "avoid sequences like abc or 6543",
+	PatternRepeat:   "avoid repeated characters and words",
+	PatternKeyboard: "avoid keyboard patterns like qwerty or asdf",
+	PatternDate:     "avoid dates and years",
+}
+
+// personalTokens lowercases userInputs and adds their parts: the local part and name
+// pieces of an email address, the pieces of a username split at punctuation
+func personalTokens(userInputs []string) []string {
+	var tokens []string
+	add := func(s string) {
+		if utf8.RuneCountInString(s) >= 3 && !slices.Contains(tokens, s) {
+			tokens = append(tokens, s)
+		}
+	}
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		add(input)
+		local, _, isEmail := strings.Cut(input, "@")
+		if isEmail {
+			add(local)
+		}
+		for _, part := range strings.FieldsFunc(local, func(r rune) bool {
+			return !('a' <= r && r <= 'z') && !('0' <= r && r <= '9') && r < utf8.RuneSelf
+		}) {
+			add(part)
+		}
+	}
+	return tokens
+}
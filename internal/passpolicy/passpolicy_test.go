@@ -0,0 +1,82 @@
+package passpolicy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	userInputs := []string{"jane_doe", "jane.doe@example.com"}
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"too short", "kX9#mq2", "must be at least 8 characters"},
+		{"length counts characters", "ŧřøüβłé", "must be at least 8 characters"},
+		{"username", "Jane_Doe", "must not be your username or email address"},
+		{"email", "jane.doe@example.com", "must not be your username or email address"},
+		{"email local part", "jane.doe", "must not be your username or email address"},
+		{"breached", "password1", "appears in a list of breached passwords, choose another one"},
+		{"common with substitutions", "P@ssw0rd", "is too easy to guess: it is built from very common passwords"},
+		{"based on username", "jane_doe2024", "is too easy to guess: it is based on your username or email address"},
+		{"keyboard walk", "zxcvfdsa", "is too easy to guess: avoid keyboard patterns like qwerty or asdf"},
+		{"date", "12/05/1990", "is too easy to guess: avoid dates and years"},
+		{"repeated", "abcdabcdabcd", "is too easy to guess: avoid repeated characters and words"},
+		{"passphrase", "plum-kettle-orbit-42", ""},
+		{"random", "kX9#mq2Lp!", ""},
+		{"long", strings.Repeat("kX9#mq2Lp!", 20), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, DefaultPolicy.Check(tt.password, userInputs...))
+		})
+	}
+}
+
+func TestCheckIsConfigurable(t *testing.T) {
+	lenient := Policy{MinLength: 4}
+	assert.Empty(t, lenient.Check("password"), "neither breach list nor estimate")
+	assert.Equal(t, "must be at least 4 characters", lenient.Check("abc"))
+
+	strict := Policy{MinLength: 12, MinScore: 4, CheckBreached: true}
+	assert.Equal(t, "must be at least 12 characters", strict.Check("kX9#mq2Lp!"))
+	assert.NotEmpty(t, strict.Check("summer2024!!"))
+}
+
+func TestEstimate(t *testing.T) {
+	// each password should be harder to guess than the one before
+	ordered := []string{
+		"password",
+		"qwerty123",
+		"Summer2024",
+		"monkeydragon77",
+		"correct horse battery staple",
+		"plum-kettle-orbit-42",
+	}
+	var last float64
+	for _, p := range ordered {
+		s := Estimate(p)
+		assert.Greater(t, s.Guesses, last, p)
+		last = s.Guesses
+	}
+
+	assert.Equal(t, 0, Estimate("").Score)
+	assert.Equal(t, PatternSequence, Estimate("abcdefgh").Pattern)
+	assert.Equal(t, PatternRepeat, Estimate("aaaaaaaa").Pattern)
+	assert.Equal(t, PatternWord, Estimate("rocketgalaxy").Pattern)
+	assert.Equal(t, PatternPersonal, Estimate("marigold", "marigold").Pattern)
+	assert.Less(t, Estimate("drowssap").Score, 2, "reversed")
+	assert.Less(t, Estimate("PASSWORD").Score, 2, "all caps")
+}
+
+func TestBreached(t *testing.T) {
+	assert.True(t, Breached("123456"))
+	assert.True(t, Breached("iloveyou"))
+	assert.False(t, Breached("Iloveyou"), "the comparison is exact")
+	assert.False(t, Breached("plum-kettle-orbit-42"))
+	assert.False(t, Breached(""))
+}
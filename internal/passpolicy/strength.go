@@ -0,0 +1,679 @@
+package passpolicy
+
+import (
+	_ "embed"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the patterns Estimate recognises, reported as Strength.Pattern
+const (
+	PatternPersonal = "personal"
+	PatternPassword = "password"
+	PatternWord     = "word"
+	PatternSequence = "sequence"
+	PatternRepeat   = "repeat"
+	PatternKeyboard = "keyboard"
+	PatternDate     = "date"
+)
+
+// Strength is how hard a password is to guess for an attacker who tries common
+// passwords, words and patterns first
+type Strength struct {
+	// Guesses is the estimated number of tries before the password comes up
+	Guesses float64
+	// Score buckets Guesses like zxcvbn: 0 below 10^3, 1 below 10^6, 2 below 10^8,
+	// 3 below 10^10, 4 above
+	Score int
+	// Pattern is the most telling pattern the estimate found, "" when the password
+	// is only guessable by brute force
+	Pattern string
+}
+
+const (
+	// bruteforceCardinality is what each character not part of a pattern multiplies
+	// the guesses by
+	bruteforceCardinality = 10
+	// sequencePenalty stands for the choices an attacker has in combining patterns,
+	// so splitting a password into many tiny patterns does not make it look weak
+	sequencePenalty = 10000
+	// maxEstimateLength caps the work per password; characters past it add brute force
+	maxEstimateLength = 64
+	minYearSpace      = 20
+)
+
+//go:embed passwords.txt
+var passwordList string
+
+//go:embed words.txt
+var wordList string
+
+var (
+	passwordRanks = rankList(passwordList)
+	wordRanks     = rankList(wordList)
+)
+
+// rankList maps each line of a list, most common first, to its 1-based rank
+func rankList(list string) map[string]int {
+	ranks := make(map[string]int)
+	for i, line := range strings.Split(strings.TrimSpace(list), "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if _, ok := ranks[line]; !ok && line != "" {
+			ranks[line] = i + 1
+		}
+	}
+	return ranks
+}
+
+// match is a pattern covering the runes [i, j) of a password
+type match struct {
+	i, j    int
+	guesses float64
+	pattern string
+}
+
+// Estimate guesses how strong password is. userInputs are treated as the most likely
+// words of all, see Policy.Check
+func Estimate(password string, userInputs ...string) Strength {
+	runes := []rune(password)
+	extra := 1.0
+	if len(runes) > maxEstimateLength {
+		extra = math.Pow(bruteforceCardinality, float64(len(runes)-maxEstimateLength))
+		runes = runes[:maxEstimateLength]
+	}
+
+	personal := make(map[string]int)
+	for i, token := range personalTokens(userInputs) {
+		personal[token] = i + 1
+	}
+	e := estimator{personal: personal, year: time.Now().Year()}
+
+	guesses, pattern := e.mostGuessable(runes)
+	guesses *= extra
+	return Strength{Guesses: guesses, Score: score(guesses), Pattern: pattern}
+}
+
+func score(guesses float64) int {
+	const delta = 5
+	switch {
+	case guesses < 1e3+delta:
+		return 0
+	case guesses < 1e6+delta:
+		return 1
+	case guesses < 1e8+delta:
+		return 2
+	case guesses < 1e10+delta:
+		return 3
+	default:
+		return 4
+	}
+}
+
+type estimator struct {
+	personal map[string]int
+	year     int
+}
+
+// mostGuessable finds the cheapest way to cover runes with patterns and brute force,
+// zxcvbn's search: l patterns whose guesses multiply to g cost l!*g + penalty^(l-1),
+// since the attacker does not know the order or the number of patterns either
+func (e estimator) mostGuessable(runes []rune) (float64, string) {
+	n := len(runes)
+	if n == 0 {
+		return 1, ""
+	}
+
+	matches := e.matches(runes)
+	byEnd := make([][]int, n+1)
+	for mi, m := range matches {
+		// a pattern inside a longer password is never free to guess
+		if m.j-m.i < n {
+			minGuesses := 50.0
+			if m.j-m.i == 1 {
+				minGuesses = bruteforceCardinality
+			}
+			matches[mi].guesses = math.Max(m.guesses, minGuesses)
+		}
+		byEnd[m.j] = append(byEnd[m.j], mi)
+	}
+
+	// best[k][l] is the smallest product of guesses covering runes[:k] with l patterns.
+	// brute force characters multiply without counting as patterns
+	best := make([][]float64, n+1)
+	from := make([][]int, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		from[k] = make([]int, n+1)
+		for l := range best[k] {
+			best[k][l] = math.Inf(1)
+		}
+	}
+	best[0][0] = 1
+
+	for k := 1; k <= n; k++ {
+		for l := 0; l < k+1; l++ {
+			if g := best[k-1][l] * bruteforceCardinality; g < best[k][l] {
+				best[k][l], from[k][l] = g, -1
+			}
+		}
+		for _, mi := range byEnd[k] {
+			m := matches[mi]
+			for l := 0; l <= m.i; l++ {
+				if g := best[m.i][l] * m.guesses; g < best[k][l+1] {
+					best[k][l+1], from[k][l+1] = g, mi
+				}
+			}
+		}
+	}
+
+	guesses, bestL := math.Inf(1), 0
+	for l := 0; l <= n; l++ {
+		if math.IsInf(best[n][l], 1) {
+			continue
+		}
+		g := best[n][l]
+		if l > 0 {
+			g = g*factorial(l) + math.Pow(sequencePenalty, float64(l-1))
+		}
+		if g < guesses {
+			guesses, bestL = g, l
+		}
+	}
+
+	// walk back to report the pattern that says the most about the weakness
+	pattern := ""
+	for k, l := n, bestL; k > 0; {
+		mi := from[k][l]
+		if mi < 0 {
+			k--
+			continue
+		}
+		if patternPriority[matches[mi].pattern] > patternPriority[pattern] {
+			pattern = matches[mi].pattern
+		}
+		k, l = matches[mi].i, l-1
+	}
+	return guesses, pattern
+}
+
+var patternPriority = map[string]int{
+	PatternWord:     1,
+	PatternDate:     2,
+	PatternRepeat:   3,
+	PatternSequence: 4,
+	PatternKeyboard: 5,
+	PatternPassword: 6,
+	PatternPersonal: 7,
+}
+
+func (e estimator) matches(runes []rune) []match {
+	var matches []match
+	matches = append(matches, e.dictionaryMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, e.dateMatches(runes)...)
+	matches = append(matches, e.repeatMatches(runes)...)
+	return matches
+}
+
+// maxWordLength bounds dictionary lookups; longer entries are rare and would be
+// found as the words they are made of
+const maxWordLength = 24
+
+var leet = map[rune][]rune{
+	'@': {'a'}, '4': {'a'}, '8': {'b'}, '(': {'c'}, '3': {'e'}, '6': {'g'}, '9': {'g'},
+	'1': {'i', 'l'}, '!': {'i'}, '|': {'i', 'l'}, '0': {'o'}, '$': {'s'}, '5': {'s'},
+	'7': {'t'}, '+': {'t'}, '2': {'z'},
+}
+
+func (e estimator) dictionaryMatches(runes []rune) []match {
+	lower := []rune(strings.ToLower(string(runes)))
+	if len(lower) != len(runes) {
+		// a few runes change length when lowercased; compare as they are
+		lower = runes
+	}
+
+	var matches []match
+	for i := range lower {
+		for j := i + 3; j <= len(lower) && j-i <= maxWordLength; j++ {
+			token := lower[i:j]
+			base, pattern := e.rank(string(token))
+			if base == 0 {
+				// spelled backwards costs the attacker one more try per word
+				if base, pattern = e.rank(reverse(token)); base > 0 {
+					base *= 2
+				}
+			}
+			if base == 0 {
+				base, pattern = e.leetRank(token)
+			}
+			if base == 0 {
+				continue
+			}
+			matches = append(matches, match{i: i, j: j, guesses: base * uppercaseVariations(runes[i:j]), pattern: pattern})
+		}
+	}
+	return matches
+}
+
+// rank looks token up in the dictionaries, most specific first. 0 means not found
+func (e estimator) rank(token string) (float64, string) {
+	if r, ok := e.personal[token]; ok {
+		return float64(r), PatternPersonal
+	}
+	if r, ok := passwordRanks[token]; ok {
+		return float64(r), PatternPassword
+	}
+	if r, ok := wordRanks[token]; ok {
+		return float64(r), PatternWord
+	}
+	return 0, ""
+}
+
+// leetRank undoes substitutions like 4 for a and $ for s. each substituted character
+// doubles the guesses, an attacker tries with and without it
+func (e estimator) leetRank(token []rune) (float64, string) {
+	subs := 0
+	for _, r := range token {
+		if _, ok := leet[r]; ok {
+			subs++
+		}
+	}
+	if subs == 0 || subs == len(token) {
+		return 0, ""
+	}
+
+	// characters with two readings, like 1 for i or l, are tried both ways
+	candidates := [][]rune{make([]rune, 0, len(token))}
+	for _, r := range token {
+		readings, ok := leet[r]
+		if !ok {
+			readings = []rune{r}
+		}
+		next := make([][]rune, 0, len(candidates)*len(readings))
+		for _, c := range candidates {
+			for _, reading := range readings {
+				next = append(next, append(c[:len(c):len(c)], reading))
+			}
+		}
+		candidates = next
+		if len(candidates) > 16 {
+			return 0, ""
+		}
+	}
+
+	for _, c := range candidates {
+		if base, pattern := e.rank(string(c)); base > 0 {
+			return base * math.Pow(2, float64(subs)), pattern
+		}
+	}
+	return 0, ""
+}
+
+// uppercaseVariations is how many ways of capitalising a word an attacker has to try
+// before reaching this one. all lowercase, all caps and a capital first or last letter
+// are the usual ones and cost little
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	if lower == 0 || unicode.IsUpper(word[0]) && upper == 1 || unicode.IsUpper(word[len(word)-1]) && upper == 1 {
+		return 2
+	}
+	variations := 0.0
+	for i := 1; i <= min(upper, lower); i++ {
+		variations += binomial(upper+lower, i)
+	}
+	return variations
+}
+
+// sequenceMatches finds runs like abc, 2468 or zyx: constant steps of 1 or 2 within
+// letters or digits
+func sequenceMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(runes); {
+		delta := runes[i+1] - runes[i]
+		j := i + 1
+		for j+1 < len(runes) && runes[j+1]-runes[j] == delta && sameClass(runes[i], runes[j+1]) {
+			j++
+		}
+		length := j - i + 1
+		if length >= 3 && (delta == 1 || delta == -1 || delta == 2 || delta == -2) && sameClass(runes[i], runes[j]) {
+			matches = append(matches, match{i: i, j: j + 1, guesses: sequenceGuesses(runes[i], delta, length), pattern: PatternSequence})
+			i = j
+			continue
+		}
+		i++
+	}
+	return matches
+}
+
+func sameClass(a, b rune) bool {
+	switch {
+	case 'a' <= a && a <= 'z':
+		return 'a' <= b && b <= 'z'
+	case 'A' <= a && a <= 'Z':
+		return 'A' <= b && b <= 'Z'
+	case '0' <= a && a <= '9':
+		return '0' <= b && b <= '9'
+	}
+	return false
+}
+
+func sequenceGuesses(first, delta rune, length int) float64 {
+	var base float64
+	switch {
+	case strings.ContainsRune("aAzZ019", first):
+		base = 4
+	case '0' <= first && first <= '9':
+		base = 10
+	default:
+		base = 26
+	}
+	if delta < 0 {
+		base *= 2
+	}
+	return base * float64(length)
+}
+
+// keyboardRows is a US qwerty layout, unshifted and shifted. rows are offset by half a
+// key, so a key touches the one above it and the one above and to the right
+var keyboardRows = [2][4]string{
+	{"1234567890-=", "qwertyuiop[]", "asdfghjkl;'", "zxcvbnm,./"},
+	{"!@#$%^&*()_+", "QWERTYUIOP{}", "ASDFGHJKL:\"", "ZXCVBNM<>?"},
+}
+
+type keyPosition struct {
+	row, col int
+	shifted  bool
+}
+
+var keyPositions = func() map[rune]keyPosition {
+	positions := make(map[rune]keyPosition)
+	for shift, rows := range keyboardRows {
+		for row, keys := range rows {
+			for col, key := range keys {
+				positions[key] = keyPosition{row: row, col: col, shifted: shift == 1}
+			}
+		}
+	}
+	return positions
+}()
+
+// keyDirection returns which of the six neighbours b is to a, or -1 when the keys do
+// not touch
+func keyDirection(a, b rune) int {
+	pa, okA := keyPositions[a]
+	pb, okB := keyPositions[b]
+	if !okA || !okB {
+		return -1
+	}
+	dr, dc := pb.row-pa.row, pb.col-pa.col
+	switch {
+	case dr == 0 && dc == -1:
+		return 0
+	case dr == 0 && dc == 1:
+		return 1
+	case dr == -1 && dc == 0:
+		return 2
+	case dr == -1 && dc == 1:
+		return 3
+	case dr == 1 && dc == -1:
+		return 4
+	case dr == 1 && dc == 0:
+		return 5
+	}
+	return -1
+}
+
+const (
+	// keyboardStarts and keyboardDegree are the number of keys and the average number
+	// of neighbours a key has, for zxcvbn's count of keyboard walks
+	keyboardStarts = 47
+	keyboardDegree = 4.6
+)
+
+// keyboardMatches finds walks over neighbouring keys like qwerty, asdfgh or 1qaz
+func keyboardMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i+2 < len(runes); {
+		j, turns, direction := i, 0, -1
+		for j+1 < len(runes) {
+			d := keyDirection(runes[j], runes[j+1])
+			if d < 0 {
+				break
+			}
+			if d != direction {
+				turns++
+				direction = d
+			}
+			j++
+		}
+		length := j - i + 1
+		if length < 4 {
+			i++
+			continue
+		}
+
+		shifted := 0
+		for _, r := range runes[i : j+1] {
+			if keyPositions[r].shifted {
+				shifted++
+			}
+		}
+		guesses := keyboardGuesses(length, turns)
+		if shifted > 0 && shifted < length {
+			guesses *= binomial(length, shifted)
+		} else if shifted == length {
+			guesses *= 2
+		}
+		matches = append(matches, match{i: i, j: j + 1, guesses: guesses, pattern: PatternKeyboard})
+		i = j
+	}
+	return matches
+}
+
+func keyboardGuesses(length, turns int) float64 {
+	guesses := 0.0
+	for i := 2; i <= length; i++ {
+		for t := 1; t <= min(turns, i-1); t++ {
+			guesses += binomial(i-1, t-1) * keyboardStarts * math.Pow(keyboardDegree, float64(t))
+		}
+	}
+	return guesses
+}
+
+// dateMatches finds years like 1987 and dates like 12/05/1990, 120590 or 19900512
+func (e estimator) dateMatches(runes []rune) []match {
+	var matches []match
+	for i := range runes {
+		for j := i + 4; j <= len(runes) && j-i <= 10; j++ {
+			token := runes[i:j]
+			if year, ok := parseYear(token); ok {
+				matches = append(matches, match{i: i, j: j, guesses: e.yearSpace(year), pattern: PatternDate})
+				continue
+			}
+			if year, separated, ok := parseDate(token); ok {
+				guesses := 365 * e.yearSpace(year)
+				if separated {
+					guesses *= 4
+				}
+				matches = append(matches, match{i: i, j: j, guesses: guesses, pattern: PatternDate})
+			}
+		}
+	}
+	return matches
+}
+
+func (e estimator) yearSpace(year int) float64 {
+	return float64(max(abs(year-e.year), minYearSpace))
+}
+
+func parseYear(token []rune) (int, bool) {
+	if len(token) != 4 {
+		return 0, false
+	}
+	year, ok := digits(token)
+	return year, ok && 1900 <= year && year <= 2099
+}
+
+// parseDate reads day, month and year in any of the usual orders, with or without a
+// separator between them
+func parseDate(token []rune) (year int, separated bool, ok bool) {
+	var parts [][]rune
+	for _, sep := range "/-._ " {
+		if fields := strings.Split(string(token), string(sep)); len(fields) == 3 {
+			for _, f := range fields {
+				parts = append(parts, []rune(f))
+			}
+			separated = true
+			break
+		}
+	}
+
+	if separated {
+		year, ok = dayMonthYear(parts)
+		return year, true, ok
+	}
+	splits := map[int][][3]int{
+		5: {{1, 1, 3}, {1, 2, 2}, {2, 1, 2}},
+		6: {{2, 2, 2}, {1, 1, 4}, {4, 1, 1}},
+		7: {{1, 2, 4}, {2, 1, 4}, {4, 1, 2}, {4, 2, 1}},
+		8: {{2, 2, 4}, {4, 2, 2}},
+	}
+	for _, split := range splits[len(token)] {
+		parts = [][]rune{token[:split[0]], token[split[0] : split[0]+split[1]], token[split[0]+split[1]:]}
+		if year, ok = dayMonthYear(parts); ok {
+			return year, false, true
+		}
+	}
+	return 0, false, false
+}
+
+// dayMonthYear accepts day-month-year, month-day-year and year-month-day
+func dayMonthYear(parts [][]rune) (int, bool) {
+	if len(parts) != 3 {
+		return 0, false
+	}
+	var n [3]int
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 4 || len(part) == 3 {
+			return 0, false
+		}
+		v, ok := digits(part)
+		if !ok {
+			return 0, false
+		}
+		n[i] = v
+	}
+
+	candidates := [][3]int{
+		{n[0], n[1], n[2]}, // day, month, year
+		{n[1], n[0], n[2]}, // month, day, year
+		{n[2], n[1], n[0]}, // year, month, day
+	}
+	yearLen := []int{len(parts[2]), len(parts[2]), len(parts[0])}
+	for i, c := range candidates {
+		day, month, year := c[0], c[1], c[2]
+		if 1 <= day && day <= 31 && 1 <= month && month <= 12 {
+			switch {
+			case yearLen[i] == 4 && 1900 <= year && year <= 2099:
+				return year, true
+			case yearLen[i] == 2 && year > 50:
+				return 1900 + year, true
+			case yearLen[i] == 2:
+				return 2000 + year, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func digits(token []rune) (int, bool) {
+	n := 0
+	for _, r := range token {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n, true
+}
+
+// repeatMatches finds a character or chunk written several times in a row, like aaaa
+// or abcabc. it costs the guesses of the chunk times the number of repeats
+func (e estimator) repeatMatches(runes []rune) []match {
+	var matches []match
+	for i := 0; i < len(runes); {
+		bestPeriod, bestCount := 0, 0
+		for period := 1; i+2*period <= len(runes); period++ {
+			count := 1
+			for i+(count+1)*period <= len(runes) && slices.Equal(runes[i:i+period], runes[i+count*period:i+(count+1)*period]) {
+				count++
+			}
+			if count >= 2 && period*count > bestPeriod*bestCount && (period > 1 || count >= 3) {
+				bestPeriod, bestCount = period, count
+			}
+		}
+		if bestPeriod == 0 {
+			i++
+			continue
+		}
+
+		chunkGuesses, _ := e.mostGuessable(runes[i : i+bestPeriod])
+		matches = append(matches, match{
+			i:       i,
+			j:       i + bestPeriod*bestCount,
+			guesses: chunkGuesses * float64(bestCount),
+			pattern: PatternRepeat,
+		})
+		i += bestPeriod * bestCount
+	}
+	return matches
+}
+
+func reverse(token []rune) string {
+	reversed := make([]rune, len(token))
+	for i, r := range token {
+		reversed[len(token)-1-i] = r
+	}
+	return string(reversed)
+}
+
+func factorial(n int) float64 {
+	f := 1.0
+	for i := 2; i <= n; i++ {
+		f *= float64(i)
+	}
+	return f
+}
+
+func binomial(n, k int) float64 {
+	if k < 0 || k > n {
+		return 0
+	}
+	result := 1.0
+	for i := 1; i <= k; i++ {
+		result = result * float64(n-k+i) / float64(i)
+	}
+	return result
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
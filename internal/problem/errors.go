@@ -0,0 +1,117 @@
+package problem
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fem/internal/store"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// constraintPointers maps postgres constraint names to the request field they guard
+var constraintPointers = map[string]FieldError{
+	"users_username_key":        {Pointer: "/username", Detail: "username is already taken"},
+	"users_email_key":           {Pointer: "/email", Detail: "email is already registered"},
+	"valid_workout_entry":       {Pointer: "/entries", Detail: "each entry needs either reps or duration_seconds, not both"},
+	"webauthn_credentials_pkey": {Pointer: "/credential/id", Detail: "passkey is already registered"},
+	"external_identities_pkey":  {Pointer: "/code", Detail: "identity is already linked to an account"},
+}
+
+// FromError converts any error returned by a store (or a *Problem) into a Problem
+func FromError(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return NotFound("resource not found")
+	case errors.Is(err, store.ErrUsernameReserved):
+		p := New(http.StatusConflict, CodeConflict, "resource already exists")
+		p.Errors = []FieldError{{Pointer: "/username", Detail: "username was recently used by another account"}}
+		return p
+	case errors.Is(err, store.ErrVersionMismatch):
+		return New(http.StatusConflict, CodeConflict, "resource was changed by another request, fetch it again and retry")
+	case store.IsTimeout(err):
+		return New(http.StatusGatewayTimeout, CodeTimeout, "the request took too long to complete")
+	case store.IsUnavailable(err):
+		return New(http.StatusServiceUnavailable, CodeUnavailable, "the service is temporarily unavailable")
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return fromPgError(pgErr)
+	}
+
+	return Internal()
+}
+
+func fromPgError(pgErr *pgconn.PgError) *Problem {
+	field, known := constraintPointers[pgErr.ConstraintName]
+
+	switch pgErr.Code {
+	case "23505": // unique_violation
+		p := New(http.StatusConflict, CodeConflict, "resource already exists")
+		if known {
+			p.Errors = []FieldError{field}
+		}
+		return p
+	case "23514", "23502", "23503", "22001", "22003": // check, not null, foreign key, too long, out of range
+		p := New(http.StatusUnprocessableEntity, CodeConstraintViolated, "request violates a data constraint")
+		switch {
+		case known:
+			p.Errors = []FieldError{field}
+		case pgErr.ColumnName != "":
+			p.Errors = []FieldError{{Pointer: "/" + pgErr.ColumnName, Detail: "invalid value"}}
+		}
+		return p
+	}
+
+	return Internal()
+}
+
+// FromDecodeError converts a json decoding failure into a 400,
+// pointing at the offending field when the decoder knows it
+func FromDecodeError(err error) *Problem {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return New(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "request body is too large")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		p := BadRequest("request body contains an unknown field")
+		p.Errors = []FieldError{{Pointer: "/" + field, Detail: "unknown field"}}
+		return p
+	case errors.Is(err, io.EOF):
+		return BadRequest("request body must not be empty")
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return BadRequest("request body is not valid JSON")
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		p := BadRequest("request body contains a value of the wrong type")
+		p.Errors = []FieldError{{
+			Pointer: "/" + strings.ReplaceAll(typeErr.Field, ".", "/"),
+			Detail:  "must be of type " + typeErr.Type.String(),
+		}}
+		return p
+	}
+
+	return BadRequest("invalid request payload")
+}
+
+// WriteError renders err as a problem. a cancelled request gets no response at all
+// since the client has already gone away
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	Write(w, r, FromError(err))
+}
@@ -0,0 +1,117 @@
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Code is the stable, machine-readable identifier of a problem.
+// clients switch on it, so existing values must never change
+type Code string
+
+const (
+	CodeInvalidRequest     Code = "invalid_request"
+	CodeValidationFailed   Code = "validation_failed"
+	CodePayloadTooLarge    Code = "payload_too_large"
+	CodeUnsupportedMedia   Code = "unsupported_media_type"
+	CodeUnauthorized       Code = "unauthorized"
+	CodeInvalidCredentials Code = "invalid_credentials"
+	CodeInvalidToken       Code = "invalid_token"
+	CodeTokenReused        Code = "token_reused"
+	CodeForbidden          Code = "forbidden"
+	CodeInsufficientScope  Code = "insufficient_scope"
+	CodeCSRFFailed         Code = "csrf_failed"
+	CodeEmailUnverified    Code = "email_unverified"
+	CodeTooManyAttempts    Code = "too_many_attempts"
+	CodeRateLimited        Code = "rate_limited"
+	CodeNotFound           Code = "not_found"
+	CodeMethodNotAllowed   Code = "method_not_allowed"
+	CodeConflict           Code = "conflict"
+	CodePreconditionFailed Code = "precondition_failed"
+	CodePreconditionNeeded Code = "precondition_required"
+	CodeConstraintViolated Code = "constraint_violated"
+	CodeInternal           Code = "internal_error"
+	CodeUnavailable        Code = "service_unavailable"
+	CodeTimeout            Code = "timeout"
+)
+
+// FieldError points at the offending part of the request body (RFC 6901 JSON pointer)
+type FieldError struct {
+	Pointer string `json:"pointer"`
+	Detail  string `json:"detail"`
+}
+
+// Problem is an RFC 7807 problem details object with two extension members:
+// `code` and, for validation failures, `errors`
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     Code         `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%d %s", p.Status, p.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", p.Status, p.Code, p.Detail)
+}
+
+func New(status int, code Code, detail string) *Problem {
+	return &Problem{
+		Type:   "/problems/" + string(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func BadRequest(detail string) *Problem {
+	return New(http.StatusBadRequest, CodeInvalidRequest, detail)
+}
+
+func Unauthorized(code Code, detail string) *Problem {
+	return New(http.StatusUnauthorized, code, detail)
+}
+
+func Forbidden(detail string) *Problem {
+	return New(http.StatusForbidden, CodeForbidden, detail)
+}
+
+func NotFound(detail string) *Problem {
+	return New(http.StatusNotFound, CodeNotFound, detail)
+}
+
+func Internal() *Problem {
+	return New(http.StatusInternalServerError, CodeInternal, "")
+}
+
+func Validation(errs ...FieldError) *Problem {
+	p := New(http.StatusUnprocessableEntity, CodeValidationFailed, "request body failed validation")
+	p.Errors = errs
+	return p
+}
+
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" && r != nil {
+		p.Instance = r.URL.Path
+	}
+
+	js, err := json.MarshalIndent(p, "", " ")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	js = append(js, '\n')
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	w.Write(js)
+}
@@ -0,0 +1,110 @@
+package problem
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fem/internal/store"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   Code
+		wantErrors []FieldError
+	}{
+		{
+			name:       "no rows",
+			err:        fmt.Errorf("get workout: %w", sql.ErrNoRows),
+			wantStatus: http.StatusNotFound,
+			wantCode:   CodeNotFound,
+		},
+		{
+			name:       "deadline exceeded",
+			err:        context.DeadlineExceeded,
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   CodeTimeout,
+		},
+		{
+			name:       "unique violation",
+			err:        &pgconn.PgError{Code: "23505", ConstraintName: "users_email_key"},
+			wantStatus: http.StatusConflict,
+			wantCode:   CodeConflict,
+			wantErrors: []FieldError{{Pointer: "/email", Detail: "email is already registered"}},
+		},
+		{
+			name:       "reserved username",
+			err:        store.ErrUsernameReserved,
+			wantStatus: http.StatusConflict,
+			wantCode:   CodeConflict,
+			wantErrors: []FieldError{{Pointer: "/username", Detail: "username was recently used by another account"}},
+		},
+		{
+			name:       "stale version",
+			err:        store.ErrVersionMismatch,
+			wantStatus: http.StatusConflict,
+			wantCode:   CodeConflict,
+		},
+		{
+			name:       "check violation",
+			err:        &pgconn.PgError{Code: "23514", ConstraintName: "valid_workout_entry"},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   CodeConstraintViolated,
+			wantErrors: []FieldError{constraintPointers["valid_workout_entry"]},
+		},
+		{
+			name:       "unknown",
+			err:        fmt.Errorf("boom"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   CodeInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := FromError(tt.err)
+			assert.Equal(t, tt.wantStatus, p.Status)
+			assert.Equal(t, tt.wantCode, p.Code)
+			assert.Equal(t, tt.wantErrors, p.Errors)
+		})
+	}
+}
+
+func TestFromDecodeError(t *testing.T) {
+	var body struct {
+		DurationMinutes int `json:"duration_minutes"`
+	}
+	err := json.NewDecoder(strings.NewReader(`{"duration_minutes": "an hour"}`)).Decode(&body)
+	require.Error(t, err)
+
+	p := FromDecodeError(err)
+	assert.Equal(t, http.StatusBadRequest, p.Status)
+	require.Len(t, p.Errors, 1)
+	assert.Equal(t, "/duration_minutes", p.Errors[0].Pointer)
+}
+
+func TestWrite(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/workouts/3", nil)
+
+	Write(w, r, NotFound("workout not found"))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+
+	var got Problem
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, "/workouts/3", got.Instance)
+	assert.Equal(t, CodeNotFound, got.Code)
+}
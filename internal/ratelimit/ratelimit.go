@@ -0,0 +1,126 @@
+// Package ratelimit throttles requests with token buckets. a bucket is kept as the time
+// it will be full again (the generic cell rate algorithm), so a backend stores a single
+// timestamp per key and can take a token in one atomic step
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Policy allows Limit requests per Period. a key that has been quiet can send Limit
+// requests at once; after that it gets one more every Period/Limit
+type Policy struct {
+	// Name keeps the buckets of different policies apart and is shown to clients
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+var (
+	// Default is what any one client may spend across the API
+	Default = Policy{Name: "default", Limit: 300, Period: time.Minute}
+	// PerIP is the ceiling for a whole address, whoever is behind it; loose because
+	// offices and mobile carriers put many users behind one
+	PerIP = Policy{Name: "ip", Limit: 1200, Period: time.Minute}
+	// Auth covers logins, registration and resets, ahead of the per account lockout
+	Auth = Policy{Name: "auth", Limit: 30, Period: 10 * time.Minute}
+	// Mail covers routes that send email, so they cannot be used to flood an inbox
+	Mail = Policy{Name: "mail", Limit: 5, Period: time.Hour}
+	// Export covers data exports, which are expensive to build
+	Export = Policy{Name: "export", Limit: 3, Period: time.Hour}
+)
+
+// interval is how long one token takes to come back
+func (p Policy) interval() time.Duration {
+	return p.Period / time.Duration(p.Limit)
+}
+
+// Store keeps the time each key's bucket is full again; keys it does not know are full.
+// Take has to be atomic: it moves full to max(full, now)+cost unless that would be past
+// now+capacity, and returns full as it is afterwards and whether it moved
+type Store interface {
+	Take(ctx context.Context, key string, now time.Time, cost, capacity time.Duration) (full time.Time, ok bool, err error)
+}
+
+// Result is the state of a bucket after a request, for the RateLimit headers
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long a refused request has to wait for the next token
+	RetryAfter time.Duration
+}
+
+type Limiter struct {
+	store Store
+	now   func() time.Time
+}
+
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{store: store, now: time.Now}
+}
+
+// Allow takes a token from the bucket of key under policy p
+func (l *Limiter) Allow(ctx context.Context, p Policy, key string) (Result, error) {
+	now := l.now()
+	interval := p.interval()
+
+	full, ok, err := l.store.Take(ctx, p.Name+":"+key, now, interval, p.Period)
+	if err != nil {
+		return Result{}, err
+	}
+
+	res := Result{Allowed: ok, Limit: p.Limit, Reset: max(full.Sub(now), 0)}
+	if ok {
+		res.Remaining = int((p.Period - full.Sub(now)) / interval)
+	} else {
+		res.RetryAfter = max(full.Sub(now)-p.Period+interval, 0)
+	}
+	return res, nil
+}
+
+// sweepEvery is how often MemoryStore drops the buckets that are full again
+const sweepEvery = time.Minute
+
+// MemoryStore keeps buckets in the process. limits hold per instance only, several
+// instances behind a load balancer each allow the full amount
+type MemoryStore struct {
+	mu        sync.Mutex
+	full      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{full: make(map[string]time.Time)}
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func (m *MemoryStore) Take(ctx context.Context, key string, now time.Time, cost, capacity time.Duration) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) >= sweepEvery {
+		for k, full := range m.full {
+			if full.Before(now) {
+				delete(m.full, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	full := m.full[key]
+	next := now.Add(cost)
+	if full.After(now) {
+		next = full.Add(cost)
+	}
+	if next.Sub(now) > capacity {
+		return full, false, nil
+	}
+	m.full[key] = next
+	return next, true, nil
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLimiter(store Store) (*Limiter, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewLimiter(store)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l, now := newTestLimiter(NewMemoryStore())
+	p := Policy{Name: "test", Limit: 3, Period: time.Minute}
+
+	// a full bucket allows a burst of Limit
+	for want := 2; want >= 0; want-- {
+		res, err := l.Allow(ctx, p, "client")
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, 3, res.Limit)
+		assert.Equal(t, want, res.Remaining)
+	}
+
+	res, err := l.Allow(ctx, p, "client")
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 20*time.Second, res.RetryAfter, "one token comes back every 20s")
+	assert.Equal(t, time.Minute, res.Reset)
+
+	other, err := l.Allow(ctx, p, "someone else")
+	require.NoError(t, err)
+	assert.True(t, other.Allowed, "buckets are per key")
+	otherPolicy, err := l.Allow(ctx, Policy{Name: "other", Limit: 3, Period: time.Minute}, "client")
+	require.NoError(t, err)
+	assert.True(t, otherPolicy.Allowed, "and per policy")
+
+	*now = now.Add(19 * time.Second)
+	res, err = l.Allow(ctx, p, "client")
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	*now = now.Add(time.Second)
+	res, err = l.Allow(ctx, p, "client")
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	// refused requests cost nothing, a quiet minute refills the bucket
+	*now = now.Add(time.Minute)
+	res, err = l.Allow(ctx, p, "client")
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+	assert.Equal(t, 20*time.Second, res.Reset)
+}
+
+func TestMemoryStoreSweeps(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	l, now := newTestLimiter(store)
+	p := Policy{Name: "test", Limit: 10, Period: time.Minute}
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := l.Allow(ctx, p, key)
+		require.NoError(t, err)
+	}
+	assert.Len(t, store.full, 3)
+
+	*now = now.Add(2 * time.Minute)
+	_, err := l.Allow(ctx, p, "d")
+	require.NoError(t, err)
+	assert.Len(t, store.full, 1, "full buckets are the same as none")
+}
@@ -2,26 +2,137 @@ package routes
 
 import (
 	"fem/internal/app"
+	"fem/internal/docs"
+	"fem/internal/middleware"
+	"fem/internal/problem"
+	"fem/internal/ratelimit"
+	"fem/internal/telemetry"
+	"fem/internal/tokens"
+	"net/http"
 
 	"github.com/go-chi/chi/v5"
 )
 
 func SetupRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(telemetry.Middleware())
+	r.Use(app.Middleware.RateLimit(ratelimit.PerIP, middleware.ByIP))
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.NotFound("no such route"))
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, ""))
+	})
 
 	r.Group(func(r chi.Router) {
+		r.Use(telemetry.Route)
 		r.Use(app.Middleware.Authenticate)
+		r.Use(app.Middleware.RateLimit(ratelimit.Default, middleware.ByClient))
 		r.Use(app.Middleware.IsAuthed)
 
-		r.Post("/workouts", app.WorkoutHandler.HandleCreateWorkout)
-		r.Put("/workouts/{id}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleUpdateWorkoutByID))
-		r.Delete("/workouts/{id}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleDeleteWorkoutByID))
+		r.Group(func(r chi.Router) {
+			r.Use(app.Middleware.RequireScope(tokens.ScopeWorkoutsWrite))
+			r.Use(app.Middleware.RequireVerified)
+
+			r.With(app.Middleware.Idempotent).Post("/workouts", app.WorkoutHandler.HandleCreateWorkout)
+			r.Put("/workouts/{id}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleUpdateWorkoutByID))
+			r.Patch("/workouts/{id}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandlePatchWorkoutByID))
+			r.Delete("/workouts/{id}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleDeleteWorkoutByID))
+			r.With(app.Middleware.Idempotent).Post("/workouts/{id}/entries", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleCreateEntry))
+			r.Put("/workouts/{id}/entries/{entryId}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleUpdateEntry))
+			r.Patch("/workouts/{id}/entries/{entryId}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandlePatchEntry))
+			r.Delete("/workouts/{id}/entries/{entryId}", app.Middleware.CanModifyWorkouts(app.WorkoutHandler.HandleDeleteEntry))
+			r.Post("/workouts/{id}/restore", app.WorkoutHandler.HandleRestoreWorkout)
+		})
+
+		r.With(app.Middleware.RequireScope(tokens.ScopeProfileRead)).Get("/users/me", app.UserHandler.HandleGetMe)
+		r.With(app.Middleware.RequireScope(tokens.ScopeWorkoutsRead)).Get("/trash", app.WorkoutHandler.HandleListTrash)
+
+		// managing tokens and the account needs a real login, not a personal access token
+		r.Group(func(r chi.Router) {
+			r.Use(app.Middleware.RequireSession)
+
+			r.Patch("/users/me", app.UserHandler.HandleUpdateMe)
+			r.Put("/users/me/password", app.UserHandler.HandleChangePassword)
+			r.With(app.Middleware.RateLimit(ratelimit.Mail, middleware.ByClient)).Put("/users/me/email", app.UserHandler.HandleChangeEmail)
+			r.Delete("/users/me", app.UserHandler.HandleDeleteMe)
+			r.Delete("/users/me/deletion", app.UserHandler.HandleCancelDeletion)
+			r.With(app.Middleware.RateLimit(ratelimit.Export, middleware.ByClient), app.Middleware.Idempotent).Post("/users/me/exports", app.ExportHandler.HandleCreateExport)
+			r.Get("/users/me/exports/{id}", app.ExportHandler.HandleGetExport)
+			r.Get("/users/me/exports/{id}/download", app.ExportHandler.HandleDownloadExport)
+			r.Post("/users/me/2fa", app.TwoFactorHandler.HandleEnroll)
+			r.Post("/users/me/2fa/confirm", app.TwoFactorHandler.HandleConfirm)
+			r.Delete("/users/me/2fa", app.TwoFactorHandler.HandleDisable)
+			r.Post("/users/me/passkeys/options", app.PasskeyHandler.HandleRegistrationOptions)
+			r.Post("/users/me/passkeys", app.PasskeyHandler.HandleRegister)
+			r.Get("/users/me/passkeys", app.PasskeyHandler.HandleListPasskeys)
+			r.Delete("/users/me/passkeys/{id}", app.PasskeyHandler.HandleDeletePasskey)
+
+			r.Delete("/tokens", app.TokenHandler.HandleRevokeAllTokens)
+			r.Delete("/tokens/current", app.TokenHandler.HandleRevokeCurrentToken)
+			r.Get("/users/me/sessions", app.TokenHandler.HandleListSessions)
+			r.Delete("/users/me/sessions/{id}", app.TokenHandler.HandleRevokeSession)
+			r.With(app.Middleware.RequireVerified).Post("/tokens/api", app.TokenHandler.HandleCreateAPIToken)
+			r.Get("/tokens/api", app.TokenHandler.HandleListAPITokens)
+			r.Delete("/tokens/api/{id}", app.TokenHandler.HandleRevokeAPIToken)
+		})
+	})
+
+	// public, but a personal access token sent along must carry workouts:read
+	r.Group(func(r chi.Router) {
+		r.Use(telemetry.Route)
+		r.Use(app.Middleware.Authenticate)
+		r.Use(app.Middleware.RateLimit(ratelimit.Default, middleware.ByClient))
+		r.Use(app.Middleware.RequireScope(tokens.ScopeWorkoutsRead))
+
+		r.Get("/workouts/{id}", app.WorkoutHandler.HandleGetWorkoutByID)
+		r.Get("/workouts/{id}/entries/{entryId}", app.WorkoutHandler.HandleGetEntry)
+	})
+
+	// public profiles, a personal access token sent along must carry profile:read
+	r.Group(func(r chi.Router) {
+		r.Use(telemetry.Route)
+		r.Use(app.Middleware.Authenticate)
+		r.Use(app.Middleware.RateLimit(ratelimit.Default, middleware.ByClient))
+		r.Use(app.Middleware.RequireScope(tokens.ScopeProfileRead))
+
+		r.Get("/users/{id}", app.UserHandler.HandleGetUserByID)
+		r.Get("/users/by-username/{username}", app.UserHandler.HandleGetUserByUsername)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(telemetry.Route)
+
+		r.Get("/health", app.HealthCheck)
+		r.Get("/openapi.json", docs.HandleSpec)
+		r.Get("/docs", docs.HandleUI)
+		r.Post("/tokens/refresh", app.TokenHandler.HandleRefreshToken)
 	})
 
-	r.Get("/health", app.HealthCheck)
-	r.Get("/workouts/{id}", app.WorkoutHandler.HandleGetWorkoutByID)
-	r.Post("/users", app.UserHandler.HandleRegisterUser)
-	r.Post("/tokens/auth", app.TokenHandler.HandleCreateToken)
+	// ways into an account, throttled per address on top of the per account lockout
+	r.Group(func(r chi.Router) {
+		r.Use(telemetry.Route)
+		r.Use(app.Middleware.RateLimit(ratelimit.Auth, middleware.ByIP))
+
+		r.Post("/users", app.UserHandler.HandleRegisterUser)
+		r.Post("/users/verify", app.UserHandler.HandleVerifyEmail)
+		r.Post("/tokens/auth", app.TokenHandler.HandleCreateToken)
+		r.Post("/tokens/2fa", app.TwoFactorHandler.HandleLogin)
+		r.Post("/tokens/passkey/options", app.PasskeyHandler.HandleLoginOptions)
+		r.Post("/tokens/passkey", app.PasskeyHandler.HandleLogin)
+		r.Post("/tokens/oidc/{provider}/options", app.OIDCHandler.HandleLoginOptions)
+		r.Post("/tokens/oidc/{provider}", app.OIDCHandler.HandleLogin)
+		r.Post("/password-reset/confirm", app.PasswordResetHandler.HandleConfirmReset)
+	})
+
+	// these send email
+	r.Group(func(r chi.Router) {
+		r.Use(telemetry.Route)
+		r.Use(app.Middleware.RateLimit(ratelimit.Mail, middleware.ByIP))
+
+		r.Post("/users/verify/resend", app.UserHandler.HandleResendVerification)
+		r.Post("/password-reset/request", app.PasswordResetHandler.HandleRequestReset)
+	})
 
 	return r
 }
@@ -1,16 +1,28 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io/fs"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/XSAM/otelsql"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
 )
 
 func Open() (*sql.DB, error) {
-	db, err := sql.Open("pgx", "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable")
+	// otelsql wraps the pgx driver so every statement run with a context gets its own span
+	db, err := otelsql.Open("pgx", "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable",
+		otelsql.WithAttributes(semconv.DBSystemNamePostgreSQL),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("db: open %w", err)
 	}
@@ -43,3 +55,67 @@ func Migrate(db *sql.DB, dir string) error {
 
 	return nil
 }
+
+// QueryTimeouts bounds how long a single store operation may hold the db.
+// a zero value means no limit beyond the caller's context
+type QueryTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+var DefaultQueryTimeouts = QueryTimeouts{
+	Read:  3 * time.Second,
+	Write: 5 * time.Second,
+}
+
+func (t QueryTimeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read)
+}
+
+func (t QueryTimeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write)
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// IsTimeout reports whether err came from a query that ran out of time,
+// either through its context deadline or postgres' own `statement_timeout`
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "57014" // query_canceled
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsUnavailable reports whether err means the database could not be reached
+func IsUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var connectErr *pgconn.ConnectError
+	if errors.As(err, &connectErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// class 08 = connection exception, 57P0x = server shutting down / starting up
+		return strings.HasPrefix(pgErr.Code, "08") || strings.HasPrefix(pgErr.Code, "57P0")
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
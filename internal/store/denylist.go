@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresDenylist holds the signed access tokens that were revoked before they expired.
+// rows are written by the `tokens_deny_on_delete` trigger whenever a token row is deleted;
+// requests check a tokens.MemoryDenylist loaded from here instead of querying it
+type PostgresDenylist struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresDenylist(db *sql.DB, timeouts QueryTimeouts) *PostgresDenylist {
+	return &PostgresDenylist{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+// ListDenied returns the jti and expiry of every revoked token that is still unexpired
+func (pgStore *PostgresDenylist) ListDenied(ctx context.Context) (map[string]time.Time, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := pgStore.db.QueryContext(ctx, `SELECT jti, expires_at FROM token_denylist WHERE expires_at > $1`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	denied := map[string]time.Time{}
+	for rows.Next() {
+		var (
+			jti       string
+			expiresAt time.Time
+		)
+		err = rows.Scan(&jti, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		denied[jti] = expiresAt
+	}
+
+	return denied, rows.Err()
+}
+
+// PurgeExpired drops entries whose token has expired anyway
+func (pgStore *PostgresDenylist) PurgeExpired(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM token_denylist WHERE expires_at < $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
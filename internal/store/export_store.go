@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"fem/internal/tokens"
+)
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// ExportTTL is how long a finished archive can be downloaded
+const ExportTTL = 7 * 24 * time.Hour
+
+// exportStaleAfter is when a running export is assumed to belong to a crashed worker
+const exportStaleAfter = time.Hour
+
+// Export is a request for a copy of all data of a user, built by a background job
+type Export struct {
+	ID          string     `json:"id"`
+	UserID      int        `json:"-"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type PostgresExportStore struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresExportStore(db *sql.DB, timeouts QueryTimeouts) *PostgresExportStore {
+	return &PostgresExportStore{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+type ExportStore interface {
+	CreateExport(ctx context.Context, userID int) (*Export, error)
+	GetExport(ctx context.Context, userID int, id string) (*Export, error)
+	GetExportArchive(ctx context.Context, userID int, id string) ([]byte, error)
+	ClaimPendingExport(ctx context.Context) (*Export, error)
+	CompleteExport(ctx context.Context, id string, archive []byte) error
+	FailExport(ctx context.Context, id string) error
+}
+
+const exportColumns = `id, user_id, status, created_at, completed_at, expires_at`
+
+func (e *Export) fields() []any {
+	return []any{&e.ID, &e.UserID, &e.Status, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt}
+}
+
+// CreateExport queues an export, or returns the one still queued or running for the user.
+// the unique index on in-flight exports makes parallel calls agree on a single one
+func (pgStore *PostgresExportStore) CreateExport(ctx context.Context, userID int) (*Export, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	id, err := tokens.NewFamilyID()
+	if err != nil {
+		return nil, err
+	}
+
+	export := &Export{}
+	// the export in flight can finish between the insert and the select; the second
+	// insert then goes through
+	for range 2 {
+		err = pgStore.db.QueryRowContext(ctx, `
+  INSERT INTO data_exports (id, user_id)
+  VALUES ($1, $2)
+  ON CONFLICT DO NOTHING
+  RETURNING `+exportColumns,
+			id, userID,
+		).Scan(export.fields()...)
+		if err != sql.ErrNoRows {
+			break
+		}
+
+		err = pgStore.db.QueryRowContext(ctx, `
+  SELECT `+exportColumns+`
+  FROM data_exports
+  WHERE user_id = $1 AND status IN ($2, $3)`,
+			userID, ExportPending, ExportRunning,
+		).Scan(export.fields()...)
+		if err != sql.ErrNoRows {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (pgStore *PostgresExportStore) GetExport(ctx context.Context, userID int, id string) (*Export, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	export := &Export{}
+	err := pgStore.db.QueryRowContext(ctx, `
+  SELECT `+exportColumns+`
+  FROM data_exports
+  WHERE id = $1 AND user_id = $2`,
+		id, userID,
+	).Scan(export.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// GetExportArchive returns the zip of a ready export. it returns sql.ErrNoRows
+// when the export does not exist, is not ready yet or has expired
+func (pgStore *PostgresExportStore) GetExportArchive(ctx context.Context, userID int, id string) ([]byte, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	var archive []byte
+	err := pgStore.db.QueryRowContext(ctx, `
+  SELECT archive
+  FROM data_exports
+  WHERE id = $1 AND user_id = $2 AND status = $3 AND expires_at > $4`,
+		id, userID, ExportReady, time.Now(),
+	).Scan(&archive)
+
+	return archive, err
+}
+
+// ClaimPendingExport marks the oldest queued export as running and returns it, or nil
+// when the queue is empty. several workers can claim concurrently without overlap, and
+// exports left running by a crashed worker are picked up again
+func (pgStore *PostgresExportStore) ClaimPendingExport(ctx context.Context) (*Export, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	now := time.Now()
+	export := &Export{}
+	err := pgStore.db.QueryRowContext(ctx, `
+  UPDATE data_exports
+  SET status = $1, started_at = $2
+  WHERE id = (
+    SELECT id FROM data_exports
+    WHERE status = $3 OR (status = $1 AND started_at < $4)
+    ORDER BY created_at
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+  )
+  RETURNING `+exportColumns,
+		ExportRunning, now, ExportPending, now.Add(-exportStaleAfter),
+	).Scan(export.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (pgStore *PostgresExportStore) CompleteExport(ctx context.Context, id string, archive []byte) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	now := time.Now()
+	_, err := pgStore.db.ExecContext(ctx, `
+  UPDATE data_exports
+  SET status = $1, archive = $2, completed_at = $3, expires_at = $4
+  WHERE id = $5`,
+		ExportReady, archive, now, now.Add(ExportTTL), id,
+	)
+	return err
+}
+
+func (pgStore *PostgresExportStore) FailExport(ctx context.Context, id string) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	// failed exports are kept around as long as an archive would be, then purged
+	now := time.Now()
+	_, err := pgStore.db.ExecContext(ctx, `
+  UPDATE data_exports
+  SET status = $1, completed_at = $2, expires_at = $3
+  WHERE id = $4`,
+		ExportFailed, now, now.Add(ExportTTL), id,
+	)
+	return err
+}
+
+// PurgeExpiredExports drops archives that can no longer be downloaded
+func (pgStore *PostgresExportStore) PurgeExpiredExports(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM data_exports WHERE expires_at <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
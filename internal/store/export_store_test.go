@@ -0,0 +1,45 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateExportConcurrent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user := &User{Username: "exporter", Email: "exporter@example.com"}
+	require.NoError(t, NewPostgresUserStore(db, DefaultQueryTimeouts).CreateUser(ctx, user))
+	store := NewPostgresExportStore(db, DefaultQueryTimeouts)
+
+	ids := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			export, err := store.CreateExport(ctx, user.ID)
+			if assert.NoError(t, err) {
+				ids[i] = export.ID
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		assert.Equal(t, ids[0], id)
+	}
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM data_exports WHERE user_id = $1`, user.ID).Scan(&count))
+	assert.Equal(t, 1, count)
+}
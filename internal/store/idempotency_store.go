@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotentResponse is what is kept under an Idempotency-Key
+type IdempotentResponse struct {
+	// Fingerprint identifies the request the key was first used with
+	Fingerprint []byte
+	// Status is 0 while that request is still being handled
+	Status int
+	Header map[string]string
+	Body   []byte
+}
+
+type PostgresIdempotencyStore struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB, timeouts QueryTimeouts) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+type IdempotencyStore interface {
+	ReserveIdempotencyKey(ctx context.Context, userID int, key string, fingerprint []byte, ttl time.Duration) (*IdempotentResponse, error)
+	SaveIdempotentResponse(ctx context.Context, userID int, key string, resp *IdempotentResponse) error
+	ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error
+}
+
+// reserveAttempts bounds the retries when a key is released between claiming and reading it
+const reserveAttempts = 3
+
+// ReserveIdempotencyKey claims key for a request with fingerprint and returns nil, or
+// returns what is already kept under the key. expired keys can be claimed again
+func (pgStore *PostgresIdempotencyStore) ReserveIdempotencyKey(ctx context.Context, userID int, key string, fingerprint []byte, ttl time.Duration) (*IdempotentResponse, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	for range reserveAttempts {
+		now := time.Now()
+		var claimed int
+		err := pgStore.db.QueryRowContext(ctx, `
+	INSERT INTO idempotency_keys (user_id, key, fingerprint, expires_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_id, key) DO UPDATE SET
+		fingerprint = EXCLUDED.fingerprint,
+		status = NULL,
+		headers = NULL,
+		body = NULL,
+		created_at = CURRENT_TIMESTAMP,
+		expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at < $5
+	RETURNING 1
+	`, userID, key, fingerprint, now.Add(ttl), now).Scan(&claimed)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		resp, err := pgStore.getIdempotentResponse(ctx, userID, key)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+	}
+	return nil, errors.New("store: idempotency key kept changing hands")
+}
+
+func (pgStore *PostgresIdempotencyStore) getIdempotentResponse(ctx context.Context, userID int, key string) (*IdempotentResponse, error) {
+	var (
+		resp    IdempotentResponse
+		status  sql.NullInt32
+		headers []byte
+	)
+	err := pgStore.db.QueryRowContext(ctx, `
+	SELECT fingerprint, status, headers, body
+	FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2
+	`, userID, key).Scan(&resp.Fingerprint, &status, &headers, &resp.Body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Status = int(status.Int32)
+	if headers != nil {
+		err = json.Unmarshal(headers, &resp.Header)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &resp, nil
+}
+
+// SaveIdempotentResponse keeps the response to the request that reserved key
+func (pgStore *PostgresIdempotencyStore) SaveIdempotentResponse(ctx context.Context, userID int, key string, resp *IdempotentResponse) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	headers, err := json.Marshal(resp.Header)
+	if err != nil {
+		return err
+	}
+	_, err = pgStore.db.ExecContext(ctx, `
+	UPDATE idempotency_keys SET status = $3, headers = $4, body = $5
+	WHERE user_id = $1 AND key = $2
+	`, userID, key, resp.Status, headers, resp.Body)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets key, so a retry is handled as a new request
+func (pgStore *PostgresIdempotencyStore) ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, err := pgStore.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`, userID, key)
+	return err
+}
+
+// PurgeExpiredIdempotencyKeys drops keys past their TTL
+func (pgStore *PostgresIdempotencyStore) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrUsernameTaken is returned by CreateUserWithIdentity when the username is in use
+var ErrUsernameTaken = errors.New("store: username is taken")
+
+// Identity is an account at an OpenID Connect provider linked to a user
+type Identity struct {
+	Provider   string     `json:"provider"`
+	Subject    string     `json:"-"`
+	UserID     int        `json:"-"`
+	Email      string     `json:"email"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// OIDCLogin is a login waiting for the provider to redirect back
+type OIDCLogin struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+}
+
+type PostgresIdentityStore struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresIdentityStore(db *sql.DB, timeouts QueryTimeouts) *PostgresIdentityStore {
+	return &PostgresIdentityStore{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+type IdentityStore interface {
+	SaveOIDCLogin(ctx context.Context, state string, login OIDCLogin, ttl time.Duration) error
+	ConsumeOIDCLogin(ctx context.Context, state string) (*OIDCLogin, error)
+	UseIdentity(ctx context.Context, provider, subject string) (*User, error)
+	LinkIdentity(ctx context.Context, identity *Identity) error
+	CreateUserWithIdentity(ctx context.Context, user *User, identity *Identity) error
+}
+
+// SaveOIDCLogin remembers a started login under the hash of its state for ttl
+func (pgStore *PostgresIdentityStore) SaveOIDCLogin(ctx context.Context, state string, login OIDCLogin, ttl time.Duration) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(state))
+	_, err := pgStore.db.ExecContext(ctx, `
+  INSERT INTO oidc_logins (state_hash, provider, nonce, code_verifier, expires_at)
+  VALUES ($1, $2, $3, $4, $5)`,
+		hash[:], login.Provider, login.Nonce, login.CodeVerifier, time.Now().Add(ttl),
+	)
+	return err
+}
+
+// ConsumeOIDCLogin uses up the login started with state. it returns sql.ErrNoRows
+// for unknown, expired or already finished logins
+func (pgStore *PostgresIdentityStore) ConsumeOIDCLogin(ctx context.Context, state string) (*OIDCLogin, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(state))
+	login := &OIDCLogin{}
+	err := pgStore.db.QueryRowContext(ctx, `
+  DELETE FROM oidc_logins
+  WHERE state_hash = $1 AND expires_at > $2
+  RETURNING provider, nonce, code_verifier`,
+		hash[:], time.Now(),
+	).Scan(&login.Provider, &login.Nonce, &login.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+	return login, nil
+}
+
+// UseIdentity returns the user the identity is linked to and notes it was used,
+// or nil when it is not linked to anyone
+func (pgStore *PostgresIdentityStore) UseIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	user := &User{}
+	err := pgStore.db.QueryRowContext(ctx, `
+  WITH used AS (
+    UPDATE external_identities
+    SET last_used_at = CURRENT_TIMESTAMP
+    WHERE provider = $1 AND subject = $2
+    RETURNING user_id
+  )
+  SELECT `+userColumns+`
+  FROM users u
+  JOIN used ON used.user_id = u.id`,
+		provider, subject,
+	).Scan(user.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// LinkIdentity links identity to identity.UserID
+func (pgStore *PostgresIdentityStore) LinkIdentity(ctx context.Context, identity *Identity) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	return insertIdentity(ctx, pgStore.db, identity)
+}
+
+func insertIdentity(ctx context.Context, db rowQueryer, identity *Identity) error {
+	return db.QueryRowContext(ctx, `
+  INSERT INTO external_identities (provider, subject, user_id, email, last_used_at)
+  VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+  RETURNING created_at, last_used_at`,
+		identity.Provider, identity.Subject, identity.UserID, identity.Email,
+	).Scan(&identity.CreatedAt, &identity.LastUsedAt)
+}
+
+// CreateUserWithIdentity creates an account without a password that signs in through
+// identity. user.EmailVerified is taken over, the provider having checked the address.
+// it returns ErrUsernameTaken or ErrUsernameReserved when user.Username is not free
+func (pgStore *PostgresIdentityStore) CreateUserWithIdentity(ctx context.Context, user *User, identity *Identity) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockUsernames(ctx, tx, user.Username)
+	if err != nil {
+		return err
+	}
+
+	var taken bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`, user.Username).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+	reserved, err := usernameReserved(ctx, tx, user.Username, 0)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return ErrUsernameReserved
+	}
+
+	query := `
+  INSERT INTO users (username, email, password_hash, bio, email_verified_at)
+  VALUES ($1, $2, NULL, $3, CASE WHEN $4 THEN CURRENT_TIMESTAMP END)
+  RETURNING id, created_at, updated_at`
+
+	err = tx.QueryRowContext(ctx, query,
+		user.Username,
+		user.Email,
+		user.Bio,
+		user.EmailVerified,
+	).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
+	err = insertIdentity(ctx, tx, identity)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pgStore *PostgresIdentityStore) PurgeExpiredLogins(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM oidc_logins WHERE expires_at <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
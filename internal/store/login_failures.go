@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fem/internal/lockout"
+	"time"
+)
+
+// PostgresLoginFailureStore keeps the failed login records of lockout.Guard
+type PostgresLoginFailureStore struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresLoginFailureStore(db *sql.DB, timeouts QueryTimeouts) *PostgresLoginFailureStore {
+	return &PostgresLoginFailureStore{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+var _ lockout.Store = (*PostgresLoginFailureStore)(nil)
+
+func (pgStore *PostgresLoginFailureStore) GetFailures(ctx context.Context, key string) (lockout.Record, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	var (
+		rec         lockout.Record
+		lockedUntil sql.NullTime
+	)
+	err := pgStore.db.QueryRowContext(ctx,
+		`SELECT failures, last_failure_at, locked_until FROM login_failures WHERE key = $1`,
+		key,
+	).Scan(&rec.Failures, &rec.LastFailureAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return lockout.Record{}, nil
+	}
+	if err != nil {
+		return lockout.Record{}, err
+	}
+
+	rec.LockedUntil = lockedUntil.Time
+	return rec, nil
+}
+
+// Reserve locks the row of key, so concurrent attempts at the same key take turns
+func (pgStore *PostgresLoginFailureStore) Reserve(ctx context.Context, key string, at time.Time, window time.Duration, allow func(lockout.Record) bool) (lockout.Record, bool, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return lockout.Record{}, false, err
+	}
+	defer tx.Rollback()
+
+	// a key without failures starts out as one whose failures are all outside the window
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO login_failures (key, failures, last_failure_at)
+	VALUES ($1, 0, $2)
+	ON CONFLICT (key) DO NOTHING
+	`, key, at.Add(-window))
+	if err != nil {
+		return lockout.Record{}, false, err
+	}
+
+	var (
+		rec         lockout.Record
+		lockedUntil sql.NullTime
+	)
+	err = tx.QueryRowContext(ctx,
+		`SELECT failures, last_failure_at, locked_until FROM login_failures WHERE key = $1 FOR UPDATE`,
+		key,
+	).Scan(&rec.Failures, &rec.LastFailureAt, &lockedUntil)
+	if err != nil {
+		return lockout.Record{}, false, err
+	}
+	rec.LockedUntil = lockedUntil.Time
+
+	if !allow(rec) {
+		return rec, false, nil
+	}
+
+	if at.Sub(rec.LastFailureAt) >= window {
+		rec.Failures = 0
+	}
+	rec.Failures++
+	rec.LastFailureAt = at
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE login_failures SET failures = $2, last_failure_at = $3 WHERE key = $1`,
+		key, rec.Failures, rec.LastFailureAt,
+	)
+	if err != nil {
+		return lockout.Record{}, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return lockout.Record{}, false, err
+	}
+	return rec, true, nil
+}
+
+func (pgStore *PostgresLoginFailureStore) Release(ctx context.Context, key string) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, err := pgStore.db.ExecContext(ctx, `UPDATE login_failures SET failures = GREATEST(failures - 1, 0) WHERE key = $1`, key)
+	return err
+}
+
+func (pgStore *PostgresLoginFailureStore) Lock(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, err := pgStore.db.ExecContext(ctx, `UPDATE login_failures SET locked_until = $2 WHERE key = $1`, key, until)
+	return err
+}
+
+func (pgStore *PostgresLoginFailureStore) ResetFailures(ctx context.Context, key string) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, err := pgStore.db.ExecContext(ctx, `DELETE FROM login_failures WHERE key = $1`, key)
+	return err
+}
+
+// PurgeStale drops records with no failure since olderThan and no lock still running
+func (pgStore *PostgresLoginFailureStore) PurgeStale(ctx context.Context, olderThan time.Time) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `
+	DELETE FROM login_failures
+	WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)
+	`, olderThan, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"fem/internal/webauthn"
+)
+
+// ceremonies a WebAuthn challenge can be issued for
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+)
+
+// Passkey is a registered WebAuthn credential. ID is the base64url credential id
+type Passkey struct {
+	ID         string              `json:"id"`
+	UserID     int                 `json:"-"`
+	Name       string              `json:"name"`
+	CreatedAt  time.Time           `json:"created_at"`
+	LastUsedAt *time.Time          `json:"last_used_at"`
+	Credential webauthn.Credential `json:"-"`
+}
+
+type PostgresPasskeyStore struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresPasskeyStore(db *sql.DB, timeouts QueryTimeouts) *PostgresPasskeyStore {
+	return &PostgresPasskeyStore{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+type PasskeyStore interface {
+	SaveChallenge(ctx context.Context, ceremony string, userID int, challenge []byte) error
+	ConsumeChallenge(ctx context.Context, ceremony string, challenge []byte) (int, error)
+	CreatePasskey(ctx context.Context, userID int, name string, cred *webauthn.Credential) (*Passkey, error)
+	GetPasskey(ctx context.Context, credentialID []byte) (*Passkey, error)
+	ListPasskeys(ctx context.Context, userID int) ([]*Passkey, error)
+	UsePasskey(ctx context.Context, credentialID []byte, signCount uint32) error
+	DeletePasskey(ctx context.Context, userID int, id string) error
+}
+
+const passkeyColumns = `id, user_id, name, public_key, sign_count, created_at, last_used_at`
+
+func scanPasskey(row interface{ Scan(...any) error }) (*Passkey, error) {
+	passkey := &Passkey{}
+	var signCount int64
+	err := row.Scan(
+		&passkey.Credential.ID,
+		&passkey.UserID,
+		&passkey.Name,
+		&passkey.Credential.PublicKey,
+		&signCount,
+		&passkey.CreatedAt,
+		&passkey.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey.ID = base64.RawURLEncoding.EncodeToString(passkey.Credential.ID)
+	passkey.Credential.SignCount = uint32(signCount)
+	return passkey, nil
+}
+
+// SaveChallenge remembers a challenge for webauthn.ChallengeTTL. userID is 0 for logins
+func (pgStore *PostgresPasskeyStore) SaveChallenge(ctx context.Context, ceremony string, userID int, challenge []byte) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	hash := sha256.Sum256(challenge)
+	_, err := pgStore.db.ExecContext(ctx, `
+  INSERT INTO webauthn_challenges (hash, ceremony, user_id, expires_at)
+  VALUES ($1, $2, $3, $4)`,
+		hash[:], ceremony, sql.NullInt64{Int64: int64(userID), Valid: userID != 0},
+		time.Now().Add(webauthn.ChallengeTTL),
+	)
+	return err
+}
+
+// ConsumeChallenge uses up a challenge and returns the user it was issued to (0 for logins).
+// it returns sql.ErrNoRows for unknown, expired or already used challenges
+func (pgStore *PostgresPasskeyStore) ConsumeChallenge(ctx context.Context, ceremony string, challenge []byte) (int, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	hash := sha256.Sum256(challenge)
+	var userID sql.NullInt64
+	err := pgStore.db.QueryRowContext(ctx, `
+  DELETE FROM webauthn_challenges
+  WHERE hash = $1 AND ceremony = $2 AND expires_at > $3
+  RETURNING user_id`,
+		hash[:], ceremony, time.Now(),
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	return int(userID.Int64), nil
+}
+
+func (pgStore *PostgresPasskeyStore) CreatePasskey(ctx context.Context, userID int, name string, cred *webauthn.Credential) (*Passkey, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	return scanPasskey(pgStore.db.QueryRowContext(ctx, `
+  INSERT INTO webauthn_credentials (id, user_id, name, public_key, sign_count)
+  VALUES ($1, $2, $3, $4, $5)
+  RETURNING `+passkeyColumns,
+		cred.ID, userID, name, cred.PublicKey, int64(cred.SignCount),
+	))
+}
+
+// GetPasskey returns nil when no passkey has the credential id
+func (pgStore *PostgresPasskeyStore) GetPasskey(ctx context.Context, credentialID []byte) (*Passkey, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	passkey, err := scanPasskey(pgStore.db.QueryRowContext(ctx,
+		`SELECT `+passkeyColumns+` FROM webauthn_credentials WHERE id = $1`,
+		credentialID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return passkey, err
+}
+
+func (pgStore *PostgresPasskeyStore) ListPasskeys(ctx context.Context, userID int) ([]*Passkey, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := pgStore.db.QueryContext(ctx, `
+  SELECT `+passkeyColumns+`
+  FROM webauthn_credentials
+  WHERE user_id = $1
+  ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+	for rows.Next() {
+		passkey, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// UsePasskey stores the sign count of a successful login. the count has to go up (or stay
+// at zero) against what is stored by now, not just against what the login read: two
+// logins racing with the same count get webauthn.ErrCloned for the slower one, as does
+// a passkey deleted in the meantime
+func (pgStore *PostgresPasskeyStore) UsePasskey(ctx context.Context, credentialID []byte, signCount uint32) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `
+  UPDATE webauthn_credentials
+  SET sign_count = $1, last_used_at = CURRENT_TIMESTAMP
+  WHERE id = $2 AND (sign_count < $1 OR $1 = 0)`,
+		int64(signCount), credentialID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return webauthn.ErrCloned
+	}
+	return nil
+}
+
+// DeletePasskey returns sql.ErrNoRows when the passkey does not exist or belongs to someone else
+func (pgStore *PostgresPasskeyStore) DeletePasskey(ctx context.Context, userID int, id string) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	credentialID, err := webauthn.DecodeBase64URL(id)
+	if err != nil {
+		return sql.ErrNoRows
+	}
+
+	result, err := pgStore.db.ExecContext(ctx,
+		`DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`,
+		credentialID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PurgeExpiredChallenges drops challenges nobody answered in time
+func (pgStore *PostgresPasskeyStore) PurgeExpiredChallenges(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM webauthn_challenges WHERE expires_at < $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
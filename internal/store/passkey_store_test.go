@@ -0,0 +1,33 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"fem/internal/webauthn"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsePasskeySignCount(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user := &User{Username: "passkey", Email: "passkey@example.com"}
+	require.NoError(t, NewPostgresUserStore(db, DefaultQueryTimeouts).CreateUser(ctx, user))
+	store := NewPostgresPasskeyStore(db, DefaultQueryTimeouts)
+
+	cred := &webauthn.Credential{ID: []byte("credential"), PublicKey: []byte("key"), SignCount: 1}
+	_, err = store.CreatePasskey(ctx, user.ID, "laptop", cred)
+	require.NoError(t, err)
+
+	require.NoError(t, store.UsePasskey(ctx, cred.ID, 2))
+	// a second login that read count 1 before the first one stored 2
+	assert.ErrorIs(t, store.UsePasskey(ctx, cred.ID, 2), webauthn.ErrCloned)
+	require.NoError(t, store.UsePasskey(ctx, cred.ID, 3))
+}
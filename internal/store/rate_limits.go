@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fem/internal/ratelimit"
+	"time"
+)
+
+// PostgresRateLimitStore keeps the buckets of ratelimit.Limiter, so limits hold across
+// every instance of the API
+type PostgresRateLimitStore struct {
+	db       *sql.DB
+	timeouts QueryTimeouts
+}
+
+func NewPostgresRateLimitStore(db *sql.DB, timeouts QueryTimeouts) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{
+		db:       db,
+		timeouts: timeouts,
+	}
+}
+
+var _ ratelimit.Store = (*PostgresRateLimitStore)(nil)
+
+// Take moves the bucket in one statement; the row lock of the upsert keeps concurrent
+// requests for the same key from both getting the last token
+func (pgStore *PostgresRateLimitStore) Take(ctx context.Context, key string, now time.Time, cost, capacity time.Duration) (time.Time, bool, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	var full time.Time
+	err := pgStore.db.QueryRowContext(ctx, `
+	INSERT INTO rate_limits (key, full_at)
+	VALUES ($1, $2::timestamptz + $3 * INTERVAL '1 microsecond')
+	ON CONFLICT (key) DO UPDATE SET
+		full_at = GREATEST(rate_limits.full_at, $2) + $3 * INTERVAL '1 microsecond'
+	WHERE GREATEST(rate_limits.full_at, $2) + $3 * INTERVAL '1 microsecond' <= $2::timestamptz + $4 * INTERVAL '1 microsecond'
+	RETURNING full_at
+	`, key, now, cost.Microseconds(), capacity.Microseconds()).Scan(&full)
+	if err == nil {
+		return full, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return time.Time{}, false, err
+	}
+
+	// the bucket was empty and is left alone; read it for the retry time
+	err = pgStore.db.QueryRowContext(ctx, `SELECT full_at FROM rate_limits WHERE key = $1`, key).Scan(&full)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return full, false, nil
+}
+
+// PurgeFull drops buckets that have filled up again
+func (pgStore *PostgresRateLimitStore) PurgeFull(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE full_at < $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,46 +1,512 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"strings"
 	"time"
 
 	"fem/internal/tokens"
 )
 
 type PostgresTokenStore struct {
-	db *sql.DB
+	db       *sql.DB
+	timeouts QueryTimeouts
+	// format issues the auth token of each pair; refresh tokens are always opaque
+	format tokens.Format
 }
 
-func NewPostgresTokenStore(db *sql.DB) *PostgresTokenStore {
+func NewPostgresTokenStore(db *sql.DB, timeouts QueryTimeouts, format tokens.Format) *PostgresTokenStore {
 	return &PostgresTokenStore{
-		db: db,
+		db:       db,
+		timeouts: timeouts,
+		format:   format,
 	}
 }
 
+// ErrTokenReused is returned when an already rotated refresh token is presented again.
+// by then the whole token family has been revoked
+var ErrTokenReused = errors.New("store: refresh token reused")
+
+// TokenReusedError is the ErrTokenReused RotateRefreshToken returns, with the signed
+// access tokens of the family it revoked
+type TokenReusedError struct {
+	Revoked RevokedTokens
+}
+
+func (e *TokenReusedError) Error() string { return ErrTokenReused.Error() }
+
+func (e *TokenReusedError) Is(target error) bool { return target == ErrTokenReused }
+
+// RevokedTokens maps the jti of each signed access token a revocation deleted to its
+// expiry, so the instance that revoked them can deny them without waiting for the
+// next denylist refresh. opaque tokens have no jti and are not in it
+type RevokedTokens map[string]time.Time
+
 type TokenStore interface {
-	CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error)
-	DeleteUserTokens(userID int, scope string) error
+	CreateNewToken(ctx context.Context, userID int, ttl time.Duration, scope string) (*tokens.Token, error)
+	CreateTokenPair(ctx context.Context, userID int, client ClientInfo) (*TokenPair, error)
+	RotateRefreshToken(ctx context.Context, refreshPlaintext string, client ClientInfo) (*TokenPair, error)
+	DeleteUserTokens(ctx context.Context, userID int, scope string) (RevokedTokens, error)
+	TouchToken(ctx context.Context, hash []byte, client ClientInfo) error
+	ListSessions(ctx context.Context, userID int, currentHash []byte) ([]*Session, error)
+	RevokeSession(ctx context.Context, userID int, sessionID string) (RevokedTokens, error)
+	RevokeSessionByToken(ctx context.Context, userID int, hash []byte) (RevokedTokens, error)
+	RevokeOtherSessions(ctx context.Context, userID int, currentHash []byte) (RevokedTokens, error)
+	CreateAPIToken(ctx context.Context, userID int, name string, scopes []string, expiry time.Time) (*APIToken, error)
+	ListAPITokens(ctx context.Context, userID int) ([]*APIToken, error)
+	RevokeAPIToken(ctx context.Context, userID int, id string) error
+}
+
+type TokenPair struct {
+	Auth    *tokens.Token
+	Refresh *tokens.Token
+}
+
+// ClientInfo is what we remember about the device a token was issued to
+type ClientInfo struct {
+	UserAgent string
+	IP        string
 }
 
-func (pgStore *PostgresTokenStore) CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
+// Session is one login: every auth/refresh token sharing a family id
+type Session struct {
+	ID         string     `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
+}
+
+// APIToken is a named personal access token limited to a set of scopes
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"token,omitempty"` // plaintext, only set right after creation
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// deleteTokens runs a DELETE FROM tokens statement and returns how many rows it
+// deleted, along with the signed access tokens among them
+func deleteTokens(ctx context.Context, db queryer, query string, args ...any) (int, RevokedTokens, error) {
+	rows, err := db.QueryContext(ctx, query+` RETURNING jti, expiry`, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	deleted := 0
+	revoked := RevokedTokens{}
+	for rows.Next() {
+		var (
+			jti    sql.NullString
+			expiry sql.NullTime
+		)
+		err = rows.Scan(&jti, &expiry)
+		if err != nil {
+			return 0, nil, err
+		}
+		deleted++
+		if jti.Valid && expiry.Valid {
+			revoked[jti.String] = expiry.Time
+		}
+	}
+
+	return deleted, revoked, rows.Err()
+}
+
+func (pgStore *PostgresTokenStore) CreateNewToken(ctx context.Context, userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
 	token, err := tokens.GenerateToken(userID, ttl, scope)
 
 	if err != nil {
 		return nil, err
 	}
-	_, err = pgStore.db.Exec(
-		`INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`,
+	err = insertToken(ctx, pgStore.db, token, ClientInfo{})
+
+	return token, err
+}
+
+func insertToken(ctx context.Context, db execer, token *tokens.Token, client ClientInfo) error {
+	_, err := db.ExecContext(
+		ctx,
+		`INSERT INTO tokens (hash, user_id, expiry, scope, family_id, user_agent, ip, jti) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
 		token.Hash,
 		token.UserID,
-		token.Expiry,
+		sql.NullTime{Time: token.Expiry, Valid: !token.Expiry.IsZero()},
 		token.Scope,
+		nullString(token.FamilyID),
+		nullString(client.UserAgent),
+		nullString(client.IP),
+		nullString(token.ID),
 	)
+	return err
+}
 
-	return token, err
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (pgStore *PostgresTokenStore) CreateTokenPair(ctx context.Context, userID int, client ClientInfo) (*TokenPair, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	familyID, err := tokens.NewFamilyID()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	pair, err := pgStore.insertTokenPair(ctx, tx, userID, familyID, client)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (pgStore *PostgresTokenStore) insertTokenPair(ctx context.Context, tx *sql.Tx, userID int, familyID string, client ClientInfo) (*TokenPair, error) {
+	pair := &TokenPair{}
+
+	for _, t := range []struct {
+		dst    **tokens.Token
+		ttl    time.Duration
+		scope  string
+		format tokens.Format
+	}{
+		{&pair.Auth, tokens.AuthTokenTTL, tokens.ScopeAuth, pgStore.format},
+		{&pair.Refresh, tokens.RefreshTokenTTL, tokens.ScopeRefresh, tokens.Opaque{}},
+	} {
+		token, err := t.format.Generate(userID, t.ttl, t.scope)
+		if err != nil {
+			return nil, err
+		}
+		token.FamilyID = familyID
+
+		err = insertToken(ctx, tx, token, client)
+		if err != nil {
+			return nil, err
+		}
+		*t.dst = token
+	}
+
+	return pair, nil
+}
+
+// RotateRefreshToken spends a refresh token and issues a new pair in the same family.
+// presenting a spent token again revokes every token of the family and returns ErrTokenReused
+func (pgStore *PostgresTokenStore) RotateRefreshToken(ctx context.Context, refreshPlaintext string, client ClientInfo) (*TokenPair, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		userID   int
+		familyID string
+		usedAt   sql.NullTime
+	)
+	query := `
+	SELECT user_id, family_id, used_at
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3 AND family_id IS NOT NULL
+	FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, query, tokens.Hash(refreshPlaintext), tokens.ScopeRefresh, time.Now()).Scan(
+		&userID,
+		&familyID,
+		&usedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		_, revoked, err := deleteTokens(ctx, tx, `DELETE FROM tokens WHERE family_id = $1`, familyID)
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &TokenReusedError{Revoked: revoked}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = CURRENT_TIMESTAMP WHERE hash = $1`, tokens.Hash(refreshPlaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := pgStore.insertTokenPair(ctx, tx, userID, familyID, client)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return pair, nil
 }
 
-func (pgStore *PostgresTokenStore) DeleteUserTokens(userID int, scope string) error {
-	_, err := pgStore.db.Exec(`DELETE FROM tokens WHERE scope = $1 AND user_id = $2`)
+func (pgStore *PostgresTokenStore) DeleteUserTokens(ctx context.Context, userID int, scope string) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, revoked, err := deleteTokens(ctx, pgStore.db, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, scope, userID)
+
+	return revoked, err
+}
+
+// TouchToken records that a token was just used. writes are throttled to once a minute per token
+func (pgStore *PostgresTokenStore) TouchToken(ctx context.Context, hash []byte, client ClientInfo) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE tokens
+	SET last_used_at = CURRENT_TIMESTAMP, ip = COALESCE($2, ip), user_agent = COALESCE($3, user_agent)
+	WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')`
 
+	_, err := pgStore.db.ExecContext(ctx, query, hash, nullString(client.IP), nullString(client.UserAgent))
 	return err
 }
+
+func (pgStore *PostgresTokenStore) ListSessions(ctx context.Context, userID int, currentHash []byte) ([]*Session, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	query := `
+	SELECT
+	  family_id,
+	  MIN(created_at),
+	  MAX(last_used_at),
+	  COALESCE((array_agg(user_agent ORDER BY created_at DESC))[1], ''),
+	  COALESCE((array_agg(ip ORDER BY last_used_at DESC NULLS LAST))[1], ''),
+	  bool_or(hash = $2)
+	FROM tokens
+	WHERE user_id = $1 AND scope IN ($3, $4) AND expiry > $5 AND used_at IS NULL AND family_id IS NOT NULL
+	GROUP BY family_id
+	ORDER BY MAX(COALESCE(last_used_at, created_at)) DESC`
+
+	rows, err := pgStore.db.QueryContext(ctx, query, userID, currentHash, tokens.ScopeAuth, tokens.ScopeRefresh, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+	for rows.Next() {
+		session := &Session{}
+		var lastUsedAt sql.NullTime
+		err = rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&lastUsedAt,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsedAt.Valid {
+			session.LastUsedAt = &lastUsedAt.Time
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes every token of a session. it returns sql.ErrNoRows
+// when the session does not exist or belongs to someone else. API tokens share
+// the family id column but are not sessions, so they cannot be revoked here
+func (pgStore *PostgresTokenStore) RevokeSession(ctx context.Context, userID int, sessionID string) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	deleted, revoked, err := deleteTokens(ctx, pgStore.db,
+		`DELETE FROM tokens WHERE user_id = $1 AND family_id = $2 AND scope IN ($3, $4)`,
+		userID, sessionID, tokens.ScopeAuth, tokens.ScopeRefresh,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return revoked, nil
+}
+
+// RevokeSessionByToken deletes the session the given token belongs to
+func (pgStore *PostgresTokenStore) RevokeSessionByToken(ctx context.Context, userID int, hash []byte) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND (
+	  hash = $2 OR family_id = (SELECT family_id FROM tokens WHERE hash = $2)
+	)`
+
+	_, revoked, err := deleteTokens(ctx, pgStore.db, query, userID, hash)
+	return revoked, err
+}
+
+// RevokeOtherSessions logs the user out everywhere except in the session currentHash belongs to
+func (pgStore *PostgresTokenStore) RevokeOtherSessions(ctx context.Context, userID int, currentHash []byte) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, revoked, err := deleteTokens(ctx, pgStore.db, `
+  DELETE FROM tokens
+  WHERE user_id = $1 AND scope IN ($2, $3)
+    AND family_id IS DISTINCT FROM (SELECT family_id FROM tokens WHERE hash = $4)`,
+		userID, tokens.ScopeAuth, tokens.ScopeRefresh, currentHash,
+	)
+	return revoked, err
+}
+
+func (pgStore *PostgresTokenStore) CreateAPIToken(ctx context.Context, userID int, name string, scopes []string, expiry time.Time) (*APIToken, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	token, err := tokens.GenerateAPIToken(userID, expiry)
+	if err != nil {
+		return nil, err
+	}
+	token.FamilyID, err = tokens.NewFamilyID()
+	if err != nil {
+		return nil, err
+	}
+
+	apiToken := &APIToken{
+		ID:     token.FamilyID,
+		Name:   name,
+		Scopes: scopes,
+		Token:  token.Plaintext,
+	}
+	if !expiry.IsZero() {
+		apiToken.ExpiresAt = &expiry
+	}
+
+	query := `
+	INSERT INTO tokens (hash, user_id, expiry, scope, family_id, name, api_scopes)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING created_at`
+
+	err = pgStore.db.QueryRowContext(ctx, query,
+		token.Hash,
+		token.UserID,
+		sql.NullTime{Time: expiry, Valid: !expiry.IsZero()},
+		token.Scope,
+		token.FamilyID,
+		name,
+		strings.Join(scopes, " "),
+	).Scan(&apiToken.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiToken, nil
+}
+
+func (pgStore *PostgresTokenStore) ListAPITokens(ctx context.Context, userID int) ([]*APIToken, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	query := `
+	SELECT family_id, name, api_scopes, created_at, last_used_at, expiry
+	FROM tokens
+	WHERE user_id = $1 AND scope = $2 AND (expiry IS NULL OR expiry > $3)
+	ORDER BY created_at DESC`
+
+	rows, err := pgStore.db.QueryContext(ctx, query, userID, tokens.ScopeAPI, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiTokens := []*APIToken{}
+	for rows.Next() {
+		apiToken := &APIToken{}
+		var (
+			scopes     string
+			lastUsedAt sql.NullTime
+			expiry     sql.NullTime
+		)
+		err = rows.Scan(
+			&apiToken.ID,
+			&apiToken.Name,
+			&scopes,
+			&apiToken.CreatedAt,
+			&lastUsedAt,
+			&expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		apiToken.Scopes = strings.Fields(scopes)
+		if lastUsedAt.Valid {
+			apiToken.LastUsedAt = &lastUsedAt.Time
+		}
+		if expiry.Valid {
+			apiToken.ExpiresAt = &expiry.Time
+		}
+		apiTokens = append(apiTokens, apiToken)
+	}
+
+	return apiTokens, rows.Err()
+}
+
+// RevokeAPIToken returns sql.ErrNoRows when the token does not exist or belongs to someone else
+func (pgStore *PostgresTokenStore) RevokeAPIToken(ctx context.Context, userID int, id string) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx,
+		`DELETE FROM tokens WHERE user_id = $1 AND family_id = $2 AND scope = $3`,
+		userID, id, tokens.ScopeAPI,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"fem/internal/tokens"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokeSessionIgnoresAPITokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user := &User{Username: "sessions", Email: "sessions@example.com"}
+	require.NoError(t, NewPostgresUserStore(db, DefaultQueryTimeouts).CreateUser(ctx, user))
+
+	store := NewPostgresTokenStore(db, DefaultQueryTimeouts, tokens.Opaque{})
+
+	apiToken, err := store.CreateAPIToken(ctx, user.ID, "ci", []string{tokens.ScopeWorkoutsRead}, time.Time{})
+	require.NoError(t, err)
+
+	// the sessions endpoint answers 404 for this
+	_, err = store.RevokeSession(ctx, user.ID, apiToken.ID)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	apiTokens, err := store.ListAPITokens(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, apiTokens, 1)
+	assert.Equal(t, apiToken.ID, apiTokens[0].ID)
+
+	pair, err := store.CreateTokenPair(ctx, user.ID, ClientInfo{})
+	require.NoError(t, err)
+	_, err = store.RevokeSession(ctx, user.ID, pair.Auth.FamilyID)
+	require.NoError(t, err)
+}
+
+func TestRevokeSessionReturnsSignedTokens(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user := &User{Username: "signed", Email: "signed@example.com"}
+	require.NoError(t, NewPostgresUserStore(db, DefaultQueryTimeouts).CreateUser(ctx, user))
+
+	keys, err := tokens.ParseKeySet("k1:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	require.NoError(t, err)
+	store := NewPostgresTokenStore(db, DefaultQueryTimeouts, tokens.Signed{Keys: keys})
+
+	pair, err := store.CreateTokenPair(ctx, user.ID, ClientInfo{})
+	require.NoError(t, err)
+
+	// only the access token is signed; the refresh token has no jti
+	revoked, err := store.RevokeSession(ctx, user.ID, pair.Auth.FamilyID)
+	require.NoError(t, err)
+	require.Len(t, revoked, 1)
+	assert.WithinDuration(t, pair.Auth.Expiry, revoked[pair.Auth.ID], time.Second)
+}
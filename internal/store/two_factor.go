@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// TOTPState is the two-factor setup of a user. Secret is sealed by totp.Cipher
+type TOTPState struct {
+	Secret   []byte
+	Enabled  bool
+	LastStep int64
+}
+
+type TwoFactorStore interface {
+	GetTOTP(ctx context.Context, userID int) (*TOTPState, error)
+	SetPendingTOTP(ctx context.Context, userID int, sealedSecret []byte) error
+	EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes [][]byte) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error)
+	DisableTOTP(ctx context.Context, userID int) error
+}
+
+// GetTOTP returns nil when the user never started enrolling
+func (pgStore *PostgresUserStore) GetTOTP(ctx context.Context, userID int) (*TOTPState, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	state := &TOTPState{}
+	err := pgStore.db.QueryRowContext(ctx, `
+  SELECT totp_secret, totp_enabled_at IS NOT NULL, totp_last_step
+  FROM users
+  WHERE id = $1 AND totp_secret IS NOT NULL`,
+		userID,
+	).Scan(&state.Secret, &state.Enabled, &state.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// SetPendingTOTP starts an enrollment, replacing any earlier unconfirmed one.
+// it returns sql.ErrNoRows when 2FA is already enabled
+func (pgStore *PostgresUserStore) SetPendingTOTP(ctx context.Context, userID int, sealedSecret []byte) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `
+  UPDATE users
+  SET totp_secret = $1, totp_last_step = 0
+  WHERE id = $2 AND totp_enabled_at IS NULL`,
+		sealedSecret, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// EnableTOTP confirms a pending enrollment with the step of the code that confirmed it and
+// replaces the recovery codes. it returns sql.ErrNoRows when nothing is pending
+func (pgStore *PostgresUserStore) EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes [][]byte) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+  UPDATE users
+  SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = $1, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $2 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL`,
+		step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code of step was used. it reports false when that step
+// or a later one was used already, so a code seen by someone else cannot be replayed
+func (pgStore *PostgresUserStore) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `
+  UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`,
+		step, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+// UseRecoveryCode uses up a recovery code and reports whether it was valid
+func (pgStore *PostgresUserStore) UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx,
+		`DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2`,
+		userID, hash,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func (pgStore *PostgresUserStore) DisableTOTP(ctx context.Context, userID int) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+  UPDATE users
+  SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $1`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
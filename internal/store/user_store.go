@@ -1,12 +1,16 @@
 package store
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"slices"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"fem/internal/passhash"
+	"fem/internal/tokens"
 )
 
 type password struct {
@@ -14,39 +18,97 @@ type password struct {
 	hash      []byte
 }
 
-func (p *password) Set(textPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(textPassword), 12)
+// Set hashes textPassword with hasher
+func (p *password) Set(hasher passhash.Hasher, textPassword string) error {
+	hash, err := hasher.Hash(textPassword)
 	if err != nil {
 		return err
 	}
 
 	p.plainText = &textPassword
-	p.hash = hash
+	p.hash = []byte(hash)
 
 	return nil
 }
 
-func (p *password) Matches(textPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(textPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+// Matches checks textPassword against the stored hash, whichever algorithm made it.
+// it is always false for accounts without a password; they still pay for a comparison
+// with hasher, so response times do not give away which accounts have none
+func (p *password) Matches(hasher passhash.Hasher, textPassword string) (bool, error) {
+	if p.hash == nil {
+		passhash.Simulate(hasher, textPassword)
+		return false, nil
 	}
-	return true, nil
+	return passhash.Verify(string(p.hash), textPassword)
+}
+
+// IsSet is false for accounts created through an identity provider until a password is set
+func (p *password) IsSet() bool {
+	return p.hash != nil
+}
+
+// NeedsRehash reports whether the stored hash was made by another algorithm or with
+// other parameters than hasher uses now
+func (p *password) NeedsRehash(hasher passhash.Hasher) bool {
+	return p.hash != nil && passhash.NeedsRehash(hasher, string(p.hash))
+}
+
+// SimulatePasswordCheck takes as long as comparing textPassword against a real hash from hasher.
+// logins for unknown usernames run it, so response times do not reveal which accounts exist
+func SimulatePasswordCheck(hasher passhash.Hasher, textPassword string) {
+	passhash.Simulate(hasher, textPassword)
 }
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash password  `json:"-"`
-	Bio          string    `json:"bio"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           int      `json:"id"`
+	Username     string   `json:"username"`
+	Email        string   `json:"email"`
+	PasswordHash password `json:"-"`
+	Bio          string   `json:"bio"`
+	// EmailVerified is set once the user followed the link mailed to their address
+	EmailVerified bool `json:"email_verified"`
+	// TwoFactorEnabled means logging in also takes a TOTP or recovery code
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+	// DeletionScheduledAt is when a requested account deletion will be carried out
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// PublicUser is what other users get to see of an account
+type PublicUser struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Bio       string    `json:"bio"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (u *User) Public() *PublicUser {
+	return &PublicUser{
+		ID:        u.ID,
+		Username:  u.Username,
+		Bio:       u.Bio,
+		CreatedAt: u.CreatedAt,
+	}
+}
+
+// userColumns is the select list User.fields scans, for queries that alias users as u
+const userColumns = `u.id, u.username, u.email, u.password_hash, COALESCE(u.bio, ''), u.email_verified_at IS NOT NULL,
+  u.totp_enabled_at IS NOT NULL, u.deletion_scheduled_at, u.created_at, u.updated_at`
+
+func (u *User) fields() []any {
+	return []any{
+		&u.ID,
+		&u.Username,
+		&u.Email,
+		&u.PasswordHash.hash,
+		&u.Bio,
+		&u.EmailVerified,
+		&u.TwoFactorEnabled,
+		&u.DeletionScheduledAt,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	}
 }
 
 var AnonymousUser = &User{}
@@ -55,30 +117,72 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// UsernameRedirectTTL is how long an old username keeps pointing at its account after a rename
+const UsernameRedirectTTL = 30 * 24 * time.Hour
+
+// ErrUsernameReserved is returned when a username was given up by another account
+// less than UsernameRedirectTTL ago
+var ErrUsernameReserved = errors.New("store: username was recently used by another account")
+
 type PostgresUserStore struct {
-	db *sql.DB
+	db       *sql.DB
+	timeouts QueryTimeouts
 }
 
-func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
+func NewPostgresUserStore(db *sql.DB, timeouts QueryTimeouts) *PostgresUserStore {
 	return &PostgresUserStore{
-		db: db,
+		db:       db,
+		timeouts: timeouts,
 	}
 }
 
 type UserStore interface {
-	CreateUser(*User) error
-	GetUserByUsername(username string) (*User, error)
-	UpdateUser(*User) error
-	GetUserByToken(scope, tokenPlainText string) (*User, error)
+	CreateUser(ctx context.Context, user *User) error
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByOldUsername(ctx context.Context, username string) (*User, error)
+	UpdateUser(ctx context.Context, user *User) error
+	UpdateEmail(ctx context.Context, user *User) error
+	UpdatePassword(ctx context.Context, user *User) error
+	RehashPassword(ctx context.Context, user *User, hasher passhash.Hasher, textPassword string) error
+	GetUserByToken(ctx context.Context, scope, tokenPlainText string) (*User, error)
+	GetUserByAPIToken(ctx context.Context, tokenPlainText string) (*User, []string, error)
+	VerifyEmail(ctx context.Context, tokenPlainText string) (*User, error)
+	ResetPassword(ctx context.Context, tokenPlainText string, user *User) (RevokedTokens, error)
+	ScheduleDeletion(ctx context.Context, user *User, at time.Time, currentHash []byte) (RevokedTokens, error)
+	CancelDeletion(ctx context.Context, userID int) error
+	DeleteUser(ctx context.Context, userID int) (RevokedTokens, error)
 }
 
-func (pgStore *PostgresUserStore) CreateUser(user *User) error {
+func (pgStore *PostgresUserStore) CreateUser(ctx context.Context, user *User) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockUsernames(ctx, tx, user.Username)
+	if err != nil {
+		return err
+	}
+	reserved, err := usernameReserved(ctx, tx, user.Username, 0)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return ErrUsernameReserved
+	}
+
 	query := `
 	INSERT INTO users (username, email, password_hash, bio)
   VALUES ($1, $2, $3, $4)
   RETURNING id, created_at, updated_at`
 
-	err := pgStore.db.QueryRow(query,
+	err = tx.QueryRowContext(ctx, query,
 		user.Username,
 		user.Email,
 		user.PasswordHash.hash,
@@ -88,29 +192,24 @@ func (pgStore *PostgresUserStore) CreateUser(user *User) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
-func (pgStore *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
+func (pgStore *PostgresUserStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
 	user := &User{
 		PasswordHash: password{},
 	}
 
 	query := `
-  SELECT id, username, email, password_hash, bio, created_at, updated_at
-  FROM users
+  SELECT ` + userColumns + `
+  FROM users u
   WHERE username = $1
   `
 
-	err := pgStore.db.QueryRow(query, username).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.PasswordHash.hash,
-		&user.Bio,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := pgStore.db.QueryRowContext(ctx, query, username).Scan(user.fields()...)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -121,36 +220,236 @@ func (pgStore *PostgresUserStore) GetUserByUsername(username string) (*User, err
 	return user, nil
 }
 
-func (pgStore *PostgresUserStore) UpdateUser(user *User) error {
+func (pgStore *PostgresUserStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	return pgStore.getUserBy(ctx, "id", id)
+}
+
+func (pgStore *PostgresUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return pgStore.getUserBy(ctx, "email", email)
+}
+
+// getUserBy looks a user up by a unique column. column is never user input
+func (pgStore *PostgresUserStore) getUserBy(ctx context.Context, column string, value any) (*User, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query := `
+  SELECT ` + userColumns + `
+  FROM users u
+  WHERE ` + column + ` = $1
+  `
+
+	err := pgStore.db.QueryRowContext(ctx, query, value).Scan(user.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// UpdateUser saves the username and bio of user. a changed username leaves a redirect
+// behind for UsernameRedirectTTL. the email address has its own method since changing
+// it needs a new verification
+func (pgStore *PostgresUserStore) UpdateUser(ctx context.Context, user *User) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1 FOR UPDATE`, user.ID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if current != user.Username {
+		err = lockUsernames(ctx, tx, current, user.Username)
+		if err != nil {
+			return err
+		}
+		reserved, err := usernameReserved(ctx, tx, user.Username, user.ID)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			return ErrUsernameReserved
+		}
+
+		// taking back a name of one's own, or one whose redirect has expired
+		_, err = tx.ExecContext(ctx, `DELETE FROM username_redirects WHERE old_username = $1`, user.Username)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `
+  INSERT INTO username_redirects (old_username, user_id, expires_at)
+  VALUES ($1, $2, $3)
+  ON CONFLICT (old_username) DO UPDATE SET user_id = EXCLUDED.user_id, expires_at = EXCLUDED.expires_at`,
+			current, user.ID, time.Now().Add(UsernameRedirectTTL),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	query := `
   UPDATE users
-  SET username = $1, email = $2, bio = $3, updated_at = CURRENT_TIMESTAMP
-  WHERE id = $4
+  SET username = $1, bio = $2, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $3
   RETURNING updated_at`
 
-	result, err := pgStore.db.Exec(query, user.Username, user.Email, user.Bio, user.ID)
+	err = tx.QueryRowContext(ctx, query, user.Username, user.Bio, user.ID).Scan(&user.UpdatedAt)
+	if err != nil {
+		return err
+	}
 
+	return tx.Commit()
+}
+
+// UpdateEmail saves the email address of user and marks it unverified. verification
+// tokens mailed to the previous address stop working
+func (pgStore *PostgresUserStore) UpdateEmail(ctx context.Context, user *User) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	query := `
+  UPDATE users
+  SET email = $1, email_verified_at = NULL, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $2
+  RETURNING updated_at`
 
+	err = tx.QueryRowContext(ctx, query, user.Email, user.ID).Scan(&user.UpdatedAt)
 	if err != nil {
 		return err
 	}
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, tokens.ScopeVerification)
+	if err != nil {
+		return err
+	}
+
+	user.EmailVerified = false
+	return tx.Commit()
+}
+
+func (pgStore *PostgresUserStore) UpdatePassword(ctx context.Context, user *User) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	query := `
+  UPDATE users
+  SET password_hash = $1, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $2
+  RETURNING updated_at`
+
+	return pgStore.db.QueryRowContext(ctx, query, user.PasswordHash.hash, user.ID).Scan(&user.UpdatedAt)
+}
+
+// RehashPassword replaces the hash of user's password, known to be textPassword, with one
+// from hasher. nothing happens when the password was changed in the meantime
+func (pgStore *PostgresUserStore) RehashPassword(ctx context.Context, user *User, hasher passhash.Hasher, textPassword string) error {
+	old := user.PasswordHash.hash
+	err := user.PasswordHash.Set(hasher, textPassword)
+	if err != nil {
+		return err
 	}
 
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	_, err = pgStore.db.ExecContext(ctx,
+		`UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3`,
+		user.PasswordHash.hash, user.ID, old,
+	)
+	return err
+}
+
+// GetUserByOldUsername finds the account that gave up username less than UsernameRedirectTTL ago
+func (pgStore *PostgresUserStore) GetUserByOldUsername(ctx context.Context, username string) (*User, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	query := `
+  SELECT ` + userColumns + `
+  FROM users u
+  INNER JOIN username_redirects r ON r.user_id = u.id
+  WHERE r.old_username = $1 AND r.expires_at > $2`
+
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	err := pgStore.db.QueryRowContext(ctx, query, username, time.Now()).Scan(user.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// lockUsernames keeps every other transaction that takes or gives up one of usernames
+// waiting until tx ends, so a name cannot be registered while a rename is leaving a
+// redirect behind for it. the locks are taken in order to avoid deadlocks
+func lockUsernames(ctx context.Context, tx *sql.Tx, usernames ...string) error {
+	slices.Sort(usernames)
+	for _, username := range usernames {
+		_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('username:' || $1))`, username)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (pgStore *PostgresUserStore) GetUserByToken(scope, plaintextPassword string) (*User, error) {
+// usernameReserved reports whether username is held by a live redirect of an account other than userID
+// the answer only holds while the lockUsernames lock on username is held
+func usernameReserved(ctx context.Context, db rowQueryer, username string, userID int) (bool, error) {
+	var owner int
+	err := db.QueryRowContext(ctx,
+		`SELECT user_id FROM username_redirects WHERE old_username = $1 AND expires_at > $2`,
+		username, time.Now(),
+	).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return owner != userID, nil
+}
+
+func (pgStore *PostgresUserStore) GetUserByToken(ctx context.Context, scope, plaintextPassword string) (*User, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
 	tokenHash := sha256.Sum256([]byte(plaintextPassword))
 
 	query := `
-  SELECT u.id, u.username, u.email, u.password_hash, u.bio, u.created_at, u.updated_at
+  SELECT ` + userColumns + `
   FROM users u
   INNER JOIN tokens t ON t.user_id = u.id
   WHERE t.hash = $1 AND t.scope = $2 and t.expiry > $3`
@@ -159,15 +458,7 @@ func (pgStore *PostgresUserStore) GetUserByToken(scope, plaintextPassword string
 		PasswordHash: password{},
 	}
 
-	err := pgStore.db.QueryRow(query, tokenHash[:], scope, time.Now()).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.PasswordHash.hash,
-		&user.Bio,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := pgStore.db.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(user.fields()...)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -178,3 +469,227 @@ func (pgStore *PostgresUserStore) GetUserByToken(scope, plaintextPassword string
 
 	return user, nil
 }
+
+// GetUserByAPIToken resolves a personal access token to its owner and granted scopes
+func (pgStore *PostgresUserStore) GetUserByAPIToken(ctx context.Context, plaintextToken string) (*User, []string, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(plaintextToken))
+
+	query := `
+  SELECT ` + userColumns + `, t.api_scopes
+  FROM users u
+  INNER JOIN tokens t ON t.user_id = u.id
+  WHERE t.hash = $1 AND t.scope = $2 AND (t.expiry IS NULL OR t.expiry > $3)`
+
+	user := &User{
+		PasswordHash: password{},
+	}
+	var scopes string
+
+	err := pgStore.db.QueryRowContext(ctx, query, tokenHash[:], tokens.ScopeAPI, time.Now()).Scan(append(user.fields(), &scopes)...)
+
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, strings.Fields(scopes), nil
+}
+
+// VerifyEmail marks the owner of a verification token as verified and uses up every
+// verification token they hold. it returns sql.ErrNoRows for unknown or expired tokens
+func (pgStore *PostgresUserStore) VerifyEmail(ctx context.Context, plaintextToken string) (*User, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `
+  DELETE FROM tokens
+  WHERE hash = $1 AND scope = $2 AND expiry > $3
+  RETURNING user_id`,
+		tokens.Hash(plaintextToken), tokens.ScopeVerification, time.Now(),
+	).Scan(&userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, userID, tokens.ScopeVerification)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		PasswordHash: password{},
+	}
+	err = tx.QueryRowContext(ctx, `
+  UPDATE users u
+  SET email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP)
+  WHERE id = $1
+  RETURNING `+userColumns,
+		userID,
+	).Scan(user.fields()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
+// ResetPassword stores user.PasswordHash for the owner of a password reset token and fills
+// in the rest of user. the token is used up, and every session and personal access token
+// of the user is revoked. it returns sql.ErrNoRows for unknown or expired tokens
+func (pgStore *PostgresUserStore) ResetPassword(ctx context.Context, plaintextToken string, user *User) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `
+  DELETE FROM tokens
+  WHERE hash = $1 AND scope = $2 AND expiry > $3
+  RETURNING user_id`,
+		tokens.Hash(plaintextToken), tokens.ScopePasswordReset, time.Now(),
+	).Scan(&userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+  UPDATE users u
+  SET password_hash = $1, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $2
+  RETURNING `+userColumns,
+		user.PasswordHash.hash, userID,
+	).Scan(user.fields()...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, revoked, err := deleteTokens(ctx, tx, `
+  DELETE FROM tokens
+  WHERE user_id = $1 AND scope IN ($2, $3, $4, $5)`,
+		userID, tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPI, tokens.ScopePasswordReset,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return revoked, tx.Commit()
+}
+
+// ScheduleDeletion marks the account for deletion at the given time. personal access
+// tokens and every session but the current one are revoked right away, so only the
+// owner can still cancel
+func (pgStore *PostgresUserStore) ScheduleDeletion(ctx context.Context, user *User, at time.Time, currentHash []byte) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+  UPDATE users
+  SET deletion_scheduled_at = $1, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $2
+  RETURNING deletion_scheduled_at, updated_at`,
+		at, user.ID,
+	).Scan(&user.DeletionScheduledAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, revoked, err := deleteTokens(ctx, tx, `
+  DELETE FROM tokens
+  WHERE user_id = $1 AND scope IN ($2, $3, $4)
+    AND family_id IS DISTINCT FROM (SELECT family_id FROM tokens WHERE hash = $5)`,
+		user.ID, tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPI, currentHash,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return revoked, tx.Commit()
+}
+
+// CancelDeletion keeps an account that was scheduled for deletion. it returns
+// sql.ErrNoRows when no deletion is pending
+func (pgStore *PostgresUserStore) CancelDeletion(ctx context.Context, userID int) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `
+  UPDATE users
+  SET deletion_scheduled_at = NULL, updated_at = CURRENT_TIMESTAMP
+  WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUser removes the account for good. workouts, their entries, tokens, username
+// redirects and data exports go with it through ON DELETE CASCADE; workouts are never
+// shared with other users, so there is nothing that has to be kept and anonymized
+func (pgStore *PostgresUserStore) DeleteUser(ctx context.Context, userID int) (RevokedTokens, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the cascade would delete the tokens too, but not say which signed ones it revoked
+	_, revoked, err := deleteTokens(ctx, tx, `DELETE FROM tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return revoked, tx.Commit()
+}
+
+// PurgeDeletedUsers deletes every account whose grace period is over
+func (pgStore *PostgresUserStore) PurgeDeletedUsers(ctx context.Context) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM users WHERE deletion_scheduled_at <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,6 +1,14 @@
 package store
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrVersionMismatch is returned when a workout was changed since the version a write was based on
+var ErrVersionMismatch = errors.New("store: workout was changed by another request")
 
 type Workout struct {
 	ID              int            `json:"id"`
@@ -9,7 +17,9 @@ type Workout struct {
 	Description     string         `json:"description"`
 	DurationMinutes int            `json:"duration_minutes"`
 	CaloriesBurned  int            `json:"calories_burned"`
+	Version         int            `json:"version"`
 	Entries         []WorkoutEntry `json:"entries"`
+	DeletedAt       *time.Time     `json:"deleted_at,omitempty"`
 }
 
 type WorkoutEntry struct {
@@ -24,23 +34,37 @@ type WorkoutEntry struct {
 }
 
 type PostgresWorkoutStore struct {
-	db *sql.DB
+	db       *sql.DB
+	timeouts QueryTimeouts
 }
 
-func NewPostgresWorkoutStore(db *sql.DB) *PostgresWorkoutStore {
-	return &PostgresWorkoutStore{db: db}
+func NewPostgresWorkoutStore(db *sql.DB, timeouts QueryTimeouts) *PostgresWorkoutStore {
+	return &PostgresWorkoutStore{db: db, timeouts: timeouts}
 }
 
 type WorkoutStore interface {
-	CreateWorkout(*Workout) (*Workout, error)
-	GetWorkoutByID(id int64) (*Workout, error)
-	UpdateWorkout(*Workout) error
-	DeleteWorkoutByID(id int64) error
-	GetWorkoutOwnerID(id int64) (int, error)
+	CreateWorkout(ctx context.Context, workout *Workout) (*Workout, error)
+	GetWorkoutByID(ctx context.Context, id int64) (*Workout, error)
+	UpdateWorkout(ctx context.Context, workout *Workout) error
+	DeleteWorkoutByID(ctx context.Context, id int64, version int) error
+	GetWorkoutOwnerID(ctx context.Context, id int64) (int, error)
+	ListWorkoutsByUser(ctx context.Context, userID int) ([]*Workout, error)
+	ListWorkoutsForExport(ctx context.Context, userID int) ([]*Workout, error)
+	ListDeletedWorkouts(ctx context.Context, userID int) ([]*Workout, error)
+	RestoreWorkout(ctx context.Context, id int64, userID int) error
 }
 
-func (pgStore *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout, error) {
-	tx, err := pgStore.db.Begin()
+/**
+* 💡 deleting a workout only sets deleted_at, PurgeDeletedWorkouts removes it for good
+* once the trash retention is over. every other query leaves deleted workouts out, so
+* to the rest of the API they are gone: reads are 404 and writes cannot reach them
+ */
+
+func (pgStore *PostgresWorkoutStore) CreateWorkout(ctx context.Context, workout *Workout) (*Workout, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -49,15 +73,15 @@ func (pgStore *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout,
 	query :=
 		`INSERT INTO workouts (user_id, title, description, duration_minutes, calories_burned)
 	VALUES ($1, $2, $3, $4, $5)
-	RETURNING id
+	RETURNING id, version
 	`
-	err = tx.QueryRow(query,
+	err = tx.QueryRowContext(ctx, query,
 		workout.UserID,
 		workout.Title,
 		workout.Description,
 		workout.DurationMinutes,
 		workout.CaloriesBurned,
-	).Scan(&workout.ID)
+	).Scan(&workout.ID, &workout.Version)
 
 	if err != nil {
 		return nil, err
@@ -69,7 +93,7 @@ func (pgStore *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout,
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		RETURNING id
 		`
-		err = tx.QueryRow(query,
+		err = tx.QueryRowContext(ctx, query,
 			workout.ID,
 			entry.ExerciseName,
 			entry.Sets,
@@ -91,19 +115,24 @@ func (pgStore *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout,
 	return workout, nil
 }
 
-func (pgStore *PostgresWorkoutStore) GetWorkoutByID(id int64) (*Workout, error) {
-	workout := &Workout{}
+func (pgStore *PostgresWorkoutStore) GetWorkoutByID(ctx context.Context, id int64) (*Workout, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	workout := &Workout{Entries: []WorkoutEntry{}}
 	query := `
-	SELECT id, title, description, duration_minutes, calories_burned
+	SELECT id, user_id, title, description, duration_minutes, calories_burned, version
 	FROM workouts
-	WHERE id = $1
+	WHERE id = $1 AND deleted_at IS NULL
 	`
-	err := pgStore.db.QueryRow(query, id).Scan(
+	err := pgStore.db.QueryRowContext(ctx, query, id).Scan(
 		&workout.ID,
+		&workout.UserID,
 		&workout.Title,
 		&workout.Description,
 		&workout.DurationMinutes,
 		&workout.CaloriesBurned,
+		&workout.Version,
 	)
 
 	if err == sql.ErrNoRows {
@@ -118,7 +147,7 @@ func (pgStore *PostgresWorkoutStore) GetWorkoutByID(id int64) (*Workout, error)
 	WHERE workout_id = $1
 	ORDER BY order_index
 	`
-	rows, err := pgStore.db.Query(entryQuery, id)
+	rows, err := pgStore.db.QueryContext(ctx, entryQuery, id)
 	if err != nil {
 		return nil, err
 	}
@@ -145,8 +174,14 @@ func (pgStore *PostgresWorkoutStore) GetWorkoutByID(id int64) (*Workout, error)
 	return workout, nil
 }
 
-func (pgStore *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
-	tx, err := pgStore.db.Begin()
+// UpdateWorkout saves workout if it is still at workout.Version and moves it to the next
+// version. it returns ErrVersionMismatch when someone else updated it first, and
+// sql.ErrNoRows for an entry id that is not one of the workout's
+func (pgStore *PostgresWorkoutStore) UpdateWorkout(ctx context.Context, workout *Workout) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := pgStore.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
@@ -154,42 +189,78 @@ func (pgStore *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 
 	query := `
 	UPDATE workouts
-	SET title = $1, description = $2, duration_minutes = $3, calories_burned = $4
-	WHERE id = $5`
+	SET title = $1, description = $2, duration_minutes = $3, calories_burned = $4, version = version + 1
+	WHERE id = $5 AND version = $6 AND deleted_at IS NULL
+	RETURNING version`
 
-	result, err := tx.Exec(query,
+	var version int
+	err = tx.QueryRowContext(ctx, query,
 		workout.Title,
 		workout.Description,
 		workout.DurationMinutes,
 		workout.CaloriesBurned,
 		workout.ID,
-	)
+		workout.Version,
+	).Scan(&version)
 
-	if err != nil {
-		return err
+	if err == sql.ErrNoRows {
+		return pgStore.missingOrChanged(ctx, tx, workout.ID)
 	}
-
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
-	}
 
-	// remove existing entries
-	_, err = tx.Exec("DELETE FROM workout_entries WHERE workout_id = $1", workout.ID)
+	// entries with an id are updated in place and keep it, the ones left out are
+	// deleted and the ones without an id are added
+	keep := []int64{}
+	for _, entry := range workout.Entries {
+		if entry.ID != 0 {
+			keep = append(keep, int64(entry.ID))
+		}
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM workout_entries WHERE workout_id = $1 AND id <> ALL($2)", workout.ID, keep)
 	if err != nil {
 		return err
 	}
 
-	// insert updated/'new' entries
-	for _, entry := range workout.Entries {
+	for i, entry := range workout.Entries {
+		if entry.ID != 0 {
+			query := `
+			UPDATE workout_entries
+			SET exercise_name = $1, sets = $2, reps = $3, duration_seconds = $4, weight = $5, notes = $6, order_index = $7
+			WHERE id = $8 AND workout_id = $9`
+
+			result, err := tx.ExecContext(ctx, query,
+				entry.ExerciseName,
+				entry.Sets,
+				entry.Reps,
+				entry.DurationSeconds,
+				entry.Weight,
+				entry.Notes,
+				entry.OrderIndex,
+				entry.ID,
+				workout.ID,
+			)
+			if err != nil {
+				return err
+			}
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rowsAffected == 0 {
+				return sql.ErrNoRows
+			}
+			continue
+		}
+
 		query := `
 		INSERT INTO workout_entries (workout_id, exercise_name, sets, reps, duration_seconds, weight, notes, order_index)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`
 
-		_, err := tx.Exec(
+		err := tx.QueryRowContext(
+			ctx,
 			query,
 			workout.ID,
 			entry.ExerciseName,
@@ -199,7 +270,7 @@ func (pgStore *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 			entry.Weight,
 			entry.Notes,
 			entry.OrderIndex,
-		)
+		).Scan(&workout.Entries[i].ID)
 
 		if err != nil {
 			return err
@@ -210,11 +281,22 @@ func (pgStore *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 	if err != nil {
 		return err
 	}
+	workout.Version = version
 	return nil
 }
 
-func (pgStore *PostgresWorkoutStore) DeleteWorkoutByID(id int64) error {
-	result, err := pgStore.db.Exec(`DELETE from workouts WHERE id = $1`, id)
+// DeleteWorkoutByID moves the workout to the trash if it is still at version, 0 deletes
+// any version. it gets a new version, so writes based on the old one fail after a restore
+func (pgStore *PostgresWorkoutStore) DeleteWorkoutByID(ctx context.Context, id int64, version int) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE workouts
+	SET deleted_at = CURRENT_TIMESTAMP, version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2)`
+
+	result, err := pgStore.db.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
@@ -223,18 +305,183 @@ func (pgStore *PostgresWorkoutStore) DeleteWorkoutByID(id int64) error {
 		return err
 	}
 	if rowsAffected == 0 {
-		return sql.ErrNoRows
+		return pgStore.missingOrChanged(ctx, pgStore.db, int(id))
 	}
 	return nil
 }
 
-func (pgStore *PostgresWorkoutStore) GetWorkoutOwnerID(workoutID int64) (int, error) {
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// missingOrChanged tells why a write guarded by a version touched no row
+func (pgStore *PostgresWorkoutStore) missingOrChanged(ctx context.Context, q queryer, id int) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM workouts WHERE id = $1 AND deleted_at IS NULL)`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return ErrVersionMismatch
+}
+
+func (pgStore *PostgresWorkoutStore) GetWorkoutOwnerID(ctx context.Context, workoutID int64) (int, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
 	var userID int
 
-	err := pgStore.db.QueryRow(`SELECT user_id FROM workouts WHERE id = $1`, workoutID).Scan(&userID)
+	err := pgStore.db.QueryRowContext(ctx, `SELECT user_id FROM workouts WHERE id = $1 AND deleted_at IS NULL`, workoutID).Scan(&userID)
 
 	if err != nil {
 		return 0, err
 	}
 	return userID, nil
 }
+
+// RestoreWorkout takes a workout of userID out of the trash. it returns sql.ErrNoRows
+// when the user has no such workout there
+func (pgStore *PostgresWorkoutStore) RestoreWorkout(ctx context.Context, id int64, userID int) error {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	query := `
+	UPDATE workouts
+	SET deleted_at = NULL, version = version + 1
+	WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL`
+
+	result, err := pgStore.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PurgeDeletedWorkouts removes the workouts that went to the trash before cutoff, their
+// entries go with them through ON DELETE CASCADE
+func (pgStore *PostgresWorkoutStore) PurgeDeletedWorkouts(ctx context.Context, cutoff time.Time) (int64, error) {
+	ctx, cancel := pgStore.timeouts.write(ctx)
+	defer cancel()
+
+	result, err := pgStore.db.ExecContext(ctx, `DELETE FROM workouts WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// which workouts of a user listWorkouts returns, as a condition on workouts w
+const (
+	withoutTrash = `w.deleted_at IS NULL`
+	onlyTrash    = `w.deleted_at IS NOT NULL`
+	withTrash    = `TRUE`
+)
+
+// ListWorkoutsByUser returns the workouts of a user with their entries, oldest first.
+// like every other query it leaves the trash out
+func (pgStore *PostgresWorkoutStore) ListWorkoutsByUser(ctx context.Context, userID int) ([]*Workout, error) {
+	return pgStore.listWorkouts(ctx, userID, withoutTrash)
+}
+
+// ListWorkoutsForExport returns every workout of a user with its entries, oldest first.
+// workouts in the trash are still the user's data until they are purged, so they are
+// included too, with DeletedAt set
+func (pgStore *PostgresWorkoutStore) ListWorkoutsForExport(ctx context.Context, userID int) ([]*Workout, error) {
+	return pgStore.listWorkouts(ctx, userID, withTrash)
+}
+
+// ListDeletedWorkouts returns the workouts of a user that are in the trash, with their entries
+func (pgStore *PostgresWorkoutStore) ListDeletedWorkouts(ctx context.Context, userID int) ([]*Workout, error) {
+	return pgStore.listWorkouts(ctx, userID, onlyTrash)
+}
+
+func (pgStore *PostgresWorkoutStore) listWorkouts(ctx context.Context, userID int, filter string) ([]*Workout, error) {
+	ctx, cancel := pgStore.timeouts.read(ctx)
+	defer cancel()
+
+	query := `
+	SELECT id, user_id, title, COALESCE(description, ''), duration_minutes, COALESCE(calories_burned, 0), version, deleted_at
+	FROM workouts w
+	WHERE w.user_id = $1 AND ` + filter + `
+	ORDER BY w.id
+	`
+	rows, err := pgStore.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workouts := []*Workout{}
+	byID := map[int]*Workout{}
+	for rows.Next() {
+		workout := &Workout{Entries: []WorkoutEntry{}}
+		err = rows.Scan(
+			&workout.ID,
+			&workout.UserID,
+			&workout.Title,
+			&workout.Description,
+			&workout.DurationMinutes,
+			&workout.CaloriesBurned,
+			&workout.Version,
+			&workout.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		workouts = append(workouts, workout)
+		byID[workout.ID] = workout
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	entryQuery := `
+	SELECT e.workout_id, e.id, e.exercise_name, e.sets, e.reps, e.duration_seconds, e.weight, COALESCE(e.notes, ''), e.order_index
+	FROM workout_entries e
+	INNER JOIN workouts w ON w.id = e.workout_id
+	WHERE w.user_id = $1 AND ` + filter + `
+	ORDER BY e.workout_id, e.order_index
+	`
+	entryRows, err := pgStore.db.QueryContext(ctx, entryQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer entryRows.Close()
+
+	for entryRows.Next() {
+		var (
+			workoutID int
+			entry     WorkoutEntry
+		)
+		err = entryRows.Scan(
+			&workoutID,
+			&entry.ID,
+			&entry.ExerciseName,
+			&entry.Sets,
+			&entry.Reps,
+			&entry.DurationSeconds,
+			&entry.Weight,
+			&entry.Notes,
+			&entry.OrderIndex,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if workout, ok := byID[workoutID]; ok {
+			workout.Entries = append(workout.Entries, entry)
+		}
+	}
+
+	return workouts, entryRows.Err()
+}
@@ -1,8 +1,10 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/stretchr/testify/assert"
@@ -31,7 +33,7 @@ func TestCreateWorkout(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
 
-	store := NewPostgresWorkoutStore(db)
+	store := NewPostgresWorkoutStore(db, DefaultQueryTimeouts)
 
 	tests := []struct {
 		name    string
@@ -89,7 +91,7 @@ func TestCreateWorkout(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			createdWorkout, err := store.CreateWorkout(tt.workout)
+			createdWorkout, err := store.CreateWorkout(context.Background(), tt.workout)
 			if tt.wantErr {
 				assert.Error(t, err)
 				return
@@ -99,7 +101,7 @@ func TestCreateWorkout(t *testing.T) {
 			assert.Equal(t, tt.workout.Description, createdWorkout.Description)
 			assert.Equal(t, tt.workout.DurationMinutes, createdWorkout.DurationMinutes)
 
-			dbWorkout, err := store.GetWorkoutByID(int64(createdWorkout.ID))
+			dbWorkout, err := store.GetWorkoutByID(context.Background(), int64(createdWorkout.ID))
 			require.NoError(t, err)
 
 			assert.Equal(t, dbWorkout.ID, createdWorkout.ID)
@@ -130,3 +132,120 @@ func IntPtr(i int) *int {
 func FlotPtr(f float64) *float64 {
 	return &f
 }
+
+func TestListWorkoutsTrash(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user := &User{Username: "trash", Email: "trash@example.com"}
+	require.NoError(t, NewPostgresUserStore(db, DefaultQueryTimeouts).CreateUser(ctx, user))
+
+	store := NewPostgresWorkoutStore(db, DefaultQueryTimeouts)
+	var ids []int
+	for _, title := range []string{"kept", "trashed"} {
+		workout, err := store.CreateWorkout(ctx, &Workout{UserID: user.ID, Title: title, DurationMinutes: 30})
+		require.NoError(t, err)
+		ids = append(ids, workout.ID)
+	}
+	require.NoError(t, store.DeleteWorkoutByID(ctx, int64(ids[1]), 0))
+
+	workouts, err := store.ListWorkoutsByUser(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, workouts, 1)
+	assert.Equal(t, ids[0], workouts[0].ID)
+
+	// trashed workouts are still the user's data, so the export has them
+	workouts, err = store.ListWorkoutsForExport(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, workouts, 2)
+	assert.Nil(t, workouts[0].DeletedAt)
+	assert.NotNil(t, workouts[1].DeletedAt)
+
+	deleted, err := store.ListDeletedWorkouts(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, ids[1], deleted[0].ID)
+}
+
+func TestRestoreWorkout(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	userStore := NewPostgresUserStore(db, DefaultQueryTimeouts)
+	owner := &User{Username: "owner", Email: "owner@example.com"}
+	require.NoError(t, userStore.CreateUser(ctx, owner))
+	other := &User{Username: "other", Email: "other@example.com"}
+	require.NoError(t, userStore.CreateUser(ctx, other))
+
+	store := NewPostgresWorkoutStore(db, DefaultQueryTimeouts)
+	workout, err := store.CreateWorkout(ctx, &Workout{UserID: owner.ID, Title: "legs", DurationMinutes: 30})
+	require.NoError(t, err)
+
+	// only workouts in the trash can be restored
+	assert.ErrorIs(t, store.RestoreWorkout(ctx, int64(workout.ID), owner.ID), sql.ErrNoRows)
+
+	require.NoError(t, store.DeleteWorkoutByID(ctx, int64(workout.ID), 0))
+
+	// someone else's trash looks the same as no workout at all
+	assert.ErrorIs(t, store.RestoreWorkout(ctx, int64(workout.ID), other.ID), sql.ErrNoRows)
+	restored, err := store.GetWorkoutByID(ctx, int64(workout.ID))
+	require.NoError(t, err)
+	assert.Nil(t, restored)
+
+	require.NoError(t, store.RestoreWorkout(ctx, int64(workout.ID), owner.ID))
+	restored, err = store.GetWorkoutByID(ctx, int64(workout.ID))
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+	assert.Equal(t, workout.Version+2, restored.Version)
+}
+
+func TestPurgeDeletedWorkouts(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE users CASCADE`)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	user := &User{Username: "purge", Email: "purge@example.com"}
+	require.NoError(t, NewPostgresUserStore(db, DefaultQueryTimeouts).CreateUser(ctx, user))
+
+	store := NewPostgresWorkoutStore(db, DefaultQueryTimeouts)
+	var ids []int
+	for _, title := range []string{"kept", "recent", "old"} {
+		workout, err := store.CreateWorkout(ctx, &Workout{
+			UserID:          user.ID,
+			Title:           title,
+			DurationMinutes: 30,
+			Entries:         []WorkoutEntry{{ExerciseName: "squat", Sets: 3, Reps: IntPtr(10)}},
+		})
+		require.NoError(t, err)
+		ids = append(ids, workout.ID)
+	}
+	require.NoError(t, store.DeleteWorkoutByID(ctx, int64(ids[1]), 0))
+	require.NoError(t, store.DeleteWorkoutByID(ctx, int64(ids[2]), 0))
+	_, err = db.Exec(`UPDATE workouts SET deleted_at = NOW() - INTERVAL '40 days' WHERE id = $1`, ids[2])
+	require.NoError(t, err)
+
+	purged, err := store.PurgeDeletedWorkouts(ctx, time.Now().Add(-30*24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	workouts, err := store.ListWorkoutsForExport(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, workouts, 2)
+	assert.Equal(t, ids[0], workouts[0].ID)
+	assert.Equal(t, ids[1], workouts[1].ID)
+
+	var entries int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM workout_entries WHERE workout_id = $1`, ids[2]).Scan(&entries))
+	assert.Zero(t, entries)
+}
@@ -0,0 +1,82 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMiddleware(t *testing.T) {
+	_, err := Setup(context.Background(), Config{Exporter: ExporterNone})
+	require.NoError(t, err)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	r := chi.NewRouter()
+	r.Use(Middleware())
+	r.Get("/workouts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/workouts/3", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "GET /workouts/{id}", spans[0].Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+}
+
+func TestRouteSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	authenticate := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := Start(r.Context(), "Authenticate.lookupToken")
+			span.End()
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	r := chi.NewRouter()
+	r.Use(Middleware())
+	r.Group(func(r chi.Router) {
+		r.Use(Route)
+		r.Use(authenticate)
+
+		r.Get("/workouts/{id}", func(w http.ResponseWriter, r *http.Request) {
+			_, span := Start(r.Context(), "GetWorkoutByID")
+			span.End()
+			w.WriteHeader(http.StatusOK)
+		})
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/workouts/3", nil))
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Len(t, spans, 4)
+
+	server := spans["GET /workouts/{id}"]
+	route := spans["route GET /workouts/{id}"]
+	require.NotNil(t, server)
+	require.NotNil(t, route)
+	assert.False(t, server.Parent().IsValid())
+	assert.Equal(t, server.SpanContext().SpanID(), route.Parent().SpanID())
+	assert.Equal(t, route.SpanContext().SpanID(), spans["Authenticate.lookupToken"].Parent().SpanID())
+	assert.Equal(t, route.SpanContext().SpanID(), spans["GetWorkoutByID"].Parent().SpanID())
+}
@@ -0,0 +1,88 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDenylistNotLoaded is returned by a MemoryDenylist that has never been refreshed.
+// signed tokens are refused until it is, rather than trusted blindly
+var ErrDenylistNotLoaded = errors.New("tokens: denylist not loaded")
+
+// Denylist tracks signed tokens that were revoked before their expiry
+type Denylist interface {
+	IsDenied(ctx context.Context, jti string) (bool, error)
+}
+
+// DenylistSource lists the jtis of revoked tokens that have not expired yet, with their expiry
+type DenylistSource interface {
+	ListDenied(ctx context.Context) (map[string]time.Time, error)
+}
+
+// MemoryDenylist keeps the revoked jtis in memory, so checking a signed token costs
+// no db read. tokens revoked through this instance are added with Deny right away;
+// one revoked on another instance is accepted until the next Refresh
+type MemoryDenylist struct {
+	source DenylistSource
+	now    func() time.Time
+
+	mu     sync.RWMutex
+	denied map[string]time.Time
+}
+
+func NewMemoryDenylist(source DenylistSource) *MemoryDenylist {
+	return &MemoryDenylist{
+		source: source,
+		now:    time.Now,
+	}
+}
+
+// Refresh adds what source lists now and drops entries whose token has expired.
+// a revoked token stays revoked, so entries Deny added while the list was being
+// read are kept. on error the old set is kept
+func (d *MemoryDenylist) Refresh(ctx context.Context) error {
+	listed, err := d.source.ListDenied(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	denied := make(map[string]time.Time, len(listed))
+	for jti, expiry := range d.denied {
+		if now.Before(expiry) {
+			denied[jti] = expiry
+		}
+	}
+	for jti, expiry := range listed {
+		denied[jti] = expiry
+	}
+	d.denied = denied
+	return nil
+}
+
+// Deny refuses the token with the given jti until it expires, without waiting for
+// the next Refresh. before the first Refresh every signed token is refused anyway
+func (d *MemoryDenylist) Deny(jti string, expiry time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.denied != nil {
+		d.denied[jti] = expiry
+	}
+}
+
+func (d *MemoryDenylist) IsDenied(_ context.Context, jti string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.denied == nil {
+		return false, ErrDenylistNotLoaded
+	}
+	expiry, ok := d.denied[jti]
+	return ok && d.now().Before(expiry), nil
+}
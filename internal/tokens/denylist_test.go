@@ -0,0 +1,77 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeDenylistSource struct {
+	denied map[string]time.Time
+	err    error
+}
+
+func (s *fakeDenylistSource) ListDenied(context.Context) (map[string]time.Time, error) {
+	return s.denied, s.err
+}
+
+func TestMemoryDenylist(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	source := &fakeDenylistSource{denied: map[string]time.Time{}}
+	denylist := NewMemoryDenylist(source)
+	denylist.now = func() time.Time { return now }
+
+	_, err := denylist.IsDenied(ctx, "a")
+	require.ErrorIs(t, err, ErrDenylistNotLoaded)
+
+	require.NoError(t, denylist.Refresh(ctx))
+	denied, err := denylist.IsDenied(ctx, "a")
+	require.NoError(t, err)
+	assert.False(t, denied)
+
+	source.denied = map[string]time.Time{
+		"a":   now.Add(time.Minute),
+		"old": now.Add(-time.Minute),
+	}
+	require.NoError(t, denylist.Refresh(ctx))
+	denied, _ = denylist.IsDenied(ctx, "a")
+	assert.True(t, denied)
+	denied, _ = denylist.IsDenied(ctx, "old")
+	assert.False(t, denied, "expired tokens fail verification anyway")
+
+	// a failed refresh keeps what was loaded
+	source.err = errors.New("db down")
+	require.Error(t, denylist.Refresh(ctx))
+	denied, _ = denylist.IsDenied(ctx, "a")
+	assert.True(t, denied)
+}
+
+func TestMemoryDenylistDeny(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	source := &fakeDenylistSource{denied: map[string]time.Time{}}
+	denylist := NewMemoryDenylist(source)
+	denylist.now = func() time.Time { return now }
+	require.NoError(t, denylist.Refresh(ctx))
+
+	// revoked on this instance: refused before the db lists it
+	denylist.Deny("a", now.Add(time.Minute))
+	denied, err := denylist.IsDenied(ctx, "a")
+	require.NoError(t, err)
+	assert.True(t, denied)
+
+	// a refresh that read the db before the revocation committed does not forget it
+	require.NoError(t, denylist.Refresh(ctx))
+	denied, _ = denylist.IsDenied(ctx, "a")
+	assert.True(t, denied)
+
+	// once the token has expired the entry goes
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, denylist.Refresh(ctx))
+	assert.NotContains(t, denylist.denied, "a")
+}
@@ -0,0 +1,82 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeySet(t *testing.T, kids ...string) *KeySet {
+	var pairs []string
+	for _, kid := range kids {
+		// the seed is derived from the kid so a key is the same in every set
+		seed := make([]byte, 32)
+		copy(seed, kid)
+		pairs = append(pairs, kid+":"+base64.StdEncoding.EncodeToString(seed))
+	}
+
+	ks, err := ParseKeySet(strings.Join(pairs, ","))
+	require.NoError(t, err)
+	return ks
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	format := Signed{Keys: testKeySet(t, "k1")}
+
+	token, err := format.Generate(42, AuthTokenTTL, ScopeAuth)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(SignedTokenTTL), token.Expiry, 2*time.Second)
+
+	claims, err := format.Parse(token.Plaintext)
+	require.NoError(t, err)
+	assert.Equal(t, token.ID, claims.ID)
+	assert.Equal(t, 42, claims.UserID)
+	assert.Equal(t, ScopeAuth, claims.Scope)
+}
+
+func TestSignedKeyRotation(t *testing.T) {
+	old := Signed{Keys: testKeySet(t, "k1")}
+	token, err := old.Generate(1, time.Minute, ScopeAuth)
+	require.NoError(t, err)
+
+	// k2 is now active, k1 is kept around until its tokens have expired
+	rotated := Signed{Keys: testKeySet(t, "k2", "k1")}
+	_, err = rotated.Parse(token.Plaintext)
+	assert.NoError(t, err)
+
+	retired := Signed{Keys: testKeySet(t, "k2")}
+	_, err = retired.Parse(token.Plaintext)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestSignedRejects(t *testing.T) {
+	format := Signed{Keys: testKeySet(t, "k1")}
+
+	expired, err := format.Generate(1, -time.Minute, ScopeAuth)
+	require.NoError(t, err)
+	_, err = format.Parse(expired.Plaintext)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	token, err := format.Generate(1, time.Minute, ScopeAuth)
+	require.NoError(t, err)
+	parts := strings.Split(token.Plaintext, ".")
+	forged := b64.EncodeToString([]byte(`{"sub":"2","jti":"x","scope":"authentication","exp":9999999999}`))
+	_, err = format.Parse(parts[0] + "." + forged + "." + parts[2])
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	opaque, err := Opaque{}.Generate(1, time.Minute, ScopeAuth)
+	require.NoError(t, err)
+	_, err = format.Parse(opaque.Plaintext)
+	assert.ErrorIs(t, err, ErrNotStateless)
+}
+
+func TestParseKeySet(t *testing.T) {
+	for _, s := range []string{"", "k1", "k1:notbase64!", "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		_, err := ParseKeySet(s)
+		assert.Error(t, err, s)
+	}
+}
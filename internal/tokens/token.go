@@ -4,19 +4,57 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/hex"
+	"slices"
+	"strings"
 	"time"
 )
 
 const (
-	ScopeAuth = "authentication"
+	ScopeAuth    = "authentication"
+	ScopeRefresh = "refresh"
+	ScopeAPI     = "api"
+	// ScopeVerification tokens are mailed out to confirm an email address
+	ScopeVerification = "verification"
+	// ScopePasswordReset tokens are mailed out to set a new password; they can be used once
+	ScopePasswordReset = "password-reset"
+	// ScopeTwoFactor tokens prove the password was right; POST /tokens/2fa trades one
+	// and a TOTP or recovery code for a token pair
+	ScopeTwoFactor = "2fa-challenge"
+)
+
+// fine-grained scopes a personal access token (ScopeAPI) can be granted
+const (
+	ScopeWorkoutsRead  = "workouts:read"
+	ScopeWorkoutsWrite = "workouts:write"
+	ScopeProfileRead   = "profile:read"
+)
+
+var APIScopes = []string{ScopeWorkoutsRead, ScopeWorkoutsWrite, ScopeProfileRead}
+
+// APITokenPrefix marks personal access tokens so they can be told apart
+// from session tokens (and spotted by secret scanners)
+const APITokenPrefix = "fem_pat_"
+
+const (
+	AuthTokenTTL          = 24 * time.Hour
+	RefreshTokenTTL       = 30 * 24 * time.Hour
+	VerificationTokenTTL  = 24 * time.Hour
+	PasswordResetTokenTTL = 30 * time.Minute
+	TwoFactorChallengeTTL = 5 * time.Minute
 )
 
 type Token struct {
+	// ID is the `jti` of self-contained tokens, empty for opaque ones
+	ID        string    `json:"-"`
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int       `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// FamilyID ties an auth/refresh pair to every pair rotated from it,
+	// so a stolen refresh token can revoke the whole chain
+	FamilyID string `json:"-"`
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -39,3 +77,41 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 
 	return token, nil
 }
+
+func NewFamilyID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hash returns the value stored in the db for a plaintext token
+func Hash(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// GenerateAPIToken creates a personal access token. a zero expiry means it never expires
+func GenerateAPIToken(userID int, expiry time.Time) (*Token, error) {
+	token, err := GenerateToken(userID, 0, ScopeAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Expiry = expiry
+	token.Plaintext = APITokenPrefix + token.Plaintext
+	token.Hash = Hash(token.Plaintext)
+
+	return token, nil
+}
+
+func IsAPIToken(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APITokenPrefix)
+}
+
+func IsAPIScope(scope string) bool {
+	return slices.Contains(APIScopes, scope)
+}
@@ -0,0 +1,65 @@
+package totp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeySize is the length of the key secrets are encrypted with (AES-256)
+const KeySize = 32
+
+var ErrSealed = errors.New("totp: sealed secret is corrupt or was encrypted with another key")
+
+// Cipher encrypts secrets at rest with AES-GCM. a sealed secret is nonce || ciphertext
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a base64 key as passed on the command line
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("totp: key is not valid base64: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("totp: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+func (c *Cipher) Seal(secret []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, ErrSealed
+	}
+	secret, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, ErrSealed
+	}
+	return secret, nil
+}
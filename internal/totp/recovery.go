@@ -0,0 +1,35 @@
+package totp
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// RecoveryCodeCount is how many recovery codes are handed out when 2FA is turned on
+const RecoveryCodeCount = 10
+
+// GenerateRecoveryCodes returns n single-use codes like "abcde-fghij" (50 random bits each).
+// only their hashes are stored
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(b32.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode forgives case, spaces and a missing dash, so a code hashes the same however it was typed
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Join(strings.Fields(code), ""))
+	code = strings.ReplaceAll(code, "-", "")
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
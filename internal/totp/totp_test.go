@@ -0,0 +1,98 @@
+package totp
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// test vectors from RFC 6238 appendix B (SHA1)
+func TestCodeRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		step := Step(time.Unix(tt.unix, 0))
+		assert.Equal(t, tt.want, code(secret, step, 8), "at %d", tt.unix)
+		assert.Equal(t, tt.want[2:], Code(secret, step), "six digits at %d", tt.unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	require.NoError(t, err)
+	now := time.Now()
+
+	step, ok := Validate(secret, Code(secret, Step(now)), now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	_, ok = Validate(secret, Code(secret, Step(now.Add(-Period))), now)
+	assert.True(t, ok, "the previous step is still accepted")
+
+	_, ok = Validate(secret, Code(secret, Step(now.Add(-3*Period))), now)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "", now)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	u, err := url.Parse(URI("fem", "jane doe", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/fem:jane doe", u.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", u.Query().Get("secret"))
+	assert.Equal(t, "fem", u.Query().Get("issuer"))
+}
+
+func TestCipher(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	c, err := NewCipher(key)
+	require.NoError(t, err)
+
+	sealed, err := c.Seal([]byte("secret"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "secret")
+
+	opened, err := c.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), opened)
+
+	other, err := NewCipher(bytes.Repeat([]byte{8}, KeySize))
+	require.NoError(t, err)
+	_, err = other.Open(sealed)
+	assert.ErrorIs(t, err, ErrSealed)
+
+	_, err = ParseKey("c2hvcnQ=")
+	assert.Error(t, err)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	require.NoError(t, err)
+	require.Len(t, codes, RecoveryCodeCount)
+
+	for _, c := range codes {
+		assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, c)
+		assert.Equal(t, c, NormalizeRecoveryCode(" "+string(bytes.ToUpper([]byte(c[:5])))+c[6:]+" "))
+	}
+}
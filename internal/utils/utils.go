@@ -3,6 +3,8 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
 
@@ -11,6 +13,30 @@ import (
 
 type Envelope map[string]interface{}
 
+// MaxBodyBytes is the largest request body ReadJSON accepts
+const MaxBodyBytes = 1 << 20 // 1MB
+
+var ErrTrailingData = errors.New("body must only contain a single JSON value")
+
+// ReadJSON decodes the request body into dst, rejecting unknown fields,
+// oversized bodies and anything after the first JSON value
+func ReadJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		return err
+	}
+
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
+
 func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
 	js, err := json.MarshalIndent(data, "", " ")
 	if err != nil {
@@ -25,14 +51,29 @@ func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
 }
 
 func ReadIDParam(r *http.Request) (int64, error) {
-	idParam := chi.URLParam(r, "id")
+	return ReadNamedIDParam(r, "id")
+}
+
+// ReadNamedIDParam reads a numeric id from the route param name, for routes with several
+func ReadNamedIDParam(r *http.Request, name string) (int64, error) {
+	idParam := chi.URLParam(r, name)
 	if idParam == "" {
-		return 0, errors.New("invalid id param")
+		return 0, errors.New("invalid " + name + " param")
 	}
 
 	id, err := strconv.ParseInt(idParam, 10, 64)
 	if err != nil {
-		return 0, errors.New("invalid id param")
+		return 0, errors.New("invalid " + name + " param")
 	}
 	return id, nil
 }
+
+// ClientIP returns the peer address of the request without its port.
+// forwarded headers are ignored since they can be spoofed by the client
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,194 @@
+package validate
+
+import (
+	"fem/internal/problem"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/**
+* 💡 rules are declared on the DTO fields with a `validate` struct tag, e.g.
+*
+*	Title string `json:"title" validate:"required,max=255"`
+*
+* supported rules:
+*	required  field must be set (non-nil pointer, non-blank string, non-empty slice)
+*	notblank  if set, a string must not be blank (for optional *string fields)
+*	min=N     numbers: value >= N, strings: at least N characters, slices: at least N items
+*	max=N     numbers: value <= N, strings: at most N characters, slices: at most N items
+*	email     string must look like an email address
+*
+* nested structs and slices of structs are validated recursively, and a struct
+* implementing Checker can add rules that span several of its fields
+ */
+
+// Checker adds cross-field rules. pointers are relative to the struct being checked
+type Checker interface {
+	Check() []problem.FieldError
+}
+
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+// Struct validates v and returns every violation found, not just the first one
+func Struct(v any) []problem.FieldError {
+	var errs []problem.FieldError
+	walk(reflect.ValueOf(v), "", &errs)
+	return errs
+}
+
+func walk(v reflect.Value, pointer string, errs *[]problem.FieldError) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		walkStruct(v, pointer, errs)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walk(v.Index(i), fmt.Sprintf("%s/%d", pointer, i), errs)
+		}
+	}
+}
+
+func walkStruct(v reflect.Value, pointer string, errs *[]problem.FieldError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := jsonName(field)
+		if name == "-" {
+			continue
+		}
+		fieldPointer := pointer + "/" + name
+		fieldValue := v.Field(i)
+
+		if tag := field.Tag.Get("validate"); tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				if detail := apply(rule, fieldValue); detail != "" {
+					*errs = append(*errs, problem.FieldError{Pointer: fieldPointer, Detail: detail})
+				}
+			}
+		}
+
+		walk(fieldValue, fieldPointer, errs)
+	}
+
+	target := v.Interface()
+	if v.CanAddr() {
+		target = v.Addr().Interface()
+	}
+	if checker, ok := target.(Checker); ok {
+		for _, fe := range checker.Check() {
+			fe.Pointer = pointer + fe.Pointer
+			*errs = append(*errs, fe)
+		}
+	}
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// apply runs a single rule and returns a message when it fails
+func apply(rule string, v reflect.Value) string {
+	name, arg, _ := strings.Cut(rule, "=")
+
+	if name == "required" {
+		if isMissing(v) {
+			return "is required"
+		}
+		return ""
+	}
+
+	// every other rule only looks at values that are present
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+
+	switch name {
+	case "notblank":
+		if v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "" {
+			return "must not be blank"
+		}
+	case "email":
+		if v.Kind() == reflect.String && !emailRegex.MatchString(v.String()) {
+			return "must be a valid email address"
+		}
+	case "min", "max":
+		return bound(name, arg, v)
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+
+	return ""
+}
+
+func isMissing(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+func bound(name, arg string, v reflect.Value) string {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validate: invalid %s argument %q", name, arg))
+	}
+
+	var (
+		got  float64
+		unit string
+	)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		got = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		got = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		got = v.Float()
+	case reflect.String:
+		got, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		got, unit = float64(v.Len()), " items"
+	default:
+		return ""
+	}
+
+	if name == "min" && got < limit {
+		if unit != "" {
+			return fmt.Sprintf("must be at least %s%s", arg, unit)
+		}
+		return fmt.Sprintf("must be greater than or equal to %s", arg)
+	}
+	if name == "max" && got > limit {
+		if unit != "" {
+			return fmt.Sprintf("must be at most %s%s", arg, unit)
+		}
+		return fmt.Sprintf("must be less than or equal to %s", arg)
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package validate_test
+
+import (
+	"fem/internal/dto"
+	"fem/internal/problem"
+	"fem/internal/validate"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func IntPtr(i int) *int {
+	return &i
+}
+
+func StrPtr(s string) *string {
+	return &s
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		name string
+		req  any
+		want []problem.FieldError
+	}{
+		{
+			name: "valid workout",
+			req: &dto.CreateWorkoutDTO{
+				Title:           "push",
+				DurationMinutes: 60,
+				Entries: []dto.WorkoutEntryDTO{
+					{ExerciseName: "Bench press", Sets: 3, Reps: IntPtr(10)},
+				},
+			},
+		},
+		{
+			name: "every violation is reported",
+			req: &dto.CreateWorkoutDTO{
+				Title:           " ",
+				DurationMinutes: -5,
+				Entries: []dto.WorkoutEntryDTO{
+					{ExerciseName: "Plank", Sets: 3, Reps: IntPtr(3), DurationSeconds: IntPtr(60)},
+					{ExerciseName: "Squats", Sets: 0},
+				},
+			},
+			want: []problem.FieldError{
+				{Pointer: "/title", Detail: "is required"},
+				{Pointer: "/duration_minutes", Detail: "must be greater than or equal to 1"},
+				{Pointer: "/entries/0/duration_seconds", Detail: "cannot be set together with reps"},
+				{Pointer: "/entries/1/sets", Detail: "must be greater than or equal to 1"},
+				{Pointer: "/entries/1/reps", Detail: "either reps or duration_seconds is required"},
+			},
+		},
+		{
+			name: "absent update fields are skipped",
+			req:  &dto.UpdateWorkoutDTO{Description: StrPtr("")},
+		},
+		{
+			name: "present update fields are checked",
+			req:  &dto.UpdateWorkoutDTO{Title: StrPtr(""), DurationMinutes: IntPtr(0)},
+			want: []problem.FieldError{
+				{Pointer: "/title", Detail: "must not be blank"},
+				{Pointer: "/duration_minutes", Detail: "must be greater than or equal to 1"},
+			},
+		},
+		{
+			name: "register user",
+			req:  &dto.RegisterUserDTO{Username: "jane_doe_with_a_username_that_is_way_too_long_for_us", Email: "jane"},
+			want: []problem.FieldError{
+				{Pointer: "/username", Detail: "must be at most 50 characters"},
+				{Pointer: "/email", Detail: "must be a valid email address"},
+				{Pointer: "/password", Detail: "is required"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, validate.Struct(tt.req))
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// a CBOR (RFC 8949) decoder covering what authenticators send: integers, byte and
+// text strings, arrays, maps and simple values, all with definite lengths
+
+var errCBOR = errors.New("webauthn: malformed CBOR")
+
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first item in data and returns the bytes after it
+func decodeCBOR(data []byte) (any, []byte, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, d.data[d.pos:], nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) remaining() int {
+	return len(d.data) - d.pos
+}
+
+// head reads the initial byte and argument of an item
+func (d *cborDecoder) head() (major byte, arg uint64, info byte, err error) {
+	if d.remaining() < 1 {
+		return 0, 0, 0, errCBOR
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info = b>>5, b&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), info, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, fmt.Errorf("%w: indefinite lengths are not supported", errCBOR)
+	}
+	if d.remaining() < size {
+		return 0, 0, 0, errCBOR
+	}
+
+	buf := make([]byte, 8)
+	copy(buf[8-size:], d.data[d.pos:d.pos+size])
+	d.pos += size
+	return major, binary.BigEndian.Uint64(buf), info, nil
+}
+
+func (d *cborDecoder) item(depth int) (any, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+
+	major, arg, info, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, fmt.Errorf("%w: integer out of range", errCBOR)
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, fmt.Errorf("%w: integer out of range", errCBOR)
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if arg > uint64(d.remaining()) {
+			return nil, errCBOR
+		}
+		b := d.data[d.pos : d.pos+int(arg)]
+		d.pos += int(arg)
+		if major == 3 {
+			return string(b), nil
+		}
+		return append([]byte(nil), b...), nil
+	case 4:
+		// every item takes at least a byte, which bounds the allocation
+		if arg > uint64(d.remaining()) {
+			return nil, errCBOR
+		}
+		items := make([]any, arg)
+		for i := range items {
+			items[i], err = d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(d.remaining()/2) {
+			return nil, errCBOR
+		}
+		m := make(map[any]any, arg)
+		for range arg {
+			key, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("%w: unsupported map key %T", errCBOR, key)
+			}
+			m[key], err = d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6:
+		// tags carry no meaning for what is parsed here
+		return d.item(depth + 1)
+	default:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: unsupported simple value or float", errCBOR)
+	}
+}
@@ -0,0 +1,110 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithm identifiers (RFC 9053) offered when registering, most preferred first
+const (
+	AlgEdDSA = -8
+	AlgES256 = -7
+	AlgRS256 = -257
+)
+
+var algorithms = []int64{AlgEdDSA, AlgES256, AlgRS256}
+
+// COSE key parameters
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // n for RSA
+	coseX   = -2 // e for RSA
+	coseY   = -3
+
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parsePublicKey reads a COSE_Key as found in authenticator data
+func parsePublicKey(cose []byte) (*publicKey, error) {
+	v, _, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: public key is not a map", ErrVerification)
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	switch {
+	case kty == ktyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x := param(coseX)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: bad Ed25519 key", ErrVerification)
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+
+	case kty == ktyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, y := param(coseX), param(coseY)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: bad P-256 key", ErrVerification)
+		}
+		uncompressed := append(append([]byte{4}, x...), y...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), uncompressed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad P-256 key: %v", ErrVerification, err)
+		}
+		return &publicKey{alg: alg, key: key}, nil
+
+	case kty == ktyRSA && alg == AlgRS256:
+		n, e := param(coseCrv), param(coseX)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: bad RSA key", ErrVerification)
+		}
+		return &publicKey{alg: alg, key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported key type %d with algorithm %d", ErrVerification, kty, alg)
+}
+
+func (k *publicKey) verify(data, sig []byte) bool {
+	switch key := k.key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
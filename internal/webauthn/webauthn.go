@@ -0,0 +1,340 @@
+// Package webauthn verifies passkey registrations and logins (WebAuthn level 2).
+// attestation statements are not checked: options ask for "none", since which
+// authenticator model holds a passkey does not matter here
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrVerification wraps every reason a ceremony response is rejected
+	ErrVerification = errors.New("webauthn: verification failed")
+	// ErrCloned means the signature counter did not go up, so two copies of the
+	// authenticator may be in use
+	ErrCloned = errors.New("webauthn: sign count did not increase, the authenticator may be cloned")
+)
+
+// ChallengeTTL is how long a client has to finish a ceremony
+const ChallengeTTL = 5 * time.Minute
+
+// Timeout is the hint passed to the browser, a bit shorter than ChallengeTTL
+const Timeout = 4 * time.Minute
+
+// Config identifies the relying party: RPID is the domain passkeys are bound to,
+// Origins are the exact origins (scheme://host[:port]) ceremonies may come from
+type Config struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// Credential is what has to be stored of a registered passkey
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Base64URL is how WebAuthn JSON carries binary values
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+// DecodeBase64URL accepts base64url with or without padding
+func DecodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions is the JSON form of PublicKeyCredentialCreationOptions
+type CreationOptions struct {
+	RP                     RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              Base64URL              `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is the JSON form of PublicKeyCredentialRequestOptions. no credentials
+// are listed, so the browser offers every passkey it has for the RP
+type RequestOptions struct {
+	Challenge        Base64URL `json:"challenge"`
+	RPID             string    `json:"rpId"`
+	Timeout          int64     `json:"timeout"`
+	UserVerification string    `json:"userVerification"`
+}
+
+// CreationOptions asks for a discoverable, user-verified passkey for user.
+// exclude lists credential ids the user already registered
+func (c Config) CreationOptions(user UserEntity, challenge []byte, exclude [][]byte) CreationOptions {
+	params := make([]CredentialParameter, len(algorithms))
+	for i, alg := range algorithms {
+		params[i] = CredentialParameter{Type: "public-key", Alg: alg}
+	}
+	excluded := make([]CredentialDescriptor, len(exclude))
+	for i, id := range exclude {
+		excluded[i] = CredentialDescriptor{Type: "public-key", ID: id}
+	}
+
+	return CreationOptions{
+		RP:                 RelyingParty{ID: c.RPID, Name: c.RPName},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            Timeout.Milliseconds(),
+		ExcludeCredentials: excluded,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}
+}
+
+func (c Config) RequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             c.RPID,
+		Timeout:          Timeout.Milliseconds(),
+		UserVerification: "required",
+	}
+}
+
+const (
+	typeCreate = "webauthn.create"
+	typeGet    = "webauthn.get"
+)
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// Challenge reads the challenge a response answers, so the caller can look it up
+// before verifying the rest
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var cd clientData
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data is not JSON", ErrVerification)
+	}
+	challenge, err := DecodeBase64URL(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, fmt.Errorf("%w: client data has no valid challenge", ErrVerification)
+	}
+	return challenge, nil
+}
+
+func (c Config) verifyClientData(clientDataJSON []byte, typ string, challenge []byte) error {
+	var cd clientData
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return fmt.Errorf("%w: client data is not JSON", ErrVerification)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("%w: client data type %q, expected %q", ErrVerification, cd.Type, typ)
+	}
+	got, err := DecodeBase64URL(cd.Challenge)
+	if err != nil || !bytes.Equal(got, challenge) {
+		return fmt.Errorf("%w: challenge does not match", ErrVerification)
+	}
+	if !slices.Contains(c.Origins, cd.Origin) {
+		return fmt.Errorf("%w: origin %q is not allowed", ErrVerification, cd.Origin)
+	}
+	if cd.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin ceremonies are not allowed", ErrVerification)
+	}
+	return nil
+}
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// only present in registrations
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrVerification)
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&flagAttested == 0 {
+		return ad, nil
+	}
+
+	// aaguid (16), credential id length (2), credential id, COSE key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data too short", ErrVerification)
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+		return nil, fmt.Errorf("%w: bad credential id", ErrVerification)
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad credential public key", ErrVerification)
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+func (c Config) verifyAuthenticatorData(ad *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return fmt.Errorf("%w: credential belongs to another relying party", ErrVerification)
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return fmt.Errorf("%w: user was not present", ErrVerification)
+	}
+	if ad.flags&flagUserVerified == 0 {
+		return fmt.Errorf("%w: user was not verified", ErrVerification)
+	}
+	return nil
+}
+
+// VerifyRegistration checks the response to CreationOptions issued with challenge
+// and returns the new credential
+func (c Config) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	err := c.verifyClientData(clientDataJSON, typeCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	v, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad attestation object", ErrVerification)
+	}
+	att, _ := v.(map[any]any)
+	rawAuthData, _ := att["authData"].([]byte)
+	if rawAuthData == nil {
+		return nil, fmt.Errorf("%w: attestation object has no authenticator data", ErrVerification)
+	}
+
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	err = c.verifyAuthenticatorData(ad)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, fmt.Errorf("%w: no credential was created", ErrVerification)
+	}
+	_, err = parsePublicKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        bytes.Clone(ad.credentialID),
+		PublicKey: bytes.Clone(ad.publicKey),
+		SignCount: ad.signCount,
+	}, nil
+}
+
+// VerifyAssertion checks a login response to RequestOptions issued with challenge
+// against a stored credential and returns the sign count to store. counters that stay
+// at zero are fine (synced passkeys often have none), any other non-increase is ErrCloned,
+// returned along with the count the authenticator presented
+func (c Config) VerifyAssertion(challenge []byte, cred Credential, clientDataJSON, authenticatorDataRaw, signature []byte) (uint32, error) {
+	err := c.verifyClientData(clientDataJSON, typeGet, challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthenticatorData(authenticatorDataRaw)
+	if err != nil {
+		return 0, err
+	}
+	err = c.verifyAuthenticatorData(ad)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(bytes.Clone(authenticatorDataRaw), clientDataHash[:]...)
+	if !key.verify(signed, signature) {
+		return 0, fmt.Errorf("%w: bad signature", ErrVerification)
+	}
+
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return ad.signCount, ErrCloned
+	}
+	return ad.signCount, nil
+}
@@ -0,0 +1,275 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeCBOR covers what the software authenticator below needs to send
+func encodeCBOR(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[any]any:
+		keys := make([]any, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return string(encodeCBOR(keys[i])) < string(encodeCBOR(keys[j])) })
+		out := head(5, uint64(len(v)))
+		for _, k := range keys {
+			out = append(out, encodeCBOR(k)...)
+			out = append(out, encodeCBOR(v[k])...)
+		}
+		return out
+	}
+	panic("encodeCBOR: unsupported type")
+}
+
+// authenticator is a software passkey: one key pair, a counter and the usual flags
+type authenticator struct {
+	id        []byte
+	signer    crypto.Signer
+	cose      []byte
+	signCount uint32
+	// noCounter leaves signCount at zero, like synced passkeys do
+	noCounter bool
+	flags     byte
+}
+
+func newAuthenticator(t *testing.T, alg int) *authenticator {
+	t.Helper()
+	a := &authenticator{id: make([]byte, 16), flags: flagUserPresent | flagUserVerified}
+	rand.Read(a.id)
+
+	switch alg {
+	case AlgEdDSA:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		a.signer = priv
+		a.cose = encodeCBOR(map[any]any{coseKty: ktyOKP, coseAlg: AlgEdDSA, coseCrv: crvEd25519, coseX: []byte(pub)})
+	case AlgES256:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		a.signer = priv
+		raw, err := priv.PublicKey.Bytes()
+		require.NoError(t, err)
+		a.cose = encodeCBOR(map[any]any{coseKty: ktyEC2, coseAlg: AlgES256, coseCrv: crvP256, coseX: raw[1:33], coseY: raw[33:]})
+	}
+	return a
+}
+
+func (a *authenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := a.flags
+	if attested {
+		flags |= flagAttested
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.cose...)
+	}
+	return data
+}
+
+func clientDataJSON(typ string, challenge []byte, origin string) []byte {
+	js, _ := json.Marshal(map[string]any{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return js
+}
+
+func (a *authenticator) create(rpID, origin string, challenge []byte) (clientData, attestationObject []byte) {
+	clientData = clientDataJSON(typeCreate, challenge, origin)
+	attestationObject = encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": a.authData(rpID, true),
+	})
+	return clientData, attestationObject
+}
+
+func (a *authenticator) get(t *testing.T, rpID, origin string, challenge []byte) (clientData, authData, signature []byte) {
+	t.Helper()
+	if !a.noCounter {
+		a.signCount++
+	}
+	clientData = clientDataJSON(typeGet, challenge, origin)
+	authData = a.authData(rpID, false)
+
+	hash := sha256.Sum256(clientData)
+	signed := append(append([]byte(nil), authData...), hash[:]...)
+
+	var err error
+	if _, ok := a.signer.(ed25519.PrivateKey); ok {
+		signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(signed)
+		signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	require.NoError(t, err)
+	return clientData, authData, signature
+}
+
+var testConfig = Config{RPID: "localhost", RPName: "fem", Origins: []string{"http://localhost:9090"}}
+
+const origin = "http://localhost:9090"
+
+func TestRegisterAndLogin(t *testing.T) {
+	for name, alg := range map[string]int{"EdDSA": AlgEdDSA, "ES256": AlgES256} {
+		t.Run(name, func(t *testing.T) {
+			a := newAuthenticator(t, alg)
+
+			challenge, err := NewChallenge()
+			require.NoError(t, err)
+			clientData, attestation := a.create("localhost", origin, challenge)
+
+			got, err := Challenge(clientData)
+			require.NoError(t, err)
+			assert.Equal(t, challenge, got)
+
+			cred, err := testConfig.VerifyRegistration(challenge, clientData, attestation)
+			require.NoError(t, err)
+			assert.Equal(t, a.id, cred.ID)
+
+			for range 2 {
+				challenge, err = NewChallenge()
+				require.NoError(t, err)
+				clientData, authData, sig := a.get(t, "localhost", origin, challenge)
+
+				count, err := testConfig.VerifyAssertion(challenge, *cred, clientData, authData, sig)
+				require.NoError(t, err)
+				assert.Equal(t, a.signCount, count)
+				cred.SignCount = count
+			}
+		})
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	challenge, err := NewChallenge()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		setup func(a *authenticator) (clientData, attestation []byte)
+	}{
+		{"wrong origin", func(a *authenticator) ([]byte, []byte) {
+			return a.create("localhost", "https://evil.example", challenge)
+		}},
+		{"wrong relying party", func(a *authenticator) ([]byte, []byte) {
+			return a.create("evil.example", origin, challenge)
+		}},
+		{"other challenge", func(a *authenticator) ([]byte, []byte) {
+			return a.create("localhost", origin, []byte("something else entirely"))
+		}},
+		{"user not verified", func(a *authenticator) ([]byte, []byte) {
+			a.flags = flagUserPresent
+			return a.create("localhost", origin, challenge)
+		}},
+		{"login response", func(a *authenticator) ([]byte, []byte) {
+			_, attestation := a.create("localhost", origin, challenge)
+			return clientDataJSON(typeGet, challenge, origin), attestation
+		}},
+		{"garbage", func(a *authenticator) ([]byte, []byte) {
+			clientData, _ := a.create("localhost", origin, challenge)
+			return clientData, []byte{0xbf, 0xff}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientData, attestation := tt.setup(newAuthenticator(t, AlgES256))
+			_, err := testConfig.VerifyRegistration(challenge, clientData, attestation)
+			assert.ErrorIs(t, err, ErrVerification)
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	challenge, err := NewChallenge()
+	require.NoError(t, err)
+	clientData, attestation := a.create("localhost", origin, challenge)
+	cred, err := testConfig.VerifyRegistration(challenge, clientData, attestation)
+	require.NoError(t, err)
+
+	t.Run("bad signature", func(t *testing.T) {
+		clientData, authData, sig := a.get(t, "localhost", origin, challenge)
+		sig[len(sig)-1] ^= 1
+		_, err := testConfig.VerifyAssertion(challenge, *cred, clientData, authData, sig)
+		assert.ErrorIs(t, err, ErrVerification)
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		other := newAuthenticator(t, AlgES256)
+		clientData, authData, sig := other.get(t, "localhost", origin, challenge)
+		_, err := testConfig.VerifyAssertion(challenge, *cred, clientData, authData, sig)
+		assert.ErrorIs(t, err, ErrVerification)
+	})
+
+	t.Run("cloned", func(t *testing.T) {
+		clientData, authData, sig := a.get(t, "localhost", origin, challenge)
+		stored := *cred
+		stored.SignCount = a.signCount
+		_, err := testConfig.VerifyAssertion(challenge, stored, clientData, authData, sig)
+		assert.ErrorIs(t, err, ErrCloned)
+	})
+
+	t.Run("no counter", func(t *testing.T) {
+		a.signCount, a.noCounter = 0, true
+		clientData, authData, sig := a.get(t, "localhost", origin, challenge)
+		stored := *cred
+		stored.SignCount = 0
+		count, err := testConfig.VerifyAssertion(challenge, stored, clientData, authData, sig)
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
+
+func TestDecodeCBORRejectsHugeLengths(t *testing.T) {
+	// an array claiming 2^32 items in five bytes
+	_, _, err := decodeCBOR([]byte{0x9a, 0xff, 0xff, 0xff, 0xff})
+	assert.ErrorIs(t, err, errCBOR)
+
+	_, _, err = decodeCBOR([]byte{0x5a, 0xff, 0xff, 0xff, 0xff})
+	assert.ErrorIs(t, err, errCBOR)
+}
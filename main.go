@@ -1,25 +1,75 @@
 package main
 
 import (
+	"context"
 	"fem/internal/app"
+	"fem/internal/mailer"
+	"fem/internal/middleware"
+	"fem/internal/passpolicy"
 	"fem/internal/routes"
+	"fem/internal/store"
+	"fem/internal/telemetry"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 )
 
 func main() {
 	var port int
+	var traceCfg telemetry.Config
+	appCfg := app.Config{QueryTimeouts: store.DefaultQueryTimeouts}
 	flag.IntVar(&port, "port", 9090, "server port")
+	flag.StringVar(&traceCfg.Exporter, "trace-exporter", telemetry.ExporterNone, "trace exporter (none|stdout|otlp)")
+	flag.StringVar(&traceCfg.OTLPEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector host:port (defaults to OTEL_EXPORTER_OTLP_* env vars)")
+	flag.BoolVar(&traceCfg.OTLPInsecure, "otlp-insecure", false, "use plain HTTP for the OTLP collector")
+	flag.DurationVar(&appCfg.QueryTimeouts.Read, "db-read-timeout", appCfg.QueryTimeouts.Read, "max duration of a read query (0 = no limit)")
+	flag.DurationVar(&appCfg.QueryTimeouts.Write, "db-write-timeout", appCfg.QueryTimeouts.Write, "max duration of a write query (0 = no limit)")
+	flag.StringVar(&appCfg.TokenFormat, "token-format", app.TokenFormatOpaque, "access token format (opaque|signed)")
+	flag.StringVar(&appCfg.SigningKeys, "signing-keys", os.Getenv("TOKEN_SIGNING_KEYS"), "Ed25519 signing keys as kid:base64seed,... (first is active)")
+	flag.DurationVar(&appCfg.DenylistRefresh, "denylist-refresh", 5*time.Second, "how often revoked signed tokens are reloaded from the db")
+	flag.StringVar(&appCfg.Mailer, "mailer", app.MailerFile, "how email is delivered (file|smtp)")
+	flag.StringVar(&appCfg.MailDir, "mail-dir", "tmp/mail", "directory the file mailer writes .eml files to")
+	flag.StringVar(&appCfg.MailFrom, "mail-from", "fem <no-reply@localhost>", "sender address of outbound email")
+	flag.StringVar(&appCfg.SMTP.Addr, "smtp-addr", "", "SMTP relay host:port")
+	flag.StringVar(&appCfg.SMTP.Username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&appCfg.SMTP.Password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+	flag.BoolVar(&appCfg.SMTP.Insecure, "smtp-insecure", false, "send mail to relays without STARTTLS (loopback relays are always allowed)")
+	flag.DurationVar(&appCfg.SMTP.Timeout, "smtp-timeout", mailer.DefaultSMTPTimeout, "max duration of one SMTP delivery")
+	flag.StringVar(&appCfg.UnverifiedPolicy, "unverified-policy", string(middleware.UnverifiedRestrict), "what accounts with an unconfirmed email may do (allow|restrict|block)")
+	flag.DurationVar(&appCfg.DeletionGracePeriod, "deletion-grace-period", 14*24*time.Hour, "how long a deleted account can be restored (0 = delete right away)")
+	flag.StringVar(&appCfg.TOTPKey, "totp-key", os.Getenv("TOTP_ENCRYPTION_KEY"), "base64 32-byte key TOTP secrets are encrypted with (empty = 2FA unavailable)")
+	flag.StringVar(&appCfg.WebAuthnRPID, "webauthn-rp-id", "localhost", "domain passkeys are registered for")
+	flag.StringVar(&appCfg.WebAuthnOrigins, "webauthn-origins", "http://localhost:9090", "comma separated origins passkey ceremonies may come from")
+	flag.StringVar(&appCfg.OIDCProviders, "oidc-providers", os.Getenv("OIDC_PROVIDERS"), "JSON array of OpenID Connect providers users can sign in with")
+	flag.BoolVar(&appCfg.InsecureCookies, "insecure-cookies", false, "send browser session cookies without Secure, for development over plain http")
+	flag.StringVar(&appCfg.PasswordHash, "password-hash", "argon2id", "algorithm new password hashes are made with: argon2id or bcrypt")
+	flag.IntVar(&appCfg.PasswordPolicy.MinLength, "password-min-length", passpolicy.DefaultPolicy.MinLength, "fewest characters a new password may have")
+	flag.IntVar(&appCfg.PasswordPolicy.MinScore, "password-min-score", passpolicy.DefaultPolicy.MinScore, "lowest strength score (0-4) a new password may have")
+	flag.BoolVar(&appCfg.PasswordPolicy.CheckBreached, "password-breach-check", passpolicy.DefaultPolicy.CheckBreached, "reject new passwords found in the embedded breach list")
+	flag.StringVar(&appCfg.RateLimit, "rate-limit", "memory", "where rate limit buckets live: memory (per instance), postgres (shared by all instances) or off")
+	flag.BoolVar(&appCfg.RequireIfMatch, "require-if-match", false, "refuse workout updates and deletes without an If-Match header (428)")
+	flag.DurationVar(&appCfg.TrashRetention, "trash-retention", 30*24*time.Hour, "how long deleted workouts can be restored before they are purged")
 	flag.Parse()
+	traceCfg.ServiceName = "fem-api"
 
-	app, err := app.NewApplication()
+	shutdownTracing, err := telemetry.Setup(context.Background(), traceCfg)
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background()) // flush buffered spans
+
+	app, err := app.NewApplication(appCfg)
 	if err != nil {
 		panic(err)
 	}
 	defer app.DB.Close() // `defer` once everything is done
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go app.RunJobs(jobsCtx)
+
 	r := routes.SetupRoutes(app)
 
 	server := &http.Server{
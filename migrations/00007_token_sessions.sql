@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens
+ADD COLUMN created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+ADD COLUMN last_used_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN user_agent TEXT,
+ADD COLUMN ip TEXT;
+
+-- tokens issued before families existed become single-token sessions
+UPDATE tokens SET family_id = encode(hash, 'hex') WHERE family_id IS NULL AND scope = 'authentication';
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_idx ON tokens (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS tokens_user_id_idx;
+ALTER TABLE tokens DROP COLUMN created_at, DROP COLUMN last_used_at, DROP COLUMN user_agent, DROP COLUMN ip;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens
+ADD COLUMN name TEXT,
+ADD COLUMN api_scopes TEXT,
+ALTER COLUMN expiry DROP NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM tokens WHERE expiry IS NULL;
+ALTER TABLE tokens DROP COLUMN name, DROP COLUMN api_scopes, ALTER COLUMN expiry SET NOT NULL;
+-- +goose StatementEnd
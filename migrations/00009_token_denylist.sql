@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens ADD COLUMN jti TEXT;
+
+CREATE TABLE IF NOT EXISTS token_denylist (
+  jti TEXT PRIMARY KEY,
+  expires_at TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+-- signed access tokens are verified without reading `tokens`, so deleting
+-- their row is not enough: remember the jti until the token would have expired
+CREATE OR REPLACE FUNCTION deny_deleted_token() RETURNS trigger AS $$
+BEGIN
+  INSERT INTO token_denylist (jti, expires_at)
+  VALUES (OLD.jti, OLD.expiry)
+  ON CONFLICT (jti) DO NOTHING;
+  RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tokens_deny_on_delete
+AFTER DELETE ON tokens
+FOR EACH ROW
+WHEN (OLD.jti IS NOT NULL AND OLD.expiry IS NOT NULL)
+EXECUTE FUNCTION deny_deleted_token();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS tokens_deny_on_delete ON tokens;
+DROP FUNCTION IF EXISTS deny_deleted_token();
+DROP TABLE token_denylist;
+ALTER TABLE tokens DROP COLUMN jti;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE;
+
+-- accounts created before verification existed keep working as they did
+UPDATE users SET email_verified_at = COALESCE(created_at, CURRENT_TIMESTAMP);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM tokens WHERE scope = 'verification';
+ALTER TABLE users DROP COLUMN email_verified_at;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- after a rename the old username keeps pointing at the account for a grace period,
+-- and nobody else can register it in the meantime. expired rows are simply ignored
+CREATE TABLE IF NOT EXISTS username_redirects (
+  old_username VARCHAR(50) PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_username_redirects_user_id ON username_redirects(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE username_redirects;
+-- +goose StatementEnd
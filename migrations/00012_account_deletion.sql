@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN deletion_scheduled_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at)
+WHERE deletion_scheduled_at IS NOT NULL;
+
+-- archives are kept in the db so they go away with the account
+CREATE TABLE IF NOT EXISTS data_exports (
+  id TEXT PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  status TEXT NOT NULL DEFAULT 'pending',
+  archive BYTEA,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  started_at TIMESTAMP WITH TIME ZONE,
+  completed_at TIMESTAMP WITH TIME ZONE,
+  expires_at TIMESTAMP WITH TIME ZONE,
+  CONSTRAINT valid_export_status CHECK (status IN ('pending', 'running', 'ready', 'failed'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id);
+CREATE INDEX IF NOT EXISTS idx_data_exports_pending ON data_exports(created_at) WHERE status = 'pending';
+-- one export per user in flight, so parallel requests get the same one
+CREATE UNIQUE INDEX IF NOT EXISTS idx_data_exports_in_flight ON data_exports(user_id)
+WHERE status IN ('pending', 'running');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE data_exports;
+ALTER TABLE users DROP COLUMN deletion_scheduled_at;
+-- +goose StatementEnd
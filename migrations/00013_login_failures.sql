@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- failed logins per key, where a key is "account:<username>" or "ip:<address>".
+-- unknown usernames get rows too, so lockouts behave the same whether an account exists
+CREATE TABLE IF NOT EXISTS login_failures (
+  key TEXT PRIMARY KEY,
+  failures INTEGER NOT NULL,
+  last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  locked_until TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_failures_last_failure_at ON login_failures(last_failure_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE login_failures;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- totp_secret is AES-GCM encrypted by the app. it is set when enrollment starts and
+-- only counts once totp_enabled_at is set. totp_last_step stops a code from being used twice
+ALTER TABLE users
+  ADD COLUMN totp_secret BYTEA,
+  ADD COLUMN totp_enabled_at TIMESTAMP WITH TIME ZONE,
+  ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash BYTEA NOT NULL,
+  PRIMARY KEY (user_id, code_hash)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE recovery_codes;
+
+ALTER TABLE users
+  DROP COLUMN totp_secret,
+  DROP COLUMN totp_enabled_at,
+  DROP COLUMN totp_last_step;
+-- +goose StatementEnd
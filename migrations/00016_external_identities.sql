@@ -0,0 +1,38 @@
+-- +goose Up
+-- +goose StatementBegin
+-- accounts created through an identity provider have no password until they set one
+ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;
+
+-- subjects are only unique per provider, and stay the same when the email changes
+CREATE TABLE IF NOT EXISTS external_identities (
+  provider TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  email VARCHAR(255) NOT NULL DEFAULT '',
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  last_used_at TIMESTAMP WITH TIME ZONE,
+  PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_external_identities_user_id ON external_identities(user_id);
+
+-- logins waiting for the provider to redirect back, keyed by the hash of their state.
+-- the nonce and PKCE verifier never leave the server
+CREATE TABLE IF NOT EXISTS oidc_logins (
+  state_hash BYTEA PRIMARY KEY,
+  provider TEXT NOT NULL,
+  nonce TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE oidc_logins;
+DROP TABLE external_identities;
+
+-- '!' is no bcrypt hash, so these accounts cannot log in with a password
+UPDATE users SET password_hash = '!' WHERE password_hash IS NULL;
+ALTER TABLE users ALTER COLUMN password_hash SET NOT NULL;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- token buckets of ratelimit.Limiter, kept as the time each is full again.
+-- keys are "<policy>:<client>"; rows whose bucket is full are the same as none.
+-- unlogged: a crash only forgets who was throttled, not worth the WAL traffic
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+  key TEXT PRIMARY KEY,
+  full_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_full_at ON rate_limits(full_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE rate_limits;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- responses kept under an Idempotency-Key so retried requests get the original answer.
+-- status is NULL while the first request with the key is still being handled
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  key VARCHAR(255) NOT NULL,
+  fingerprint BYTEA NOT NULL,
+  status INTEGER,
+  headers JSONB,
+  body BYTEA,
+  created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE idempotency_keys;
+-- +goose StatementEnd
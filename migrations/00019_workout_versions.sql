@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- bumped by every update, it is the ETag clients send back in If-Match
+ALTER TABLE workouts ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE workouts DROP COLUMN version;
+-- +goose StatementEnd
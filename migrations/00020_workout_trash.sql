@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- deleted workouts stay in the trash until the purge job removes them for good
+ALTER TABLE workouts ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_workouts_deleted_at ON workouts(deleted_at)
+WHERE deleted_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE workouts DROP COLUMN deleted_at;
+-- +goose StatementEnd